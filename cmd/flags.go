@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -43,3 +44,67 @@ func (s *MapStringStringFlag) ToMapStringString() map[string]string {
 func NewMapStringStringFlag() MapStringStringFlag {
 	return MapStringStringFlag{Values: map[string]string{}}
 }
+
+// StringSliceFlag is a flag struct for comma separated lists of values
+type StringSliceFlag struct {
+	Values []string
+	// set tracks whether Values still holds the defaults, which are replaced the first time the flag is given
+	set bool
+}
+
+// String implements the flag.Var interface
+func (s *StringSliceFlag) String() string {
+	return strings.Join(s.Values, ",")
+}
+
+// Set implements the flag.Var interface
+func (s *StringSliceFlag) Set(value string) error {
+	if !s.set {
+		s.Values = []string{}
+		s.set = true
+	}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			s.Values = append(s.Values, v)
+		}
+	}
+	return nil
+}
+
+// NewStringSliceFlag creates a new flag var for storing a list of values, with some defaults
+func NewStringSliceFlag(defaults []string) StringSliceFlag {
+	return StringSliceFlag{Values: defaults}
+}
+
+// NonNegativeIntFlag is a flag struct for an int that must not be negative, stored in Value
+type NonNegativeIntFlag struct {
+	Value *int
+}
+
+// String implements the flag.Var interface
+func (s *NonNegativeIntFlag) String() string {
+	if s.Value == nil {
+		return "0"
+	}
+	return strconv.Itoa(*s.Value)
+}
+
+// Set implements the flag.Var interface
+func (s *NonNegativeIntFlag) Set(value string) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s is not an integer", value)
+	}
+	if i < 0 {
+		return fmt.Errorf("must not be negative, but got %d", i)
+	}
+	*s.Value = i
+	return nil
+}
+
+// NewNonNegativeIntFlag creates a new flag var storing a non-negative int in value, defaulting to defaultValue
+func NewNonNegativeIntFlag(value *int, defaultValue int) *NonNegativeIntFlag {
+	*value = defaultValue
+	return &NonNegativeIntFlag{Value: value}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	"github.com/tumblr/k8s-sidecar-injector/pkg/server"
+)
+
+// runInject implements the inject subcommand: it injects the manifests in the files named by args (or stdin) with
+// the configs in --config-directory, like the webhook would inject the pods created from them, and writes them
+// to stdout
+func runInject(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var (
+		configDirectory     string
+		annotationNamespace string
+		namespace           string
+		failurePolicy       string
+	)
+	ignoredNamespaces := NewStringSliceFlag(server.DefaultIgnoredNamespaces)
+
+	flags := newSubcommandFlagSet("inject", "[file...]", "Injects the pods and pod templates of the manifests in the files (or stdin, or -), and writes them to stdout", stderr)
+	flags.StringVar(&configDirectory, "config-directory", "conf/", "Config directory (will load all .yaml files in this directory)")
+	flags.StringVar(&annotationNamespace, "annotation-namespace", "injector.tumblr.com", "Override the AnnotationNamespace")
+	flags.StringVar(&namespace, "namespace", "default", "Namespace of the manifests that do not set one")
+	flags.StringVar(&failurePolicy, "default-failure-policy", config.FailurePolicyIgnore, "Whether manifests are written without injection (Ignore) or fail the command (Fail) when the configs they request cannot be injected, unless the configs set their own failurePolicy")
+	flags.Var(&ignoredNamespaces, "ignored-namespaces", "Namespaces that are never injected into. These should be name[,name2,...]; a name may be a glob (openshift-*) or a regexp wrapped in slashes (/^openshift-.*$/)")
+	flags.Var(NewNonNegativeIntFlag(&config.MaxInheritanceDepth, config.DefaultMaxInheritanceDepth), "max-inheritance-depth", "How many configs an Injection Config may inherit from, transitively")
+	if err := parseSubcommandFlags(flags, args); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadConfigDirectory(configDirectory)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %s", err.Error())
+	}
+	if annotationNamespace != "" {
+		cfg.AnnotationNamespace = annotationNamespace
+	}
+	if failurePolicy == "" || !config.ValidFailurePolicy(failurePolicy) {
+		return fmt.Errorf("invalid --default-failure-policy %q: must be %q or %q", failurePolicy, config.FailurePolicyIgnore, config.FailurePolicyFail)
+	}
+	ignoredNamespaceMatcher, err := server.NewNamespaceMatcher(ignoredNamespaces.Values)
+	if err != nil {
+		return fmt.Errorf("failed to parse --ignored-namespaces: %s", err.Error())
+	}
+	// without a cluster, namespaces cannot opt out, and configs with a namespaceSelector are never selected
+	whsvr := &server.WebhookServer{
+		Config:               cfg,
+		IgnoredNamespaces:    ignoredNamespaceMatcher,
+		DefaultFailurePolicy: failurePolicy,
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for i, file := range files {
+		if i > 0 {
+			if _, err := io.WriteString(stdout, "---\n"); err != nil {
+				return err
+			}
+		}
+		if file == "-" {
+			if err := whsvr.InjectManifests(stdin, stdout, namespace); err != nil {
+				return fmt.Errorf("stdin: %s", err.Error())
+			}
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		err = whsvr.InjectManifests(f, stdout, namespace)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err.Error())
+		}
+	}
+	return nil
+}
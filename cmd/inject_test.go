@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	_ "github.com/tumblr/k8s-sidecar-injector/internal/pkg/testing"
+)
+
+type subcommandTest struct {
+	name  string
+	args  []string
+	stdin string
+	code  int
+	// stdout is the expected output on stdout
+	stdout string
+	// stderr is what the output on stderr starts with
+	stderr string
+}
+
+// injectArgs returns args with the flags loading the configs requested by the manifest fixtures
+func injectArgs(args ...string) []string {
+	return append([]string{"--config-directory", "test/fixtures/sidecars", "--annotation-namespace", "injector.unittest.com"}, args...)
+}
+
+func TestInject(t *testing.T) {
+	injected, err := ioutil.ReadFile("test/fixtures/k8s/manifests/workloads-injected.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notInjected := `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+spec:
+  template:
+    metadata:
+      annotations:
+        injector.unittest.com/request: does-not-exist
+    spec:
+      containers:
+      - image: migrate:1.0
+        name: migrate
+      restartPolicy: Never
+`
+
+	tests := []subcommandTest{
+		{
+			name:   "workloads",
+			args:   injectArgs("test/fixtures/k8s/manifests/workloads.yaml"),
+			stdout: string(injected),
+		},
+		{
+			name:   "stdin",
+			args:   injectArgs(),
+			stdin:  "kind: ConfigMap\nmetadata:\n  name: not-a-workload\n",
+			stdout: "kind: ConfigMap\nmetadata:\n  name: not-a-workload\n",
+		},
+		{
+			name:   "missing config failing open",
+			args:   injectArgs("test/fixtures/k8s/manifests/missing-config.yaml"),
+			stdout: notInjected,
+		},
+		{
+			name:   "missing config failing closed",
+			args:   injectArgs("--default-failure-policy", "Fail", "test/fixtures/k8s/manifests/missing-config.yaml"),
+			code:   1,
+			stderr: "inject: test/fixtures/k8s/manifests/missing-config.yaml: Job migrate: Requested sidecar not found in configuration: does-not-exist\n",
+		},
+		{
+			name:   "invalid failure policy",
+			args:   injectArgs("--default-failure-policy", "Maybe"),
+			code:   1,
+			stderr: `inject: invalid --default-failure-policy "Maybe": must be "Ignore" or "Fail"` + "\n",
+		},
+		{
+			name:   "missing file",
+			args:   injectArgs("test/fixtures/does-not-exist.yaml"),
+			code:   1,
+			stderr: "inject: open test/fixtures/does-not-exist.yaml: no such file or directory\n",
+		},
+		{
+			name:   "missing config directory",
+			args:   []string{"--config-directory", "test/fixtures/does-not-exist"},
+			code:   1,
+			stderr: "inject: failed to load configuration: ",
+		},
+		{
+			name:   "help",
+			args:   []string{"-h"},
+			code:   1,
+			stderr: "Usage of ",
+		},
+	}
+	for _, test := range tests {
+		runSubcommandTest(t, "inject", test)
+	}
+}
+
+// runSubcommandTest runs the subcommand name like main would, and checks its exit code and output against test
+func runSubcommandTest(t *testing.T, name string, test subcommandTest) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runSubcommand(name, test.args, strings.NewReader(test.stdin), &stdout, &stderr)
+	if code != test.code {
+		t.Errorf("%s: expected exit code %d but got %d (stderr: %s)", test.name, test.code, code, stderr.String())
+	}
+	if stdout.String() != test.stdout {
+		t.Errorf("%s: expected output\n%s\nbut got\n%s", test.name, test.stdout, stdout.String())
+	}
+	if !strings.HasPrefix(stderr.String(), test.stderr) {
+		t.Errorf("%s: expected stderr to start with %q but got %q", test.name, test.stderr, stderr.String())
+	}
+}
@@ -25,6 +25,13 @@ import (
 	"github.com/dyson/certman"
 )
 
+// layers of the config store, by increasing precedence: configs from the k8s api override those on disk
+const (
+	configLayerDirectory         = "directory"
+	configLayerConfigMaps        = "configmaps"
+	configLayerSidecarInjections = "sidecarinjections"
+)
+
 var (
 	// EventCoalesceWindow is the window for coalescing events from ConfigMapWatcher
 	EventCoalesceWindow = time.Second * 3
@@ -43,17 +50,27 @@ func init() {
 	flag.Lookup("stderrthreshold").Value.Set("INFO")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage of %s [inject|validate]:\n", os.Args[0])
 		ShowVersion(os.Stderr)
 		flag.PrintDefaults()
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if _, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(runSubcommand(os.Args[1], os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
 	var (
-		parameters server.Parameters
+		parameters        server.Parameters
+		sidecarInjections bool
+		watchPods         bool
+		driftInterval     time.Duration
 	)
 	cmWatcherLabels := NewMapStringStringFlag()
+	ignoredNamespaces := NewStringSliceFlag(server.DefaultIgnoredNamespaces)
 	watcherConfig := watcher.NewConfig()
 
 	// get command line parameters
@@ -63,13 +80,21 @@ func main() {
 	flag.StringVar(&parameters.KeyFile, "tls-key-file", "/var/lib/secrets/cert.key", "File containing the x509 private key to --tls-cert-file.")
 	flag.StringVar(&parameters.ConfigDirectory, "config-directory", "conf/", "Config directory (will load all .yaml files in this directory)")
 	flag.StringVar(&parameters.AnnotationNamespace, "annotation-namespace", "injector.tumblr.com", "Override the AnnotationNamespace")
+	flag.StringVar(&parameters.FailurePolicy, "default-failure-policy", config.FailurePolicyIgnore, "Whether pods are admitted without injection (Ignore) or rejected (Fail) when the configs they request cannot be injected, unless the configs set their own failurePolicy")
+	flag.Var(&ignoredNamespaces, "ignored-namespaces", "Namespaces that are never injected into. These should be name[,name2,...]; a name may be a glob (openshift-*) or a regexp wrapped in slashes (/^openshift-.*$/)")
 	flag.StringVar(&watcherConfig.Namespace, "configmap-namespace", "", "Namespace to search for ConfigMaps to load Injection Configs from (default: current namespace)")
 	flag.Var(&cmWatcherLabels, "configmap-labels", "Label pairs used to discover ConfigMaps in Kubernetes. These should be key1=value[,key2=val2,...]")
 	flag.StringVar(&watcherConfig.MasterURL, "master-url", "", "Kubernetes master URL (used for running outside of the cluster)")
 	flag.StringVar(&watcherConfig.Kubeconfig, "kubeconfig", "", "Kubernetes kubeconfig (used only for running outside of the cluster)")
+	flag.DurationVar(&watcherConfig.ResyncPeriod, "resync-period", watcher.DefaultResyncPeriod, "How often watched ConfigMaps and SidecarInjections are reconciled even if they did not change (0 disables resyncs)")
+	flag.BoolVar(&sidecarInjections, "sidecar-injections", false, "Also load Injection Configs from SidecarInjection custom resources in --configmap-namespace (requires the SidecarInjection CRD)")
+	flag.BoolVar(&watchPods, "watch-pods", false, "Cache the pods of all namespaces, to report the ones injected with an outdated Injection Config on /stalepods")
+	flag.DurationVar(&driftInterval, "drift-interval", server.DefaultDriftInterval, "How often the workloads of pods injected with an outdated Injection Config are reported, with --watch-pods (0 disables the reports)")
+	flag.Var(NewNonNegativeIntFlag(&config.MaxInheritanceDepth, config.DefaultMaxInheritanceDepth), "max-inheritance-depth", "How many configs an Injection Config may inherit from, transitively")
 	flag.Parse()
 
 	watcherConfig.ConfigMapLabels = cmWatcherLabels.ToMapStringString()
+	parameters.IgnoredNamespaces = ignoredNamespaces.Values
 
 	glog.Infof("Launching k8s-sidecar-injector version=%s commit=%s branch=%s golang=%s\n", version.Version, version.Commit, version.Branch, runtime.Version())
 
@@ -84,12 +109,31 @@ func main() {
 		cfg.AnnotationNamespace = parameters.AnnotationNamespace
 	}
 
+	if parameters.FailurePolicy == "" || !config.ValidFailurePolicy(parameters.FailurePolicy) {
+		glog.Errorf("Invalid --default-failure-policy %q: must be %q or %q", parameters.FailurePolicy, config.FailurePolicyIgnore, config.FailurePolicyFail)
+		os.Exit(1)
+	}
+
+	ignoredNamespaceMatcher, err := server.NewNamespaceMatcher(parameters.IgnoredNamespaces)
+	if err != nil {
+		glog.Errorf("Failed to parse --ignored-namespaces: %v", err)
+		os.Exit(1)
+	}
+
 	// wire this up to cancel the context when we get shutdown signal
 	ctx, cancelContexts := context.WithCancel(context.Background())
 
 	glog.Infof("Loaded %d injection configs in annotation namespace %s:", len(cfg.Injections), cfg.AnnotationNamespace)
+	directoryInjectionConfigs := make([]*config.InjectionConfig, 0, len(cfg.Injections))
 	for _, v := range cfg.Injections {
-		glog.Infof("  %s", v.String())
+		glog.Infof("  %s from %s", v.String(), v.Source())
+		directoryInjectionConfigs = append(directoryInjectionConfigs, v)
+	}
+	// configs from the k8s api are reconciled into their own layers, so they never replace the ones from disk
+	configStore := config.NewStore(cfg, configLayerDirectory, configLayerConfigMaps, configLayerSidecarInjections)
+	if _, err := configStore.Update(map[string][]*config.InjectionConfig{configLayerDirectory: directoryInjectionConfigs}); err != nil {
+		glog.Errorf("Failed to load configuration: %v", err)
+		os.Exit(1)
 	}
 
 	// start up the watcher, and get the first batch of ConfigMaps
@@ -100,6 +144,38 @@ func main() {
 		glog.Errorf("Error creating ConfigMap watcher: %s", err.Error())
 		os.Exit(1)
 	}
+	var sidecarInjectionWatcher *watcher.K8sSidecarInjectionWatcher
+	if sidecarInjections {
+		sidecarInjectionWatcher, err = watcher.NewSidecarInjectionWatcher(*watcherConfig)
+		if err != nil {
+			glog.Errorf("Error creating SidecarInjection watcher: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// namespaces are cached to evaluate namespaceSelectors and the opt-out label without hitting the apiserver
+	namespaces := configWatcher.NamespaceCache()
+	go func() {
+		glog.Infof("launching watcher for Namespaces")
+		if err := namespaces.Watch(ctx); err != nil {
+			glog.Fatalf("error watching Namespaces (terminating): %s", err.Error())
+		}
+	}()
+
+	var podWatcher *watcher.K8sPodWatcher
+	if watchPods {
+		podWatcher, err = watcher.NewPodWatcher(*watcherConfig)
+		if err != nil {
+			glog.Errorf("Error creating Pod watcher: %s", err.Error())
+			os.Exit(1)
+		}
+		go func() {
+			glog.Infof("launching watcher for Pods")
+			if err := podWatcher.Watch(ctx); err != nil {
+				glog.Fatalf("error watching Pods (terminating): %s", err.Error())
+			}
+		}()
+	}
 
 	go func() {
 		// watch for reconciliation signals, and grab configmaps, then update the running configuration
@@ -110,46 +186,61 @@ func main() {
 		// debounce events from sigChan, so we dont hammer apiserver on reconciliation
 		eventsCh := coalescer.Coalesce(ctx, EventCoalesceWindow, sigChan)
 
+		// the informers behind the watchers re-establish dropped watches themselves, and relist with backoff
 		go func() {
-			for {
-				glog.Infof("launching watcher for ConfigMaps")
-				err := configWatcher.Watch(ctx, sigChan)
-				if err != nil {
-					switch err {
-					case watcher.ErrWatchChannelClosed:
-						glog.Errorf("watcher got error, try to restart watcher: %s", err.Error())
-					default:
-						glog.Fatalf("error watching for new ConfigMaps (terminating): %s", err.Error())
-					}
-				}
+			glog.Infof("launching watcher for ConfigMaps")
+			if err := configWatcher.Watch(ctx, sigChan); err != nil {
+				glog.Fatalf("error watching for new ConfigMaps (terminating): %s", err.Error())
 			}
 		}()
 
+		if sidecarInjectionWatcher != nil {
+			go func() {
+				glog.Infof("launching watcher for SidecarInjections")
+				if err := sidecarInjectionWatcher.Watch(ctx, sigChan); err != nil {
+					glog.Fatalf("error watching for new SidecarInjections (terminating): %s", err.Error())
+				}
+			}()
+		}
+
 		for {
 			select {
 			case <-eventsCh:
 				glog.V(1).Infof("triggering ConfigMap reconciliation")
-				updatedInjectionConfigs, err := configWatcher.Get(ctx)
+				updates := map[string][]*config.InjectionConfig{}
+				// ConfigMaps that fail to load dont fail Get; they keep serving their last-known-good configs
+				configMapInjectionConfigs, err := configWatcher.Get(ctx)
 				if err != nil {
-					glog.Errorf("error reconciling configmaps: %s", err.Error())
-					continue
+					glog.Errorf("error reconciling configmaps (keeping the previous configs): %s", err.Error())
+				} else {
+					updates[configLayerConfigMaps] = configMapInjectionConfigs
 				}
-				glog.V(1).Infof("got %d updated InjectionConfigs from reconciliation", len(updatedInjectionConfigs))
-
-				newInjectionConfigs := make([]*config.InjectionConfig, len(updatedInjectionConfigs)+len(cfg.Injections))
-				{
-					i := 0
-					for k := range cfg.Injections {
-						newInjectionConfigs[i] = cfg.Injections[k]
-						i++
-					}
-					for i, watched := range updatedInjectionConfigs {
-						newInjectionConfigs[i+len(cfg.Injections)] = watched
+				if sidecarInjectionWatcher != nil {
+					sidecarInjectionConfigs, err := sidecarInjectionWatcher.Get(ctx)
+					if err != nil {
+						glog.Errorf("error reconciling SidecarInjections (keeping the previous configs): %s", err.Error())
+					} else {
+						updates[configLayerSidecarInjections] = sidecarInjectionConfigs
 					}
 				}
+				if len(updates) == 0 {
+					continue
+				}
+				glog.V(1).Infof("got %d updated InjectionConfigs from ConfigMaps and %d from SidecarInjections", len(updates[configLayerConfigMaps]), len(updates[configLayerSidecarInjections]))
 
-				glog.V(1).Infof("updating server with newly loaded configurations (%d loaded from disk, %d loaded from k8s api)", len(cfg.Injections), len(updatedInjectionConfigs))
-				cfg.ReplaceInjectionConfigs(newInjectionConfigs)
+				// configs from the k8s api inherit by name, from any other config
+				inheritanceErrors, err := configStore.Update(updates)
+				if err != nil {
+					glog.Errorf("error updating configs: %s", err.Error())
+					continue
+				}
+				for name, err := range inheritanceErrors {
+					glog.Errorf("unable to resolve inheritance of InjectionConfig %s (not loading it): %s", name, err.Error())
+				}
+				configWatcher.SetInheritanceErrors(inheritanceErrors)
+				if sidecarInjectionWatcher != nil {
+					sidecarInjectionWatcher.UpdateStatuses(ctx, inheritanceErrors)
+				}
 				glog.V(1).Infof("configuration replaced")
 			}
 		}
@@ -167,6 +258,26 @@ func main() {
 		Server: &http.Server{
 			Addr: fmt.Sprintf(":%v", parameters.TLSPort),
 		},
+		Namespaces:           namespaces,
+		IgnoredNamespaces:    ignoredNamespaceMatcher,
+		ConfigMaps:           configWatcher,
+		ConfigMapSelector:    server.NewConfigMapSelector(watcherConfig.ConfigMapLabels),
+		ConfigNamespace:      configWatcher.Namespace,
+		DefaultFailurePolicy: parameters.FailurePolicy,
+	}
+	if podWatcher != nil {
+		whsvr.Pods = podWatcher
+		if driftInterval > 0 {
+			whsvr.Drift = &server.DriftReconciler{
+				Server:      whsvr,
+				ReplicaSets: podWatcher.ReplicaSets,
+				Recorder:    podWatcher.Recorder,
+			}
+			go func() {
+				glog.Infof("launching drift reconciler every %s", driftInterval)
+				whsvr.Drift.Run(ctx, driftInterval, podWatcher.HasSynced)
+			}()
+		}
 	}
 
 	if parameters.CertFile != "" && parameters.KeyFile != "" {
@@ -185,10 +296,18 @@ func main() {
 	// define secure mux for routing requests that come in over our TLS port
 	secureMux := mux.NewRouter()
 	secureMux.Handle("/mutate", whsvr.MutateHandler())
+	secureMux.Handle("/validate", whsvr.ValidateHandler())
 	secureMux.Handle("/health", whsvr.HealthHandler())
 	loggedSecureRouter := handlers.CombinedLoggingHandler(os.Stdout, secureMux)
 	whsvr.Server.Handler = loggedSecureRouter
 
+	// pods in namespaces opting out of injection can only be told apart once namespaces are cached
+	glog.Infof("Waiting for the Namespace cache to sync")
+	if !namespaces.WaitForSync(ctx) {
+		glog.Errorf("Failed to sync the Namespace cache")
+		os.Exit(1)
+	}
+
 	// start webhook server in new rountine
 	glog.Infof("Launching sidecar injector server (http+tls) on :%d", parameters.TLSPort)
 	go func() {
@@ -209,9 +328,22 @@ func main() {
 	insecureMux := mux.NewRouter()
 	insecureMux.Handle("/metrics", whsvr.MetricsHandler())
 	insecureMux.Handle("/health", whsvr.HealthHandler())
+	insecureMux.Handle("/configmaps", whsvr.ConfigMapsHandler())
+	insecureMux.Handle("/stalepods", whsvr.StalePodsHandler())
+	insecureMux.Handle("/drift", whsvr.DriftHandler())
+	insecureMux.Handle("/preview", whsvr.PreviewHandler())
+	insecureMux.Handle("/configs", whsvr.ConfigsHandler())
+	insecureMux.PathPrefix("/configs/").Handler(whsvr.ConfigsHandler())
 	loggedInsecureRouter := handlers.CombinedLoggingHandler(os.Stdout, insecureMux)
 	lifecycleServer.Handler = loggedInsecureRouter
 
+	// pods in namespaces opting out of injection can only be told apart once namespaces are cached
+	glog.Infof("Waiting for the Namespace cache to sync")
+	if !namespaces.WaitForSync(ctx) {
+		glog.Errorf("Failed to sync the Namespace cache")
+		os.Exit(1)
+	}
+
 	// start webhook server in new rountine
 	glog.Infof("Launching lifecycle server (http) on :%d", parameters.LifecyclePort)
 	go func() {
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// subcommands run instead of the server when named by the first argument. They return flag.ErrHelp if
+// asked for their usage.
+var subcommands = map[string]func(args []string, stdin io.Reader, stdout, stderr io.Writer) error{
+	"inject":   runInject,
+	"validate": runValidate,
+	"lint":     runValidate,
+}
+
+// runSubcommand runs the subcommand name with args, and returns the exit code of the command: 0 if it succeeded,
+// 1 otherwise. Errors are written to stderr, except flag.ErrHelp, for which the usage was already written.
+func runSubcommand(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if err := subcommands[name](args, stdin, stdout, stderr); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(stderr, "%s: %s\n", name, err.Error())
+		}
+		return 1
+	}
+	return 0
+}
+
+// newSubcommandFlagSet returns the flags of the subcommand name, whose usage is printed to stderr
+func newSubcommandFlagSet(name, arguments, description string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage of %s %s [flags] %s:\n%s\n", os.Args[0], name, arguments, description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseSubcommandFlags parses args into flags, along with the glog flags, which are registered on the command
+// line flags that subcommands do not parse otherwise
+func parseSubcommandFlags(flags *flag.FlagSet, args []string) error {
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return flag.CommandLine.Parse(nil)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config/lint"
+)
+
+// runValidate implements the validate subcommand: it loads the InjectionConfigs in the directories and files
+// named by args (or --config-directory), and writes them to stdout as yaml, merged with the configs they inherit.
+// If any config does not load, the problems are written to stdout as json instead, and an error is returned.
+func runValidate(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var configDirectory string
+
+	flags := newSubcommandFlagSet("validate", "[directory|file...]", "Validates the Injection Configs in the directories (like --config-directory), and the files holding an Injection Config, or ConfigMaps and SidecarInjections, and prints the configs as they would be loaded", stderr)
+	flags.StringVar(&configDirectory, "config-directory", "conf/", "Config directory to validate if no directory or file is given")
+	flags.Var(NewNonNegativeIntFlag(&config.MaxInheritanceDepth, config.DefaultMaxInheritanceDepth), "max-inheritance-depth", "How many configs an Injection Config may inherit from, transitively")
+	if err := parseSubcommandFlags(flags, args); err != nil {
+		return err
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{configDirectory}
+	}
+	result := lint.Lint(paths)
+	if len(result.Problems) > 0 {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+		return fmt.Errorf("%d problems found in injection configs", len(result.Problems))
+	}
+	if len(result.Configs) == 0 {
+		return config.ErrNoConfigurationLoaded
+	}
+	return result.WriteConfigs(stdout)
+}
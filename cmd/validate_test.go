@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	problems := `{
+  "errors": [
+    {
+      "source": "test/fixtures/sidecars/bad/ports.yaml",
+      "config": "ports:latest",
+      "field": "containers[0].ports[1].containerPort",
+      "type": "FieldValueInvalid",
+      "message": "Invalid value: 90000: must be between 1 and 65535, inclusive"
+    },
+    {
+      "source": "test/fixtures/sidecars/bad/ports.yaml",
+      "config": "ports:latest",
+      "field": "containers[1].ports[0].containerPort",
+      "type": "FieldValueDuplicate",
+      "message": "Duplicate value: \"8080/TCP, also used by containers[0].ports[0]\""
+    }
+  ]
+}
+`
+
+	tests := []subcommandTest{
+		{
+			name: "valid",
+			args: []string{"test/fixtures/k8s/sidecarinjection-logger.yaml"},
+			stdout: `# logger:v1 from test/fixtures/k8s/sidecarinjection-logger.yaml: SidecarInjection logger
+containers:
+- image: logger:1.0
+  name: logger
+  resources: {}
+env:
+- name: LOG_LEVEL
+  value: info
+name: logger:v1
+`,
+		},
+		{
+			name:   "invalid",
+			args:   []string{"test/fixtures/sidecars/bad/ports.yaml"},
+			code:   1,
+			stdout: problems,
+			stderr: "validate: 2 problems found in injection configs\n",
+		},
+		{
+			name:   "no configs",
+			args:   []string{"--config-directory", t.TempDir()},
+			code:   1,
+			stderr: "validate: at least one config must be present in the --config-directory\n",
+		},
+		{
+			name:   "negative inheritance depth",
+			args:   []string{"--max-inheritance-depth", "-1"},
+			code:   1,
+			stderr: `invalid value "-1" for flag -max-inheritance-depth: must not be negative, but got -1` + "\n",
+		},
+		{
+			name:   "help",
+			args:   []string{"-h"},
+			code:   1,
+			stderr: "Usage of ",
+		},
+	}
+	for _, test := range tests {
+		runSubcommandTest(t, "validate", test)
+	}
+
+	// lint is another name for validate
+	runSubcommandTest(t, "lint", subcommandTest{
+		name:   "lint",
+		args:   []string{"test/fixtures/sidecars/bad/ports.yaml"},
+		code:   1,
+		stdout: problems,
+		stderr: "lint: 2 problems found in injection configs\n",
+	})
+}
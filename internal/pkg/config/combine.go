@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CombineInjectionConfigs combines several InjectionConfigs into a single InjectionConfig, so that multiple
+// sidecars can be requested by a single pod. Unlike Merge, nothing is overridden: if two configs define a
+// container, volume, environment variable or volume mount with the same name but a different definition,
+// or set a different serviceAccountName, policy, label, annotation or pod level setting (like the same
+// nodeSelector key to different values), an error wrapping ErrConflictingInjectionConfigs is returned
+// describing every conflict. Identical definitions are only injected once.
+//
+// The passed configs are not mutated. If only one config is passed, it is returned as is.
+func CombineInjectionConfigs(ics ...*InjectionConfig) (*InjectionConfig, error) {
+	if len(ics) == 0 {
+		return nil, ErrCannotMergeNilInjectionConfig
+	}
+	if len(ics) == 1 {
+		return ics[0], nil
+	}
+
+	combined := InjectionConfig{}
+	conflicts := []string{}
+	// owners tracks which config first defined a named thing, keyed by "<kind> <name>"
+	owners := map[string]string{}
+	// claim returns true if the named thing should be added to the combined config, and records
+	// a conflict if it was already claimed by another config with a different definition
+	claim := func(kind, name, owner string, isSame func() bool) bool {
+		key := kind + " " + name
+		prev, ok := owners[key]
+		if !ok {
+			owners[key] = owner
+			return true
+		}
+		if !isSame() {
+			conflicts = append(conflicts, fmt.Sprintf("%s %s is defined by both %s and %s", kind, name, prev, owner))
+		}
+		return false
+	}
+
+	names := make([]string, len(ics))
+	for i, ic := range ics {
+		if ic == nil {
+			return nil, ErrCannotMergeNilInjectionConfig
+		}
+		owner := ic.FullName()
+		names[i] = owner
+
+		// container names must be unique across containers and initContainers in a pod
+		for _, ctr := range ic.Containers {
+			ctr := ctr
+			if claim("container", ctr.Name, owner, func() bool { return hasSameContainer(combined.Containers, ctr) }) {
+				combined.Containers = append(combined.Containers, ctr)
+			}
+		}
+		for _, ctr := range ic.InitContainers {
+			ctr := ctr
+			if claim("container", ctr.Name, owner, func() bool { return hasSameContainer(combined.InitContainers, ctr) }) {
+				combined.InitContainers = append(combined.InitContainers, ctr)
+			}
+		}
+		for _, v := range ic.Volumes {
+			v := v
+			if claim("volume", v.Name, owner, func() bool {
+				for _, existing := range combined.Volumes {
+					if existing.Name == v.Name {
+						return reflect.DeepEqual(existing, v)
+					}
+				}
+				return false
+			}) {
+				combined.Volumes = append(combined.Volumes, v)
+			}
+		}
+		for _, e := range ic.Environment {
+			e := e
+			if claim("env", e.Name, owner, func() bool {
+				for _, existing := range combined.Environment {
+					if existing.Name == e.Name {
+						return reflect.DeepEqual(existing, e)
+					}
+				}
+				return false
+			}) {
+				combined.Environment = append(combined.Environment, e)
+			}
+		}
+		for _, vm := range ic.VolumeMounts {
+			vm := vm
+			if claim("volumeMount", vm.Name, owner, func() bool {
+				for _, existing := range combined.VolumeMounts {
+					if existing.Name == vm.Name {
+						return reflect.DeepEqual(existing, vm)
+					}
+				}
+				return false
+			}) {
+				combined.VolumeMounts = append(combined.VolumeMounts, vm)
+			}
+		}
+
+		if ic.ServiceAccountName != "" {
+			if combined.ServiceAccountName == "" {
+				combined.ServiceAccountName = ic.ServiceAccountName
+				owners["serviceAccountName"] = owner
+			} else if combined.ServiceAccountName != ic.ServiceAccountName {
+				conflicts = append(conflicts, fmt.Sprintf("serviceAccountName is set to %s by %s and to %s by %s",
+					combined.ServiceAccountName, owners["serviceAccountName"], ic.ServiceAccountName, owner))
+			}
+		}
+
+		// a policy only matters to configs with entries to apply it to, and the combined config can only
+		// have one
+		if len(ic.Environment) > 0 {
+			if combined.EnvPolicy == "" {
+				combined.EnvPolicy = ic.GetEnvPolicy()
+				owners["envPolicy"] = owner
+			} else if combined.EnvPolicy != ic.GetEnvPolicy() {
+				conflicts = append(conflicts, fmt.Sprintf("envPolicy is set to %s by %s and to %s by %s",
+					combined.EnvPolicy, owners["envPolicy"], ic.GetEnvPolicy(), owner))
+			}
+		}
+		if len(ic.VolumeMounts) > 0 {
+			if combined.VolumeMountPolicy == "" {
+				combined.VolumeMountPolicy = ic.GetVolumeMountPolicy()
+				owners["volumeMountPolicy"] = owner
+			} else if combined.VolumeMountPolicy != ic.GetVolumeMountPolicy() {
+				conflicts = append(conflicts, fmt.Sprintf("volumeMountPolicy is set to %s by %s and to %s by %s",
+					combined.VolumeMountPolicy, owners["volumeMountPolicy"], ic.GetVolumeMountPolicy(), owner))
+			}
+		}
+
+		combined.Labels, conflicts = combineStringMaps("label", combined.Labels, ic.Labels, owner, owners, conflicts)
+		combined.Annotations, conflicts = combineStringMaps("annotation", combined.Annotations, ic.Annotations, owner, owners, conflicts)
+		if len(ic.Labels) > 0 || len(ic.Annotations) > 0 {
+			if combined.MetadataPolicy == "" {
+				combined.MetadataPolicy = effectivePolicy(ic.MetadataPolicy)
+				owners["metadataPolicy"] = owner
+			} else if combined.MetadataPolicy != effectivePolicy(ic.MetadataPolicy) {
+				conflicts = append(conflicts, fmt.Sprintf("metadataPolicy is set to %s by %s and to %s by %s",
+					combined.MetadataPolicy, owners["metadataPolicy"], effectivePolicy(ic.MetadataPolicy), owner))
+			}
+		}
+
+		// failing closed is never a conflict: if any of the configs must not be left out, none may
+		if combined.FailurePolicy != FailurePolicyFail && ic.FailurePolicy != "" {
+			combined.FailurePolicy = ic.FailurePolicy
+		}
+
+		podSettingsConflicts, err := combined.combinePodSettings(ic, owner, owners)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, podSettingsConflicts...)
+
+		// host aliases are merged by IP, with the union of their hostnames, and the host settings can only be
+		// turned on, so neither can conflict
+		combined.HostAliases = mergeHostAliases(combined.HostAliases, ic.HostAliases)
+		if len(ic.PodVolumes) > 0 {
+			combined.PodVolumes = unionStrings(combined.PodVolumes, ic.PodVolumes)
+		}
+		combined.HostNetwork = combined.HostNetwork || ic.HostNetwork
+		combined.HostPID = combined.HostPID || ic.HostPID
+	}
+
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrConflictingInjectionConfigs, strings.Join(conflicts, "; "))
+	}
+
+	combined.Name = strings.Join(names, ",")
+	combined.members = names
+	return &combined, nil
+}
+
+func hasSameContainer(existing []corev1.Container, ctr corev1.Container) bool {
+	for _, c := range existing {
+		if c.Name == ctr.Name {
+			return reflect.DeepEqual(c, ctr)
+		}
+	}
+	return false
+}
@@ -1,17 +1,24 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const (
@@ -28,6 +35,9 @@ var (
 	ErrCannotMergeNilInjectionConfig = fmt.Errorf("cannot merge nil InjectionConfig")
 	// ErrUnsupportedNameVersionFormat indicates the format of the name is invalid
 	ErrUnsupportedNameVersionFormat = fmt.Errorf(`not a valid name or name:version format`)
+	// ErrConflictingInjectionConfigs indicates that InjectionConfigs cannot be combined, because they define
+	// different things with the same name
+	ErrConflictingInjectionConfigs = fmt.Errorf(`injection configs conflict`)
 )
 
 // InjectionConfig is a specific instance of a injected config, for a given annotation
@@ -44,7 +54,87 @@ type InjectionConfig struct {
 	InitContainers     []corev1.Container   `json:"initContainers"`
 	ServiceAccountName string               `json:"serviceAccountName"`
 
+	// NamespaceSelector and PodSelector make this config apply automatically to pods that carry no request
+	// annotation. A pod is selected when it matches PodSelector and runs in a namespace matching
+	// NamespaceSelector; a nil selector matches everything, but at least one of them must be set.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// ContainerMergeStrategy controls how this config's containers and init containers are merged into
+	// the ones it inherits: "replace" (the default) or "strategic"
+	ContainerMergeStrategy string `json:"containerMergeStrategy,omitempty"`
+
+	// ContainerOrder controls where containers and init containers that are new in this config go, relative
+	// to the ones it inherits: "append" (the default) or "prepend"
+	ContainerOrder string `json:"containerOrder,omitempty"`
+
+	// EnvPolicy and VolumeMountPolicy control how Environment and VolumeMounts are applied to the
+	// existing containers of a pod: "add-only" (the default), "override" or "remove"
+	EnvPolicy         string `json:"envPolicy,omitempty"`
+	VolumeMountPolicy string `json:"volumeMountPolicy,omitempty"`
+
+	// PodVolumes names the volumes of the pods this config is injected into that its containers mount. Other
+	// volumes its containers mount must be defined in Volumes (see Validate).
+	PodVolumes []string `json:"podVolumes,omitempty"`
+
+	// Labels and Annotations are added to the pod. MetadataPolicy controls what happens to the labels and
+	// annotations the pod already has: "add-only" (the default) keeps them, "override" replaces them, and
+	// "remove" removes them instead of adding anything
+	Labels         map[string]string `json:"labels,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	MetadataPolicy string            `json:"metadataPolicy,omitempty"`
+
+	// pod level settings. They never override what the pod sets itself: lists are added to, and maps and
+	// structs only get the keys and fields the pod does not set (see the server's createPatch)
+	Tolerations           []corev1.Toleration           `json:"tolerations,omitempty"`
+	NodeSelector          map[string]string             `json:"nodeSelector,omitempty"`
+	Affinity              *corev1.Affinity              `json:"affinity,omitempty"`
+	PriorityClassName     string                        `json:"priorityClassName,omitempty"`
+	DNSConfig             *corev1.PodDNSConfig          `json:"dnsConfig,omitempty"`
+	ImagePullSecrets      []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	ShareProcessNamespace *bool                         `json:"shareProcessNamespace,omitempty"`
+	SecurityContext       *corev1.PodSecurityContext    `json:"securityContext,omitempty"`
+
+	// FailurePolicy controls what happens to pods requesting this config when it cannot be injected: "Ignore"
+	// admits them without injection, "Fail" rejects them. If unset, the default of the server applies.
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+
+	// Remove names inherited entries this config removes
+	Remove *InheritedRemovals `json:"remove,omitempty"`
+
+	// Template enables rendering container args, env values and volume paths as go templates with the
+	// metadata and spec of the pod being injected (see Render)
+	Template bool `json:"template,omitempty"`
+
 	version string
+	// members holds the full names of the InjectionConfigs this config was combined from, if any
+	members []string
+	// rawContainers are the containers as written, if ContainerMergeStrategy is strategic
+	rawContainers *rawContainers
+	// resolved is set once Inherits was merged in, or if Inherits needs no resolving by name, i.e. for
+	// configs loaded from files
+	resolved bool
+	// source is where the config was loaded from, see Source
+	source string
+	// inheritance is the chain of configs merged into this one, see InheritanceChain. It is nil for configs
+	// that inherit nothing.
+	inheritance []InheritedConfig
+}
+
+// Hash returns a hex encoded sha256 of the content of the InjectionConfig. Pods record the hash of the config
+// as rendered for them (see Render), and as loaded, with its inheritance resolved: comparing the latter with
+// the hash of the currently loaded config tells whether the config changed since.
+func (c *InjectionConfig) Hash() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	// the version is not part of the serialized config
+	h.Write([]byte(c.FullName()))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // Config is a struct indicating how a given injection should be configured
@@ -52,6 +142,11 @@ type Config struct {
 	sync.RWMutex
 	AnnotationNamespace string                      `yaml:"annotationnamespace"`
 	Injections          map[string]*InjectionConfig `yaml:"injections"`
+
+	// lastReload is when Injections were last loaded or replaced
+	lastReload time.Time
+	// loaded records the hash of each of Injections, and since when it is loaded with that hash
+	loaded map[string]loadedVersion
 }
 
 // String returns a string representation of the config
@@ -65,7 +160,15 @@ func (c *InjectionConfig) String() string {
 	if c.ServiceAccountName != "" {
 		saString = fmt.Sprintf(", serviceAccountName %s", c.ServiceAccountName)
 	}
-	return fmt.Sprintf("%s%s: %d containers, %d init containers, %d volumes, %d environment vars, %d volume mounts, %d host aliases%s",
+
+	selectorString := ""
+	if c.NamespaceSelector != nil {
+		selectorString += fmt.Sprintf(", namespaceSelector %s", metav1.FormatLabelSelector(c.NamespaceSelector))
+	}
+	if c.PodSelector != nil {
+		selectorString += fmt.Sprintf(", podSelector %s", metav1.FormatLabelSelector(c.PodSelector))
+	}
+	return fmt.Sprintf("%s%s: %d containers, %d init containers, %d volumes, %d environment vars, %d volume mounts, %d host aliases%s%s",
 		c.FullName(),
 		inheritsString,
 		len(c.Containers),
@@ -74,7 +177,35 @@ func (c *InjectionConfig) String() string {
 		len(c.Environment),
 		len(c.VolumeMounts),
 		len(c.HostAliases),
-		saString)
+		saString,
+		selectorString)
+}
+
+// HasSelectors returns true if this config is injected automatically into pods selected by its
+// NamespaceSelector and PodSelector
+func (c *InjectionConfig) HasSelectors() bool {
+	return c.NamespaceSelector != nil || c.PodSelector != nil
+}
+
+// SelectsPod returns true if a pod with podLabels is selected by PodSelector
+func (c *InjectionConfig) SelectsPod(podLabels map[string]string) (bool, error) {
+	return selectorMatches(c.PodSelector, podLabels)
+}
+
+// SelectsNamespace returns true if a namespace with namespaceLabels is selected by NamespaceSelector
+func (c *InjectionConfig) SelectsNamespace(namespaceLabels map[string]string) (bool, error) {
+	return selectorMatches(c.NamespaceSelector, namespaceLabels)
+}
+
+func selectorMatches(selector *metav1.LabelSelector, l map[string]string) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	return s.Matches(labels.Set(l)), nil
 }
 
 // Version returns the parsed version of this injection config. If no version is specified,
@@ -89,8 +220,12 @@ func (c *InjectionConfig) Version() string {
 }
 
 // FullName returns the full identifier of this sidecar - both the Name, and the Version(), formatted like
-// "${.Name}:${.Version}"
+// "${.Name}:${.Version}". For a config produced by CombineInjectionConfigs, this is the comma separated list
+// of the full names of the configs it was combined from.
 func (c *InjectionConfig) FullName() string {
+	if len(c.members) > 0 {
+		return strings.Join(c.members, ",")
+	}
 	return canonicalizeConfigName(c.Name, c.Version())
 }
 
@@ -104,6 +239,23 @@ func (c *Config) ReplaceInjectionConfigs(replacementConfigs []*InjectionConfig)
 	for _, r := range replacementConfigs {
 		c.Injections[r.FullName()] = r
 	}
+	c.recordReload(time.Now())
+}
+
+// SelectorInjectionConfigs returns all InjectionConfigs that have a NamespaceSelector or PodSelector, sorted by
+// their FullName
+func (c *Config) SelectorInjectionConfigs() []*InjectionConfig {
+	c.RLock()
+	defer c.RUnlock()
+
+	ics := []*InjectionConfig{}
+	for _, ic := range c.Injections {
+		if ic.HasSelectors() {
+			ics = append(ics, ic)
+		}
+	}
+	sort.Slice(ics, func(i, j int) bool { return ics[i].FullName() < ics[j].FullName() })
+	return ics
 }
 
 // HasInjectionConfig returns bool for whether the config contains a config
@@ -171,12 +323,99 @@ func LoadConfigDirectory(path string) (*Config, error) {
 	if cfg.AnnotationNamespace == "" {
 		cfg.AnnotationNamespace = annotationNamespaceDefault
 	}
+	cfg.recordReload(time.Now())
 
 	glog.V(2).Infof("Loaded %d injection configs from %s", len(cfg.Injections), glob)
 
 	return &cfg, nil
 }
 
+// DeepCopy returns a copy of c that shares no memory with c
+func (c *InjectionConfig) DeepCopy() *InjectionConfig {
+	out := *c
+	out.Containers = deepCopyContainers(c.Containers)
+	out.InitContainers = deepCopyContainers(c.InitContainers)
+	if c.Volumes != nil {
+		out.Volumes = make([]corev1.Volume, len(c.Volumes))
+		for i := range c.Volumes {
+			c.Volumes[i].DeepCopyInto(&out.Volumes[i])
+		}
+	}
+	if c.Environment != nil {
+		out.Environment = make([]corev1.EnvVar, len(c.Environment))
+		for i := range c.Environment {
+			c.Environment[i].DeepCopyInto(&out.Environment[i])
+		}
+	}
+	if c.VolumeMounts != nil {
+		out.VolumeMounts = make([]corev1.VolumeMount, len(c.VolumeMounts))
+		for i := range c.VolumeMounts {
+			c.VolumeMounts[i].DeepCopyInto(&out.VolumeMounts[i])
+		}
+	}
+	if c.PodVolumes != nil {
+		out.PodVolumes = append([]string{}, c.PodVolumes...)
+	}
+	if c.HostAliases != nil {
+		out.HostAliases = make([]corev1.HostAlias, len(c.HostAliases))
+		for i := range c.HostAliases {
+			c.HostAliases[i].DeepCopyInto(&out.HostAliases[i])
+		}
+	}
+	if c.Tolerations != nil {
+		out.Tolerations = make([]corev1.Toleration, len(c.Tolerations))
+		for i := range c.Tolerations {
+			c.Tolerations[i].DeepCopyInto(&out.Tolerations[i])
+		}
+	}
+	out.Labels = copyStringMap(c.Labels)
+	out.Annotations = copyStringMap(c.Annotations)
+	out.NodeSelector = copyStringMap(c.NodeSelector)
+	out.Affinity = c.Affinity.DeepCopy()
+	out.DNSConfig = c.DNSConfig.DeepCopy()
+	if c.ImagePullSecrets != nil {
+		out.ImagePullSecrets = append([]corev1.LocalObjectReference{}, c.ImagePullSecrets...)
+	}
+	if c.ShareProcessNamespace != nil {
+		shareProcessNamespace := *c.ShareProcessNamespace
+		out.ShareProcessNamespace = &shareProcessNamespace
+	}
+	out.SecurityContext = c.SecurityContext.DeepCopy()
+	out.Remove = c.Remove.DeepCopy()
+	out.NamespaceSelector = c.NamespaceSelector.DeepCopy()
+	out.PodSelector = c.PodSelector.DeepCopy()
+	if c.members != nil {
+		out.members = append([]string{}, c.members...)
+	}
+	if c.inheritance != nil {
+		out.inheritance = append([]InheritedConfig{}, c.inheritance...)
+	}
+	// rawContainers are never modified, so they can be shared
+	return &out
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func deepCopyContainers(containers []corev1.Container) []corev1.Container {
+	if containers == nil {
+		return nil
+	}
+	out := make([]corev1.Container, len(containers))
+	for i := range containers {
+		containers[i].DeepCopyInto(&out[i])
+	}
+	return out
+}
+
 // Merge mutates c by merging in fields from child, to create an inheritance
 // functionality.
 func (c *InjectionConfig) Merge(child *InjectionConfig) error {
@@ -187,21 +426,25 @@ func (c *InjectionConfig) Merge(child *InjectionConfig) error {
 	c.Name = child.Name
 	c.version = child.version
 	c.Inherits = child.Inherits
-
-	// merge containers
-	for _, cctr := range child.Containers {
-		contains := false
-
-		for bi, bctr := range c.Containers {
-			if bctr.Name == cctr.Name {
-				contains = true
-				c.Containers[bi] = cctr
-			}
-		}
-
-		if !contains {
-			c.Containers = append(c.Containers, cctr)
+	c.source = child.source
+
+	// removals only apply to what is inherited, so the child can remove and redefine something. once applied,
+	// there is nothing left to remove, whatever the base itself removed.
+	c.remove(child.Remove)
+	c.Remove = nil
+
+	inheritedContainers := containerNames(c.Containers)
+	inheritedInitContainers := containerNames(c.InitContainers)
+	if child.ContainerMergeStrategy == ContainerMergeStrategyStrategic {
+		if err := c.mergeContainersStrategic(child); err != nil {
+			return err
 		}
+	} else {
+		c.mergeContainersReplace(child)
+	}
+	if child.ContainerOrder == ContainerOrderPrepend {
+		c.Containers = prependNewContainers(c.Containers, inheritedContainers)
+		c.InitContainers = prependNewContainers(c.InitContainers, inheritedInitContainers)
 	}
 
 	// merge volumes
@@ -252,9 +495,70 @@ func (c *InjectionConfig) Merge(child *InjectionConfig) error {
 		}
 	}
 
-	// merge host aliases
-	// note: we do not need to merge things, as entries are not keyed
-	c.HostAliases = append(c.HostAliases, child.HostAliases...)
+	c.HostAliases = mergeHostAliases(c.HostAliases, child.HostAliases)
+	if len(child.PodVolumes) > 0 {
+		c.PodVolumes = unionStrings(c.PodVolumes, child.PodVolumes)
+	}
+
+	// merge labels and annotations by key
+	c.Labels = mergeStringMaps(c.Labels, child.Labels)
+	c.Annotations = mergeStringMaps(c.Annotations, child.Annotations)
+
+	if err := c.mergePodSettings(child); err != nil {
+		return err
+	}
+
+	// policies are inherited unless the child sets its own
+	if child.EnvPolicy != "" {
+		c.EnvPolicy = child.EnvPolicy
+	}
+	if child.VolumeMountPolicy != "" {
+		c.VolumeMountPolicy = child.VolumeMountPolicy
+	}
+	if child.MetadataPolicy != "" {
+		c.MetadataPolicy = child.MetadataPolicy
+	}
+	if child.FailurePolicy != "" {
+		c.FailurePolicy = child.FailurePolicy
+	}
+
+	// merge serviceAccount settings to the left
+	if child.ServiceAccountName != "" {
+		c.ServiceAccountName = child.ServiceAccountName
+	}
+
+	// selectors are replaced wholesale, as merging label selectors is ambiguous
+	if child.NamespaceSelector != nil {
+		c.NamespaceSelector = child.NamespaceSelector
+	}
+	if child.PodSelector != nil {
+		c.PodSelector = child.PodSelector
+	}
+
+	// templating is opt-in for the whole config; any templated field in the chain requires rendering
+	c.Template = c.Template || child.Template
+
+	return nil
+}
+
+// mergeContainersReplace merges the containers and init containers of child into c, replacing any container
+// of c with the same name
+func (c *InjectionConfig) mergeContainersReplace(child *InjectionConfig) {
+	// merge containers
+	for _, cctr := range child.Containers {
+		contains := false
+
+		for bi, bctr := range c.Containers {
+			if bctr.Name == cctr.Name {
+				contains = true
+				c.Containers[bi] = cctr
+			}
+		}
+
+		if !contains {
+			c.Containers = append(c.Containers, cctr)
+		}
+	}
 
 	// merge init containers
 	for _, cv := range child.InitContainers {
@@ -271,20 +575,30 @@ func (c *InjectionConfig) Merge(child *InjectionConfig) error {
 			c.InitContainers = append(c.InitContainers, cv)
 		}
 	}
-
-	// merge serviceAccount settings to the left
-	if child.ServiceAccountName != "" {
-		c.ServiceAccountName = child.ServiceAccountName
-	}
-
-	return nil
 }
 
 // LoadInjectionConfigFromFilePath returns a InjectionConfig given a yaml file on disk
 // NOTE: if the InjectionConfig loaded has an Inherits field, we recursively load from Inherits
-// and merge the InjectionConfigs to create an inheritance pattern. Inherits is not supported for
-// configs loaded via `LoadInjectionConfig`
+// and merge the InjectionConfigs to create an inheritance pattern. Configs loaded via `LoadInjectionConfig`
+// inherit by name instead, see ResolveInheritance. Loops in the chain of Inherits are reported as an
+// InheritanceCycleError, and chains longer than MaxInheritanceDepth as ErrInheritanceTooDeep.
 func LoadInjectionConfigFromFilePath(configFile string) (*InjectionConfig, error) {
+	return loadInjectionConfigFromFilePath(configFile, nil)
+}
+
+// loadInjectionConfigFromFilePath loads configFile, which is inherited by the files in chain
+func loadInjectionConfigFromFilePath(configFile string, chain []string) (*InjectionConfig, error) {
+	configFile = filepath.Clean(configFile)
+	for i, inheritor := range chain {
+		if inheritor == configFile {
+			return nil, &InheritanceCycleError{Chain: append(append([]string{}, chain[i:]...), configFile)}
+		}
+	}
+	chain = append(append([]string{}, chain...), configFile)
+	if len(chain)-1 > MaxInheritanceDepth {
+		return nil, fmt.Errorf("%w: %s exceeds the maximum of %d", ErrInheritanceTooDeep, strings.Join(chain, " -> "), MaxInheritanceDepth)
+	}
+
 	f, err := os.Open(configFile)
 	if err != nil {
 		return nil, fmt.Errorf("error loading injection config from file %s: %s", configFile, err.Error())
@@ -302,14 +616,15 @@ func LoadInjectionConfigFromFilePath(configFile string) (*InjectionConfig, error
 	if ic.Inherits != "" {
 		// all Inherits are relative to the directory the current file is in, and are cleaned
 		// prior to use.
-		basedir := filepath.Dir(filepath.Clean(f.Name()))
+		basedir := filepath.Dir(configFile)
 		cleanPath := filepath.Join(basedir, ic.Inherits)
 		glog.V(4).Infof("%s inherits from %s", ic.FullName(), ic.Inherits)
 
-		base, err := LoadInjectionConfigFromFilePath(cleanPath)
+		base, err := loadInjectionConfigFromFilePath(cleanPath, chain)
 		if err != nil {
 			return nil, err
 		}
+		inherited := base.InheritanceChain()
 
 		err = base.Merge(ic)
 		if err != nil {
@@ -317,6 +632,16 @@ func LoadInjectionConfigFromFilePath(configFile string) (*InjectionConfig, error
 		}
 
 		ic = base
+		ic.inheritance = append([]InheritedConfig{{Name: ic.FullName(), Source: configFile}}, inherited...)
+	}
+	ic.source = configFile
+	// Inherits is a path, not a name; there is nothing left to resolve
+	ic.resolved = true
+	if ic.Inherits != "" {
+		// what the partial config could not check on its own
+		if err := ic.validate(); err != nil {
+			return nil, err
+		}
 	}
 
 	glog.V(3).Infof("Loaded injection config %s version=%s", ic.Name, ic.Version())
@@ -346,6 +671,47 @@ func LoadInjectionConfig(reader io.Reader) (*InjectionConfig, error) {
 		return nil, err
 	}
 
+	// make sure the selectors are usable, so we dont find out at admission time
+	if _, err := metav1.LabelSelectorAsSelector(cfg.NamespaceSelector); err != nil {
+		return nil, fmt.Errorf("invalid namespaceSelector: %s", err.Error())
+	}
+	if _, err := metav1.LabelSelectorAsSelector(cfg.PodSelector); err != nil {
+		return nil, fmt.Errorf("invalid podSelector: %s", err.Error())
+	}
+
+	if !validContainerMergeStrategy(cfg.ContainerMergeStrategy) {
+		return nil, fmt.Errorf("invalid containerMergeStrategy %q: must be %q or %q", cfg.ContainerMergeStrategy, ContainerMergeStrategyReplace, ContainerMergeStrategyStrategic)
+	}
+	if !validContainerOrder(cfg.ContainerOrder) {
+		return nil, fmt.Errorf("invalid containerOrder %q: must be %q or %q", cfg.ContainerOrder, ContainerOrderAppend, ContainerOrderPrepend)
+	}
+	if !validPolicy(cfg.EnvPolicy) {
+		return nil, fmt.Errorf("invalid envPolicy %q: must be %q, %q or %q", cfg.EnvPolicy, PolicyAddOnly, PolicyOverride, PolicyRemove)
+	}
+	if !validPolicy(cfg.VolumeMountPolicy) {
+		return nil, fmt.Errorf("invalid volumeMountPolicy %q: must be %q, %q or %q", cfg.VolumeMountPolicy, PolicyAddOnly, PolicyOverride, PolicyRemove)
+	}
+	if !validPolicy(cfg.MetadataPolicy) {
+		return nil, fmt.Errorf("invalid metadataPolicy %q: must be %q, %q or %q", cfg.MetadataPolicy, PolicyAddOnly, PolicyOverride, PolicyRemove)
+	}
+	if !ValidFailurePolicy(cfg.FailurePolicy) {
+		return nil, fmt.Errorf("invalid failurePolicy %q: must be %q or %q", cfg.FailurePolicy, FailurePolicyIgnore, FailurePolicyFail)
+	}
+	if cfg.ContainerMergeStrategy == ContainerMergeStrategyStrategic {
+		// keep the containers as written, with only the fields that were set and any patch directives
+		cfg.rawContainers = &rawContainers{}
+		if err := yaml.Unmarshal(data, cfg.rawContainers); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.validateTemplates(); err != nil {
+		return nil, fmt.Errorf("invalid template: %s", err.Error())
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
@@ -1,10 +1,13 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 
 	testhelper "github.com/tumblr/k8s-sidecar-injector/internal/pkg/testing"
+	corev1 "k8s.io/api/core/v1"
 )
 
 var (
@@ -29,6 +32,69 @@ var (
 			Path:      fixtureSidecarsDir + "/bad/inheritance-escape.yaml",
 			LoadError: fmt.Errorf(`error loading injection config from file test/fixtures/etc/passwd: open test/fixtures/etc/passwd: no such file or directory`),
 		},
+		"inheritance cycle self": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/cycle-self.yaml",
+			LoadError: fmt.Errorf(`inheritance cycle: test/fixtures/sidecars/bad/cycle-self.yaml -> test/fixtures/sidecars/bad/cycle-self.yaml`),
+		},
+		"inheritance cycle two": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/cycle-two-a.yaml",
+			LoadError: fmt.Errorf(`inheritance cycle: test/fixtures/sidecars/bad/cycle-two-a.yaml -> test/fixtures/sidecars/bad/cycle-two-b.yaml -> test/fixtures/sidecars/bad/cycle-two-a.yaml`),
+		},
+		"inheritance cycle three": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/cycle-three-b.yaml",
+			LoadError: fmt.Errorf(`inheritance cycle: test/fixtures/sidecars/bad/cycle-three-b.yaml -> test/fixtures/sidecars/bad/cycle-three-c.yaml -> test/fixtures/sidecars/bad/cycle-three-a.yaml -> test/fixtures/sidecars/bad/cycle-three-b.yaml`),
+		},
+		"container merge strategy": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/container-merge-strategy.yaml",
+			LoadError: fmt.Errorf(`invalid containerMergeStrategy "merge": must be "replace" or "strategic"`),
+		},
+		"container order": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/container-order.yaml",
+			LoadError: fmt.Errorf(`invalid containerOrder "first": must be "append" or "prepend"`),
+		},
+		"env policy": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/env-policy.yaml",
+			LoadError: fmt.Errorf(`invalid envPolicy "replace": must be "add-only", "override" or "remove"`),
+		},
+		"volume mount policy": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/volume-mount-policy.yaml",
+			LoadError: fmt.Errorf(`invalid volumeMountPolicy "delete": must be "add-only", "override" or "remove"`),
+		},
+		"metadata policy": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/metadata-policy.yaml",
+			LoadError: fmt.Errorf(`invalid metadataPolicy "overwrite": must be "add-only", "override" or "remove"`),
+		},
+		"failure policy": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/failure-policy.yaml",
+			LoadError: fmt.Errorf(`invalid failurePolicy "Reject": must be "Ignore" or "Fail"`),
+		},
+		"template syntax": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/template-syntax.yaml",
+			LoadError: fmt.Errorf(`invalid template: template: env[BROKEN].value:1: unclosed action`),
+		},
+		"invalid names": testhelper.ConfigExpectation{
+			Path: fixtureSidecarsDir + "/bad/invalid-names.yaml",
+			LoadError: fmt.Errorf(`invalid injection config invalid-names:latest: [` +
+				`volumes[0].name: Invalid value: "Logs": a DNS-1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?'), ` +
+				`containers[0].name: Invalid value: "logger_sidecar": a DNS-1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?'), ` +
+				`containers[0].env[0].name: Invalid value: "1LOG_LEVEL": a valid environment variable name must consist of alphabetic characters, digits, '_', '-', or '.', and must not start with a digit (e.g. 'my.env-name',  or 'MY_ENV.NAME',  or 'MyEnvName1', regex used for validation is '[-._a-zA-Z][-._a-zA-Z0-9]*')]`),
+		},
+		"volume mount of an undefined volume": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/volume-mount-undefined.yaml",
+			LoadError: fmt.Errorf(`invalid injection config volume-mount-undefined:latest: containers[0].volumeMounts[1].name: Not found: "log-config"`),
+		},
+		"volume mount of an undefined volume, once inherited": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/inheritance-volume-mount-undefined.yaml",
+			LoadError: fmt.Errorf(`invalid injection config inheritance-volume-mount-undefined:latest: containers[4].volumeMounts[0].name: Not found: "logs"`),
+		},
+		"ports": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/ports.yaml",
+			LoadError: fmt.Errorf(`invalid injection config ports:latest: [containers[0].ports[1].containerPort: Invalid value: 90000: must be between 1 and 65535, inclusive, containers[1].ports[0].containerPort: Duplicate value: "8080/TCP, also used by containers[0].ports[0]"]`),
+		},
+		"patch directive without inherits": testhelper.ConfigExpectation{
+			Path:      fixtureSidecarsDir + "/bad/patch-directive.yaml",
+			LoadError: fmt.Errorf(`invalid injection config patch-directive:latest: containers[0].$patch: Forbidden: delete applies to inherited containers, and patch-directive:latest inherits none`),
+		},
 	}
 
 	// test files and expectations
@@ -122,7 +188,19 @@ var (
 			HostAliasCount:     1,
 			InitContainerCount: 1,
 		},
-		// test deep inheritance
+		// test strategic merging of inherited containers
+		"strategic inheritance from complex-sidecar": testhelper.ConfigExpectation{
+			Name:               "inheritance-strategic",
+			Version:            "v1",
+			Path:               fixtureSidecarsDir + "/inheritance-strategic.yaml",
+			EnvCount:           0,
+			ContainerCount:     4,
+			VolumeCount:        1,
+			VolumeMountCount:   0,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+		},
+		// test deep inheritance; all aliases of 1.2.3.4 along the chain are merged into one
 		"deep inheritance from inheritance-complex": testhelper.ConfigExpectation{
 			Name:               "inheritance-deep",
 			Version:            "v2",
@@ -131,9 +209,90 @@ var (
 			ContainerCount:     6,
 			VolumeCount:        3,
 			VolumeMountCount:   0,
-			HostAliasCount:     3,
+			HostAliasCount:     1,
 			InitContainerCount: 2,
 		},
+		"proxy": testhelper.ConfigExpectation{
+			Name:               "proxy",
+			Version:            "latest",
+			Path:               fixtureSidecarsDir + "/env-policy-override.yaml",
+			EnvCount:           2,
+			ContainerCount:     0,
+			VolumeCount:        0,
+			VolumeMountCount:   0,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+			EnvPolicy:          PolicyOverride,
+		},
+		"no-docker-socket": testhelper.ConfigExpectation{
+			Name:               "no-docker-socket",
+			Version:            "latest",
+			Path:               fixtureSidecarsDir + "/volume-mount-policy-remove.yaml",
+			EnvCount:           0,
+			ContainerCount:     0,
+			VolumeCount:        0,
+			VolumeMountCount:   1,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+			ServiceAccount:     "restricted",
+			VolumeMountPolicy:  PolicyRemove,
+		},
+		"metadata": testhelper.ConfigExpectation{
+			Name:               "metadata",
+			Version:            "latest",
+			Path:               fixtureSidecarsDir + "/metadata.yaml",
+			EnvCount:           0,
+			ContainerCount:     0,
+			VolumeCount:        0,
+			VolumeMountCount:   0,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+		},
+		"metadata-override": testhelper.ConfigExpectation{
+			Name:               "metadata-override",
+			Version:            "latest",
+			Path:               fixtureSidecarsDir + "/metadata-override.yaml",
+			EnvCount:           0,
+			ContainerCount:     0,
+			VolumeCount:        0,
+			VolumeMountCount:   0,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+		},
+		"audit-logger": testhelper.ConfigExpectation{
+			Name:               "audit-logger",
+			Version:            "latest",
+			Path:               fixtureSidecarsDir + "/audit-logger.yaml",
+			EnvCount:           0,
+			ContainerCount:     1,
+			VolumeCount:        1,
+			VolumeMountCount:   0,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+			FailurePolicy:      FailurePolicyFail,
+		},
+		"metadata-remove": testhelper.ConfigExpectation{
+			Name:               "metadata-remove",
+			Version:            "latest",
+			Path:               fixtureSidecarsDir + "/metadata-remove.yaml",
+			EnvCount:           0,
+			ContainerCount:     0,
+			VolumeCount:        0,
+			VolumeMountCount:   0,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+		},
+		"pod-settings": testhelper.ConfigExpectation{
+			Name:               "pod-settings",
+			Version:            "latest",
+			Path:               fixtureSidecarsDir + "/pod-settings.yaml",
+			EnvCount:           0,
+			ContainerCount:     1,
+			VolumeCount:        0,
+			VolumeMountCount:   0,
+			HostAliasCount:     0,
+			InitContainerCount: 0,
+		},
 		"service-account": testhelper.ConfigExpectation{
 			Name:               "service-account",
 			Version:            "latest",
@@ -187,6 +346,21 @@ var (
 			HostAliasCount:     0,
 			InitContainerCount: 1,
 		},
+		"selector": testhelper.ConfigExpectation{
+			Name:     "selector-injected",
+			Version:  "latest",
+			Path:     fixtureSidecarsDir + "/selector.yaml",
+			EnvCount: 1,
+		},
+		"templated": testhelper.ConfigExpectation{
+			Name:             "templated",
+			Version:          "latest",
+			Path:             fixtureSidecarsDir + "/templated.yaml",
+			EnvCount:         1,
+			ContainerCount:   1,
+			VolumeCount:      1,
+			VolumeMountCount: 1,
+		},
 		"network-pid": testhelper.ConfigExpectation{
 			Name:        "test-network-pid",
 			Version:     "latest",
@@ -209,6 +383,38 @@ func TestConfigsLoadErrors(t *testing.T) {
 	}
 }
 
+func TestInheritanceCycleErrors(t *testing.T) {
+	for _, f := range []string{"cycle-self.yaml", "cycle-two-a.yaml", "cycle-three-a.yaml"} {
+		_, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/bad/" + f)
+		var cycle *InheritanceCycleError
+		if !errors.As(err, &cycle) {
+			t.Fatalf("%s: expected an InheritanceCycleError but got %v", f, err)
+		}
+		if cycle.Chain[0] != cycle.Chain[len(cycle.Chain)-1] {
+			t.Errorf("%s: expected the cycle to start and end with the same file, but got %v", f, cycle.Chain)
+		}
+	}
+}
+
+func TestMaxInheritanceDepth(t *testing.T) {
+	defer func(depth int) { MaxInheritanceDepth = depth }(MaxInheritanceDepth)
+
+	// inheritance-deep-2.yaml -> inheritance-1.yaml -> complex-sidecar.yaml
+	MaxInheritanceDepth = 2
+	if _, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/inheritance-deep-2.yaml"); err != nil {
+		t.Fatalf("expected a chain of depth 2 to load, but got %v", err)
+	}
+	MaxInheritanceDepth = 1
+	_, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/inheritance-deep-2.yaml")
+	if !errors.Is(err, ErrInheritanceTooDeep) {
+		t.Fatalf("expected ErrInheritanceTooDeep but got %v", err)
+	}
+	expected := "inheritance chain too deep: test/fixtures/sidecars/inheritance-deep-2.yaml -> test/fixtures/sidecars/inheritance-1.yaml -> test/fixtures/sidecars/complex-sidecar.yaml exceeds the maximum of 1"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q but got %q", expected, err.Error())
+	}
+}
+
 // TestGoodConfigs: load configs from filepath and check if we load what we expected
 func TestGoodConfigs(t *testing.T) {
 	for _, testConfig := range testGoodConfigs {
@@ -251,6 +457,15 @@ func TestGoodConfigs(t *testing.T) {
 		if c.ServiceAccountName != testConfig.ServiceAccount {
 			t.Fatalf("expected ServiceAccountName %s, but got %s", testConfig.ServiceAccount, c.ServiceAccountName)
 		}
+		if c.GetEnvPolicy() != effectivePolicy(testConfig.EnvPolicy) {
+			t.Fatalf("expected EnvPolicy %s loaded from %s but got %s", effectivePolicy(testConfig.EnvPolicy), testConfig.Path, c.GetEnvPolicy())
+		}
+		if c.GetVolumeMountPolicy() != effectivePolicy(testConfig.VolumeMountPolicy) {
+			t.Fatalf("expected VolumeMountPolicy %s loaded from %s but got %s", effectivePolicy(testConfig.VolumeMountPolicy), testConfig.Path, c.GetVolumeMountPolicy())
+		}
+		if c.FailurePolicy != testConfig.FailurePolicy {
+			t.Fatalf("expected FailurePolicy %q loaded from %s but got %q", testConfig.FailurePolicy, testConfig.Path, c.FailurePolicy)
+		}
 	}
 }
 
@@ -312,4 +527,212 @@ func TestGetInjectionConfig(t *testing.T) {
 	if i.ServiceAccountName != cfg.ServiceAccount {
 		t.Fatalf("expected ServiceAccountName %s, but got %s", cfg.ServiceAccount, i.ServiceAccountName)
 	}
+	if i.GetEnvPolicy() != effectivePolicy(cfg.EnvPolicy) {
+		t.Fatalf("expected EnvPolicy %s, but got %s", effectivePolicy(cfg.EnvPolicy), i.GetEnvPolicy())
+	}
+	if i.GetVolumeMountPolicy() != effectivePolicy(cfg.VolumeMountPolicy) {
+		t.Fatalf("expected VolumeMountPolicy %s, but got %s", effectivePolicy(cfg.VolumeMountPolicy), i.GetVolumeMountPolicy())
+	}
+}
+
+// TestCombineInjectionConfigs: combine several configs requested by a single pod, and detect conflicts between them
+func TestCombineInjectionConfigs(t *testing.T) {
+	c, err := LoadConfigDirectory(fixtureSidecarsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecarTest, err := c.GetInjectionConfig("sidecar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initContainers, err := c.GetInjectionConfig("init-containers:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env1, err := c.GetInjectionConfig("env1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	combined, err := CombineInjectionConfigs(sidecarTest, initContainers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if combined.FullName() != "sidecar-test:latest,init-containers:v2" {
+		t.Fatalf("expected combined FullName sidecar-test:latest,init-containers:v2 but got %s", combined.FullName())
+	}
+	if len(combined.Containers) != len(sidecarTest.Containers)+len(initContainers.Containers) {
+		t.Fatalf("expected %d containers but got %d", len(sidecarTest.Containers)+len(initContainers.Containers), len(combined.Containers))
+	}
+	if len(combined.InitContainers) != 1 {
+		t.Fatalf("expected 1 init container but got %d", len(combined.InitContainers))
+	}
+	if len(combined.Environment) != len(sidecarTest.Environment) {
+		t.Fatalf("expected %d Envs but got %d", len(sidecarTest.Environment), len(combined.Environment))
+	}
+
+	// identical definitions are not conflicts, and are only injected once
+	combined, err = CombineInjectionConfigs(sidecarTest, sidecarTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(combined.Containers) != len(sidecarTest.Containers) {
+		t.Fatalf("expected %d containers but got %d", len(sidecarTest.Containers), len(combined.Containers))
+	}
+
+	// both configs define DATACENTER with different values
+	_, err = CombineInjectionConfigs(sidecarTest, env1)
+	if !errors.Is(err, ErrConflictingInjectionConfigs) {
+		t.Fatalf("expected ErrConflictingInjectionConfigs but got %v", err)
+	}
+	expected := "injection configs conflict: env DATACENTER is defined by both sidecar-test:latest and env1:latest"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q but got %q", expected, err.Error())
+	}
+
+	// the env vars do not conflict, but they would be applied differently
+	proxy, err := c.GetInjectionConfig("proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CombineInjectionConfigs(proxy, env1)
+	if !errors.Is(err, ErrConflictingInjectionConfigs) {
+		t.Fatalf("expected ErrConflictingInjectionConfigs but got %v", err)
+	}
+	expected = "injection configs conflict: envPolicy is set to override by proxy:latest and to add-only by env1:latest"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q but got %q", expected, err.Error())
+	}
+
+	// failing closed wins over the default
+	auditLogger, err := c.GetInjectionConfig("audit-logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined, err = CombineInjectionConfigs(env1, auditLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if combined.FailurePolicy != FailurePolicyFail {
+		t.Fatalf("expected failurePolicy %s but got %q", FailurePolicyFail, combined.FailurePolicy)
+	}
+
+	// host aliases are merged by IP
+	hostAliases, err := c.GetInjectionConfig("host-aliases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHostAliases := &InjectionConfig{Name: "other-host-aliases", HostAliases: []corev1.HostAlias{
+		{IP: "1.2.3.4", Hostnames: []string{"some.domain.com", "extra.domain.com"}},
+		{IP: "5.6.7.8", Hostnames: []string{"new.domain.com"}},
+	}}
+	combined, err = CombineInjectionConfigs(hostAliases, otherHostAliases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHostAliases := []corev1.HostAlias{
+		{IP: "1.2.3.4", Hostnames: []string{"some.domain.com", "some.other-domain.com", "extra.domain.com"}},
+		{IP: "4.3.2.1", Hostnames: []string{"another.domain.com", "yetanother.domain.com"}},
+		{IP: "2.3.4.5", Hostnames: []string{"another.domain.com"}},
+		{IP: "5.6.7.8", Hostnames: []string{"new.domain.com"}},
+	}
+	if !reflect.DeepEqual(combined.HostAliases, expectedHostAliases) {
+		t.Fatalf("expected host aliases %v but got %v", expectedHostAliases, combined.HostAliases)
+	}
+
+	// pod level settings conflict by key or field
+	podSettings, err := c.GetInjectionConfig("pod-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPodSettings := podSettings.DeepCopy()
+	otherPodSettings.Name = "other-pod-settings"
+	otherPodSettings.Containers = nil
+	otherPodSettings.NodeSelector = map[string]string{"kubernetes.io/os": "linux", "node.tumblr.com/pool": "other"}
+	fsGroup := int64(3000)
+	otherPodSettings.SecurityContext.FSGroup = &fsGroup
+	_, err = CombineInjectionConfigs(podSettings, otherPodSettings)
+	if !errors.Is(err, ErrConflictingInjectionConfigs) {
+		t.Fatalf("expected ErrConflictingInjectionConfigs but got %v", err)
+	}
+	expected = "injection configs conflict: nodeSelector node.tumblr.com/pool is set to agents by pod-settings:latest and to other by other-pod-settings:latest; securityContext.fsGroup is defined by both pod-settings:latest and other-pod-settings:latest"
+	if err.Error() != expected {
+		t.Fatalf("expected error %q but got %q", expected, err.Error())
+	}
+}
+
+// TestInjectionConfigSelectors: check pod and namespace selectors are evaluated against labels
+func TestInjectionConfigSelectors(t *testing.T) {
+	ic, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/selector.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ic.HasSelectors() {
+		t.Fatal("expected selector.yaml to have selectors")
+	}
+	if ok, err := ic.SelectsPod(map[string]string{"inject-me": "true", "app": "foo"}); err != nil || !ok {
+		t.Fatalf("expected podSelector to select pod, got %v (%v)", ok, err)
+	}
+	if ok, err := ic.SelectsPod(map[string]string{"app": "foo"}); err != nil || ok {
+		t.Fatalf("expected podSelector not to select pod, got %v (%v)", ok, err)
+	}
+	if ok, err := ic.SelectsNamespace(map[string]string{"team": "injectable"}); err != nil || !ok {
+		t.Fatalf("expected namespaceSelector to select namespace, got %v (%v)", ok, err)
+	}
+	if ok, err := ic.SelectsNamespace(nil); err != nil || ok {
+		t.Fatalf("expected namespaceSelector not to select namespace, got %v (%v)", ok, err)
+	}
+
+	c, err := LoadConfigDirectory(fixtureSidecarsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := c.SelectorInjectionConfigs()
+	if len(selected) != 1 || selected[0].FullName() != "selector-injected:latest" {
+		t.Fatalf("expected only selector-injected:latest to have selectors, but got %v", selected)
+	}
+}
+
+func TestInjectionConfigHash(t *testing.T) {
+	c, err := LoadConfigDirectory(fixtureSidecarsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic, err := c.GetInjectionConfig("sidecar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := ic.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := ic.DeepCopy()
+	copiedHash, err := copied.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copiedHash != hash {
+		t.Fatalf("expected an identical config to hash to %s but got %s", hash, copiedHash)
+	}
+
+	copied.Containers[0].Image = "nginx:latest"
+	changedHash, err := copied.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changedHash == hash {
+		t.Fatal("expected a changed config to hash differently")
+	}
+
+	// the version is part of the identity of a config, but not of its serialized content
+	copied = ic.DeepCopy()
+	copied.version = "v2"
+	versionedHash, err := copied.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versionedHash == hash {
+		t.Fatal("expected a config of another version to hash differently")
+	}
 }
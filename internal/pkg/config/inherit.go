@@ -0,0 +1,153 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultMaxInheritanceDepth is the default of MaxInheritanceDepth
+	DefaultMaxInheritanceDepth = 10
+)
+
+var (
+	// ErrInheritedConfigNotFound indicates an InjectionConfig inherits from a name that is not loaded
+	ErrInheritedConfigNotFound = fmt.Errorf(`inherited injection config not found`)
+	// ErrInheritanceTooDeep indicates a chain of Inherits is longer than MaxInheritanceDepth
+	ErrInheritanceTooDeep = fmt.Errorf(`inheritance chain too deep`)
+
+	// MaxInheritanceDepth is how many configs an InjectionConfig may inherit from, transitively
+	MaxInheritanceDepth = DefaultMaxInheritanceDepth
+)
+
+// InheritanceCycleError indicates InjectionConfigs inherit from each other in a loop
+type InheritanceCycleError struct {
+	// Chain is the inheritance chain that loops, starting and ending with the same config. Configs
+	// inheriting by name are identified by their full name, and configs on disk by their path.
+	Chain []string
+}
+
+func (e *InheritanceCycleError) Error() string {
+	return fmt.Sprintf("inheritance cycle: %s", strings.Join(e.Chain, " -> "))
+}
+
+// inCycle returns whether name is part of the cycle
+func (e *InheritanceCycleError) inCycle(name string) bool {
+	for _, n := range e.Chain {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveInheritance resolves the Inherits field of InjectionConfigs that inherit by name (i.e. those
+// loaded from ConfigMaps or SidecarInjections), against the whole set of ics. Bases may be any config in
+// ics, including ones loaded from disk. Configs loaded from files already resolved their inheritance, and
+// are returned as they are, as are configs that do not inherit.
+//
+// The returned configs are ics in order, with inheriting configs replaced by the merged result. Configs
+// that cannot be resolved are left out, and their errors are returned keyed by FullName. ics are not
+// modified.
+func ResolveInheritance(ics []*InjectionConfig) ([]*InjectionConfig, map[string]error) {
+	r := inheritanceResolver{
+		byName: map[string]*InjectionConfig{},
+		done:   map[string]resolvedInjectionConfig{},
+	}
+	for _, ic := range ics {
+		r.byName[ic.FullName()] = ic
+	}
+
+	resolved := make([]*InjectionConfig, 0, len(ics))
+	errs := map[string]error{}
+	for _, ic := range ics {
+		out, err := r.resolve(ic, nil)
+		if err != nil {
+			errs[ic.FullName()] = err
+			continue
+		}
+		resolved = append(resolved, out)
+	}
+	return resolved, errs
+}
+
+type resolvedInjectionConfig struct {
+	ic *InjectionConfig
+	// ancestry is the full name of the config, followed by those of the configs it inherits from
+	ancestry []string
+	err      error
+}
+
+type inheritanceResolver struct {
+	byName map[string]*InjectionConfig
+	done   map[string]resolvedInjectionConfig
+}
+
+// resolve merges ic onto its resolved parent. chain holds the names of the configs inheriting from ic.
+func (r *inheritanceResolver) resolve(ic *InjectionConfig, chain []string) (*InjectionConfig, error) {
+	out, _, err := r.resolveAncestry(ic, chain)
+	return out, err
+}
+
+func (r *inheritanceResolver) resolveAncestry(ic *InjectionConfig, chain []string) (*InjectionConfig, []string, error) {
+	name := ic.FullName()
+	if ic.resolved || ic.Inherits == "" {
+		// configs loaded from files already resolved the files they inherit, which count towards the depth
+		chain := ic.InheritanceChain()
+		ancestry := make([]string, 0, len(chain))
+		for _, inherited := range chain {
+			ancestry = append(ancestry, inherited.Name)
+		}
+		return ic, ancestry, nil
+	}
+	if done, ok := r.done[name]; ok {
+		return done.ic, done.ancestry, done.err
+	}
+	for i, n := range chain {
+		if n == name {
+			return nil, nil, &InheritanceCycleError{Chain: append(append([]string{}, chain[i:]...), name)}
+		}
+	}
+
+	out, ancestry, err := r.merge(ic, append(append([]string{}, chain...), name))
+	r.done[name] = resolvedInjectionConfig{ic: out, ancestry: ancestry, err: err}
+	return out, ancestry, err
+}
+
+func (r *inheritanceResolver) merge(ic *InjectionConfig, chain []string) (*InjectionConfig, []string, error) {
+	name := ic.FullName()
+	parentName, parentVersion, err := configNameFields(ic.Inherits)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s inherits %s: %w", name, ic.Inherits, err)
+	}
+	parentKey := canonicalizeConfigName(parentName, parentVersion)
+	parent, ok := r.byName[parentKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s inherits %s", ErrInheritedConfigNotFound, name, parentKey)
+	}
+
+	base, parentAncestry, err := r.resolveAncestry(parent, chain)
+	if err != nil {
+		var cycle *InheritanceCycleError
+		if errors.As(err, &cycle) && cycle.inCycle(name) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("%s inherits %s: %w", name, parentKey, err)
+	}
+	ancestry := append([]string{name}, parentAncestry...)
+	if len(ancestry)-1 > MaxInheritanceDepth {
+		return nil, nil, fmt.Errorf("%w: %s exceeds the maximum of %d", ErrInheritanceTooDeep, strings.Join(ancestry, " -> "), MaxInheritanceDepth)
+	}
+
+	merged := base.DeepCopy()
+	if err := merged.Merge(ic.DeepCopy()); err != nil {
+		return nil, nil, err
+	}
+	merged.resolved = true
+	merged.inheritance = append([]InheritedConfig{{Name: name, Source: ic.source}}, base.InheritanceChain()...)
+	if err := merged.validate(); err != nil {
+		return nil, nil, err
+	}
+	return merged, ancestry, nil
+}
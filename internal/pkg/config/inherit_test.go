@@ -0,0 +1,288 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// loadInjectionConfigs parses InjectionConfigs as if they were loaded from ConfigMaps
+func loadInjectionConfigs(t *testing.T, yamls ...string) []*InjectionConfig {
+	t.Helper()
+	ics := []*InjectionConfig{}
+	for _, y := range yamls {
+		ic, err := LoadInjectionConfig(strings.NewReader(y))
+		if err != nil {
+			t.Fatalf("unable to load %q: %s", y, err.Error())
+		}
+		ics = append(ics, ic)
+	}
+	return ics
+}
+
+func TestResolveInheritance(t *testing.T) {
+	// a base loaded from disk, which itself inherits from a file
+	diskBase, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/service-account-with-inheritance.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ics := append([]*InjectionConfig{diskBase}, loadInjectionConfigs(t, `
+name: base-logging:v3
+containers:
+- name: logger
+  image: logger:3
+env:
+- name: LOG_LEVEL
+  value: info
+`, `
+name: team-logging
+inherits: base-logging:v3
+env:
+- name: LOG_LEVEL
+  value: debug
+- name: TEAM
+  value: a
+`, `
+name: team-logging-sa
+inherits: team-logging
+serviceAccountName: team
+`, `
+name: from-disk
+inherits: service-account-inherits-env1
+`, `
+name: plain
+env:
+- name: PLAIN
+  value: "true"
+`)...)
+
+	resolved, errs := ResolveInheritance(ics)
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, but got %v", errs)
+	}
+	if len(resolved) != len(ics) {
+		t.Fatalf("expected %d resolved configs, but got %d", len(ics), len(resolved))
+	}
+	byName := map[string]*InjectionConfig{}
+	for i, ic := range resolved {
+		if ic.FullName() != ics[i].FullName() {
+			t.Fatalf("expected resolved configs in order, but got %s at %d instead of %s", ic.FullName(), i, ics[i].FullName())
+		}
+		byName[ic.FullName()] = ic
+	}
+
+	if resolved[0] != diskBase || byName["plain:latest"] != ics[5] {
+		t.Errorf("expected configs that need no resolving to be returned as they are")
+	}
+
+	teamLoggingSA := byName["team-logging-sa:latest"]
+	if len(teamLoggingSA.Containers) != 1 || teamLoggingSA.Containers[0].Name != "logger" {
+		t.Errorf("expected team-logging-sa to inherit the logger container, but got %v", teamLoggingSA.Containers)
+	}
+	env := []string{}
+	for _, e := range teamLoggingSA.Environment {
+		env = append(env, e.Name+"="+e.Value)
+	}
+	if strings.Join(env, ",") != "LOG_LEVEL=debug,TEAM=a" {
+		t.Errorf("expected team-logging-sa env LOG_LEVEL=debug,TEAM=a but got %v", env)
+	}
+	if teamLoggingSA.ServiceAccountName != "team" {
+		t.Errorf("expected team-logging-sa serviceAccountName team but got %s", teamLoggingSA.ServiceAccountName)
+	}
+
+	fromDisk := byName["from-disk:latest"]
+	if len(fromDisk.Environment) != 3 || fromDisk.ServiceAccountName != diskBase.ServiceAccountName {
+		t.Errorf("expected from-disk to inherit env and serviceAccountName from disk, but got %s", fromDisk.String())
+	}
+
+	// the inputs must be left alone; they are cached by the watchers
+	if len(ics[2].Containers) != 0 || len(ics[2].Environment) != 2 || len(ics[1].Environment) != 1 || ics[1].Environment[0].Value != "info" {
+		t.Errorf("expected ResolveInheritance not to modify its inputs")
+	}
+}
+
+func TestResolveInheritanceErrors(t *testing.T) {
+	ics := loadInjectionConfigs(t, `
+name: self
+inherits: self
+`, `
+name: ping
+inherits: pong
+`, `
+name: pong
+inherits: ping
+`, `
+name: a
+inherits: b
+`, `
+name: b
+inherits: c
+`, `
+name: c
+inherits: a
+`, `
+name: uses-cycle
+inherits: a
+`, `
+name: orphan
+inherits: missing:v1
+`, `
+name: uses-orphan
+inherits: orphan
+`, `
+name: fine
+`)
+
+	resolved, errs := ResolveInheritance(ics)
+	if len(resolved) != 1 || resolved[0].FullName() != "fine:latest" {
+		t.Errorf("expected only fine:latest to resolve, but got %v", resolved)
+	}
+
+	expectedCycles := map[string]string{
+		"self:latest": "inheritance cycle: self:latest -> self:latest",
+		"ping:latest": "inheritance cycle: ping:latest -> pong:latest -> ping:latest",
+		"pong:latest": "inheritance cycle: ping:latest -> pong:latest -> ping:latest",
+		"a:latest":    "inheritance cycle: a:latest -> b:latest -> c:latest -> a:latest",
+		"b:latest":    "inheritance cycle: a:latest -> b:latest -> c:latest -> a:latest",
+		"c:latest":    "inheritance cycle: a:latest -> b:latest -> c:latest -> a:latest",
+	}
+	for name, expected := range expectedCycles {
+		var cycle *InheritanceCycleError
+		if !errors.As(errs[name], &cycle) {
+			t.Errorf("%s: expected an InheritanceCycleError, but got %v", name, errs[name])
+			continue
+		}
+		if cycle.Error() != expected {
+			t.Errorf("%s: expected %q but got %q", name, expected, cycle.Error())
+		}
+	}
+
+	expectedErrors := map[string]string{
+		"uses-cycle:latest":  "uses-cycle:latest inherits a:latest: inheritance cycle: a:latest -> b:latest -> c:latest -> a:latest",
+		"orphan:latest":      "inherited injection config not found: orphan:latest inherits missing:v1",
+		"uses-orphan:latest": "uses-orphan:latest inherits orphan:latest: inherited injection config not found: orphan:latest inherits missing:v1",
+	}
+	for name, expected := range expectedErrors {
+		if errs[name] == nil || errs[name].Error() != expected {
+			t.Errorf("%s: expected error %q but got %v", name, expected, errs[name])
+		}
+	}
+	if !errors.Is(errs["uses-orphan:latest"], ErrInheritedConfigNotFound) {
+		t.Errorf("expected the error of uses-orphan:latest to wrap ErrInheritedConfigNotFound")
+	}
+	if len(errs) != len(expectedCycles)+len(expectedErrors) {
+		t.Errorf("expected %d errors, but got %v", len(expectedCycles)+len(expectedErrors), errs)
+	}
+}
+
+func TestResolveInheritanceMaxDepth(t *testing.T) {
+	defer func(depth int) { MaxInheritanceDepth = depth }(MaxInheritanceDepth)
+	MaxInheritanceDepth = 4
+
+	// the files the base loaded from disk inherits count towards the depth: it inherits
+	// inheritance-complex:v1, which inherits complex-sidecar:v420.69
+	diskBase, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/inheritance-deep-2.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ics := append([]*InjectionConfig{diskBase}, loadInjectionConfigs(t, `
+name: one
+inherits: `+diskBase.FullName()+`
+`, `
+name: two
+inherits: one
+`, `
+name: three
+inherits: two
+`)...)
+
+	resolved, errs := ResolveInheritance(ics)
+	if len(resolved) != 3 {
+		t.Errorf("expected %s, one and two to resolve, but got %v", diskBase.FullName(), resolved)
+	}
+	expected := "inheritance chain too deep: three:latest -> two:latest -> one:latest -> " + diskBase.FullName() +
+		" -> inheritance-complex:v1 -> complex-sidecar:v420.69 exceeds the maximum of 4"
+	if errs["three:latest"] == nil || errs["three:latest"].Error() != expected {
+		t.Errorf("expected error %q but got %v", expected, errs["three:latest"])
+	}
+}
+
+func TestResolveInheritanceValidates(t *testing.T) {
+	// partial configs load, as what they refer to or conflict with may only be inherited
+	ics := loadInjectionConfigs(t, `
+name: base
+volumes:
+- name: logs
+  emptyDir: {}
+containers:
+- name: logger
+  image: logger:1
+  ports:
+  - containerPort: 8080
+`, `
+name: mounts-inherited
+inherits: base
+containers:
+- name: shipper
+  image: shipper:1
+  volumeMounts:
+  - name: logs
+    mountPath: /var/log
+`, `
+name: mounts-pod-volume
+inherits: base
+podVolumes:
+- log-config
+containers:
+- name: shipper
+  image: shipper:1
+  volumeMounts:
+  - name: log-config
+    mountPath: /etc/shipper
+`, `
+name: mounts-undefined
+inherits: base
+containers:
+- name: shipper
+  image: shipper:1
+  volumeMounts:
+  - name: log-config
+    mountPath: /etc/shipper
+`, `
+name: port-conflict
+inherits: base
+containers:
+- name: shipper
+  image: shipper:1
+  ports:
+  - containerPort: 8080
+`, `
+name: deletes-inherited
+inherits: base
+containerMergeStrategy: strategic
+containers:
+- name: logger
+  $patch: delete
+`)
+
+	resolved, errs := ResolveInheritance(ics)
+	if len(resolved) != 4 {
+		t.Errorf("expected 4 configs to resolve, but got %v", resolved)
+	}
+	expected := map[string]string{
+		"mounts-undefined:latest": `invalid injection config mounts-undefined:latest: containers[1].volumeMounts[0].name: Not found: "log-config"`,
+		"port-conflict:latest":    `invalid injection config port-conflict:latest: containers[1].ports[0].containerPort: Duplicate value: "8080/TCP, also used by containers[0].ports[0]"`,
+	}
+	for name, message := range expected {
+		err := errs[name]
+		if !errors.Is(err, ErrInvalidInjectionConfig) {
+			t.Fatalf("expected the error of %s to wrap ErrInvalidInjectionConfig, but got %v", name, err)
+		}
+		if err.Error() != message {
+			t.Errorf("expected error %q but got %q", message, err.Error())
+		}
+	}
+	if len(errs) != len(expected) {
+		t.Errorf("expected %d errors, but got %v", len(expected), errs)
+	}
+}
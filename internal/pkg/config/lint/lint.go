@@ -0,0 +1,224 @@
+// Package lint checks InjectionConfigs before they are deployed, from config directories, config files, and
+// manifests of ConfigMaps and SidecarInjections, like the injector would load them
+package lint
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config/watcher"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Problem is why an InjectionConfig does not load
+type Problem struct {
+	// Source is where the config is defined: a file, followed by the ConfigMap item or SidecarInjection in it
+	Source string `json:"source"`
+	// Config is the full name of the config, if it could be parsed
+	Config string `json:"config,omitempty"`
+	// Field is the path of the invalid field, and Type the kind of error (like FieldValueRequired), for configs
+	// that fail config.InjectionConfig.Validate
+	Field string `json:"field,omitempty"`
+	Type  string `json:"type,omitempty"`
+	// Message explains the problem
+	Message string `json:"message"`
+}
+
+// Config is an InjectionConfig as it would be loaded, with its inheritance resolved
+type Config struct {
+	Source string
+	*config.InjectionConfig
+}
+
+// Result holds the configs that loaded, sorted by full name, and the problems of those that did not
+type Result struct {
+	Configs  []Config  `json:"-"`
+	Problems []Problem `json:"errors"`
+}
+
+// Lint loads the InjectionConfigs in paths. A path is either a directory, whose *.yaml files are loaded like
+// --config-directory, or a file holding an InjectionConfig, or manifests of ConfigMaps and SidecarInjections.
+// Other manifests are ignored. Inheritance is resolved across all paths, like for configs from the k8s api.
+func Lint(paths []string) *Result {
+	l := linter{sources: map[string]string{}}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			l.problem(path, "", err)
+			continue
+		}
+		if !info.IsDir() {
+			l.loadFile(path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.yaml"))
+		if err != nil {
+			l.problem(path, "", err)
+			continue
+		}
+		for _, match := range matches {
+			l.loadFile(match)
+		}
+	}
+
+	resolved, errs := config.ResolveInheritance(l.configs)
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l.problem(l.sources[name], name, errs[name])
+	}
+
+	result := &Result{Problems: l.problems}
+	for _, ic := range resolved {
+		result.Configs = append(result.Configs, Config{Source: l.sources[ic.FullName()], InjectionConfig: ic})
+	}
+	sort.Slice(result.Configs, func(i, j int) bool {
+		return result.Configs[i].FullName() < result.Configs[j].FullName()
+	})
+	return result
+}
+
+// WriteConfigs writes the configs of r to w as yaml documents, each preceded by a comment with its full name and
+// source
+func (r *Result) WriteConfigs(w io.Writer) error {
+	for i, c := range r.Configs {
+		data, err := c.YAML()
+		if err != nil {
+			return fmt.Errorf("%s: %s", c.FullName(), err.Error())
+		}
+		separator := "---\n"
+		if i == 0 {
+			separator = ""
+		}
+		if _, err := fmt.Fprintf(w, "%s# %s from %s\n%s", separator, c.FullName(), c.Source, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type linter struct {
+	configs  []*config.InjectionConfig
+	problems []Problem
+	// sources are the sources of configs, by full name
+	sources map[string]string
+}
+
+// add adds ic, unless a config of the same name was already loaded
+func (l *linter) add(source string, ic *config.InjectionConfig) {
+	if other, ok := l.sources[ic.FullName()]; ok {
+		l.problem(source, ic.FullName(), fmt.Errorf("%s is already defined by %s", ic.FullName(), other))
+		return
+	}
+	l.sources[ic.FullName()] = source
+	l.configs = append(l.configs, ic)
+}
+
+// problem records err, with a problem for each field of validation errors
+func (l *linter) problem(source, name string, err error) {
+	var invalid *config.ValidationError
+	if !errors.As(err, &invalid) {
+		l.problems = append(l.problems, Problem{Source: source, Config: name, Message: err.Error()})
+		return
+	}
+	for _, e := range invalid.Errors {
+		l.problems = append(l.problems, Problem{
+			Source:  source,
+			Config:  invalid.Config,
+			Field:   e.Field,
+			Type:    string(e.Type),
+			Message: e.ErrorBody(),
+		})
+	}
+}
+
+// loadFile loads the InjectionConfig in path, or the ones in the ConfigMaps and SidecarInjections in it
+func (l *linter) loadFile(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.problem(path, "", err)
+		return
+	}
+
+	docs := []map[string]interface{}{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		var doc map[string]interface{}
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			l.problem(path, "", err)
+			return
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	// files without kinds are InjectionConfigs, which inherit from other files
+	if len(docs) == 0 || docs[0]["kind"] == nil {
+		ic, err := config.LoadInjectionConfigFromFilePath(path)
+		if err != nil {
+			l.problem(path, "", err)
+			return
+		}
+		l.add(path, ic)
+		return
+	}
+
+	for _, doc := range docs {
+		switch doc["kind"] {
+		case "ConfigMap":
+			l.loadConfigMap(path, doc)
+		case "SidecarInjection":
+			si := &unstructured.Unstructured{Object: doc}
+			source := fmt.Sprintf("%s: SidecarInjection %s", path, si.GetName())
+			ic, err := watcher.InjectionConfigFromSidecarInjection(si)
+			if err != nil {
+				l.problem(source, "", err)
+				continue
+			}
+			l.add(source, ic)
+		}
+	}
+}
+
+// loadConfigMap loads the items of the ConfigMap in doc, in order
+func (l *linter) loadConfigMap(path string, doc map[string]interface{}) {
+	var cm corev1.ConfigMap
+	data, err := json.Marshal(doc)
+	if err == nil {
+		err = json.Unmarshal(data, &cm)
+	}
+	if err != nil {
+		l.problem(path, "", fmt.Errorf("could not unmarshal ConfigMap: %s", err.Error()))
+		return
+	}
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		source := fmt.Sprintf("%s: ConfigMap %s data[%s]", path, cm.Name, key)
+		ic, err := config.LoadInjectionConfig(strings.NewReader(cm.Data[key]))
+		if err != nil {
+			l.problem(source, "", err)
+			continue
+		}
+		l.add(source, ic)
+	}
+}
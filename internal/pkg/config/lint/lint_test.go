@@ -0,0 +1,130 @@
+package lint
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/tumblr/k8s-sidecar-injector/internal/pkg/testing"
+)
+
+func TestLintDirectory(t *testing.T) {
+	result := Lint([]string{"test/fixtures/sidecars"})
+	if len(result.Problems) != 0 {
+		t.Fatalf("expected no problems, but got %+v", result.Problems)
+	}
+	files, err := filepath.Glob("test/fixtures/sidecars/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Configs) != len(files) {
+		t.Errorf("expected %d configs, but got %d", len(files), len(result.Configs))
+	}
+	for i := 1; i < len(result.Configs); i++ {
+		if result.Configs[i-1].FullName() >= result.Configs[i].FullName() {
+			t.Errorf("expected configs sorted by full name, but got %s before %s", result.Configs[i-1].FullName(), result.Configs[i].FullName())
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	result := Lint([]string{
+		"test/fixtures/sidecars/sidecar-test.yaml",
+		"test/fixtures/k8s/lint/configmaps.yaml",
+		"test/fixtures/k8s/sidecarinjection-inherits.yaml",
+		"test/fixtures/sidecars/bad/ports.yaml",
+		"test/fixtures/does-not-exist.yaml",
+	})
+
+	expectedProblems := []Problem{
+		{
+			Source:  "test/fixtures/k8s/lint/configmaps.yaml: ConfigMap broken data[duplicate]",
+			Config:  "logger:v1",
+			Message: "logger:v1 is already defined by test/fixtures/k8s/lint/configmaps.yaml: ConfigMap sidecars data[logger]",
+		},
+		{
+			Source:  "test/fixtures/k8s/lint/configmaps.yaml: ConfigMap broken data[invalid]",
+			Config:  "invalid:latest",
+			Field:   "containers[0].image",
+			Type:    "FieldValueRequired",
+			Message: "Required value",
+		},
+		{
+			Source:  "test/fixtures/sidecars/bad/ports.yaml",
+			Config:  "ports:latest",
+			Field:   "containers[0].ports[1].containerPort",
+			Type:    "FieldValueInvalid",
+			Message: "Invalid value: 90000: must be between 1 and 65535, inclusive",
+		},
+		{
+			Source:  "test/fixtures/sidecars/bad/ports.yaml",
+			Config:  "ports:latest",
+			Field:   "containers[1].ports[0].containerPort",
+			Type:    "FieldValueDuplicate",
+			Message: `Duplicate value: "8080/TCP, also used by containers[0].ports[0]"`,
+		},
+		{
+			Source:  "test/fixtures/does-not-exist.yaml",
+			Message: "stat test/fixtures/does-not-exist.yaml: no such file or directory",
+		},
+	}
+	if !reflect.DeepEqual(result.Problems, expectedProblems) {
+		t.Errorf("expected problems\n%+v\nbut got\n%+v", expectedProblems, result.Problems)
+	}
+
+	expectedConfigs := map[string]string{
+		"inherits:latest":           "test/fixtures/k8s/sidecarinjection-inherits.yaml: SidecarInjection inherits",
+		"logger:v1":                 "test/fixtures/k8s/lint/configmaps.yaml: ConfigMap sidecars data[logger]",
+		"sidecar-test-debug:latest": "test/fixtures/k8s/lint/configmaps.yaml: ConfigMap sidecars data[debug]",
+		"sidecar-test:latest":       "test/fixtures/sidecars/sidecar-test.yaml",
+	}
+	configs := map[string]string{}
+	for _, c := range result.Configs {
+		configs[c.FullName()] = c.Source
+	}
+	if !reflect.DeepEqual(configs, expectedConfigs) {
+		t.Errorf("expected configs %v but got %v", expectedConfigs, configs)
+	}
+	for _, c := range result.Configs {
+		// configs inheriting by name are merged with what they inherit
+		if c.FullName() == "sidecar-test-debug:latest" && (len(c.Containers) != 2 || len(c.Environment) != 3) {
+			t.Errorf("expected sidecar-test-debug:latest to be merged with sidecar-test:latest, but got %s", c.String())
+		}
+	}
+}
+
+func TestWriteConfigs(t *testing.T) {
+	result := Lint([]string{"test/fixtures/k8s/sidecarinjection-logger.yaml", "test/fixtures/k8s/sidecarinjection-inherits.yaml"})
+	if len(result.Problems) != 0 {
+		t.Fatalf("expected no problems, but got %+v", result.Problems)
+	}
+
+	var out bytes.Buffer
+	if err := result.WriteConfigs(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# inherits:latest from test/fixtures/k8s/sidecarinjection-inherits.yaml: SidecarInjection inherits
+containers:
+- image: logger:1.0
+  name: logger
+  resources: {}
+env:
+- name: LOG_LEVEL
+  value: debug
+name: inherits:latest
+---
+# logger:v1 from test/fixtures/k8s/sidecarinjection-logger.yaml: SidecarInjection logger
+containers:
+- image: logger:1.0
+  name: logger
+  resources: {}
+env:
+- name: LOG_LEVEL
+  value: info
+name: logger:v1
+`
+	if out.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, out.String())
+	}
+}
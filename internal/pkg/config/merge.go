@@ -0,0 +1,237 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+const (
+	// ContainerMergeStrategyReplace replaces inherited containers with the child's containers of the same
+	// name. This is the default.
+	ContainerMergeStrategyReplace = "replace"
+	// ContainerMergeStrategyStrategic merges the child's containers into inherited containers of the same
+	// name, field by field, following the rules of kubernetes strategic merge patches
+	ContainerMergeStrategyStrategic = "strategic"
+)
+
+// rawContainers are containers as they were written in a config, for use as a strategic merge patch.
+// Unlike corev1.Container, they only hold the fields that were set, and retain patch directives
+// like `$patch: delete`.
+type rawContainers struct {
+	Containers     []json.RawMessage `json:"containers,omitempty"`
+	InitContainers []json.RawMessage `json:"initContainers,omitempty"`
+}
+
+// podSpecContainers holds the fields of a corev1.PodSpec we merge strategically
+type podSpecContainers struct {
+	Containers     []corev1.Container `json:"containers"`
+	InitContainers []corev1.Container `json:"initContainers"`
+}
+
+func validContainerMergeStrategy(strategy string) bool {
+	switch strategy {
+	case "", ContainerMergeStrategyReplace, ContainerMergeStrategyStrategic:
+		return true
+	default:
+		return false
+	}
+}
+
+// mergeContainersStrategic merges the containers and init containers of child into c, as a strategic merge
+// patch of the pod spec
+func (c *InjectionConfig) mergeContainersStrategic(child *InjectionConfig) error {
+	patch, err := json.Marshal(child.rawContainers)
+	if child.rawContainers == nil {
+		// the child was not loaded from yaml, so it has no raw containers; use what we have
+		patch, err = json.Marshal(podSpecContainers{Containers: child.Containers, InitContainers: child.InitContainers})
+	}
+	if err != nil {
+		return err
+	}
+
+	original, err := json.Marshal(podSpecContainers{Containers: c.Containers, InitContainers: c.InitContainers})
+	if err != nil {
+		return err
+	}
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, corev1.PodSpec{})
+	if err != nil {
+		return fmt.Errorf("unable to merge containers of %s into %s: %s", child.FullName(), c.FullName(), err.Error())
+	}
+
+	var out podSpecContainers
+	if err := json.Unmarshal(merged, &out); err != nil {
+		return err
+	}
+	c.Containers = out.Containers
+	c.InitContainers = out.InitContainers
+	return nil
+}
+
+const (
+	// ContainerOrderAppend puts new containers after the inherited ones. This is the default.
+	ContainerOrderAppend = "append"
+	// ContainerOrderPrepend puts new containers before the inherited ones
+	ContainerOrderPrepend = "prepend"
+)
+
+// InheritedRemovals names inherited entries an InjectionConfig removes, by name
+type InheritedRemovals struct {
+	Containers     []string `json:"containers,omitempty"`
+	InitContainers []string `json:"initContainers,omitempty"`
+	Volumes        []string `json:"volumes,omitempty"`
+	Environment    []string `json:"env,omitempty"`
+	VolumeMounts   []string `json:"volumeMounts,omitempty"`
+}
+
+// DeepCopy returns a copy of r that shares no memory with r
+func (r *InheritedRemovals) DeepCopy() *InheritedRemovals {
+	if r == nil {
+		return nil
+	}
+	out := InheritedRemovals{}
+	for _, f := range []struct{ in, out *[]string }{
+		{&r.Containers, &out.Containers},
+		{&r.InitContainers, &out.InitContainers},
+		{&r.Volumes, &out.Volumes},
+		{&r.Environment, &out.Environment},
+		{&r.VolumeMounts, &out.VolumeMounts},
+	} {
+		if *f.in != nil {
+			*f.out = append([]string{}, *f.in...)
+		}
+	}
+	return &out
+}
+
+func validContainerOrder(order string) bool {
+	switch order {
+	case "", ContainerOrderAppend, ContainerOrderPrepend:
+		return true
+	default:
+		return false
+	}
+}
+
+// remove drops the entries of c named by r
+func (c *InjectionConfig) remove(r *InheritedRemovals) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.Containers {
+		c.Containers = removeContainer(c.Containers, name, "container", c.FullName())
+	}
+	for _, name := range r.InitContainers {
+		c.InitContainers = removeContainer(c.InitContainers, name, "init container", c.FullName())
+	}
+	for _, name := range r.Volumes {
+		kept := c.Volumes[:0]
+		for _, v := range c.Volumes {
+			if v.Name != name {
+				kept = append(kept, v)
+			}
+		}
+		warnNotRemoved(len(kept) == len(c.Volumes), "volume", name, c.FullName())
+		c.Volumes = kept
+	}
+	for _, name := range r.Environment {
+		kept := c.Environment[:0]
+		for _, e := range c.Environment {
+			if e.Name != name {
+				kept = append(kept, e)
+			}
+		}
+		warnNotRemoved(len(kept) == len(c.Environment), "env", name, c.FullName())
+		c.Environment = kept
+	}
+	for _, name := range r.VolumeMounts {
+		kept := c.VolumeMounts[:0]
+		for _, vm := range c.VolumeMounts {
+			if vm.Name != name {
+				kept = append(kept, vm)
+			}
+		}
+		warnNotRemoved(len(kept) == len(c.VolumeMounts), "volumeMount", name, c.FullName())
+		c.VolumeMounts = kept
+	}
+}
+
+func removeContainer(containers []corev1.Container, name, kind, from string) []corev1.Container {
+	kept := containers[:0]
+	for _, ctr := range containers {
+		if ctr.Name != name {
+			kept = append(kept, ctr)
+		}
+	}
+	warnNotRemoved(len(kept) == len(containers), kind, name, from)
+	return kept
+}
+
+// warnNotRemoved logs removals of things that are not inherited. This is not an error, so configs dont
+// break when the config they inherit from drops something on its own.
+func warnNotRemoved(notFound bool, kind, name, from string) {
+	if notFound {
+		glog.Warningf("Cannot remove %s %s: not inherited from %s", kind, name, from)
+	}
+}
+
+func containerNames(containers []corev1.Container) map[string]bool {
+	names := make(map[string]bool, len(containers))
+	for _, ctr := range containers {
+		names[ctr.Name] = true
+	}
+	return names
+}
+
+// prependNewContainers moves the containers not named by inherited in front of the others, keeping
+// their relative order
+func prependNewContainers(containers []corev1.Container, inherited map[string]bool) []corev1.Container {
+	out := make([]corev1.Container, 0, len(containers))
+	for _, ctr := range containers {
+		if !inherited[ctr.Name] {
+			out = append(out, ctr)
+		}
+	}
+	for _, ctr := range containers {
+		if inherited[ctr.Name] {
+			out = append(out, ctr)
+		}
+	}
+	return out
+}
+
+// mergeHostAliases merges added into hostAliases, keyed by IP, and returns the result. Hostnames are a union,
+// as hosts files allow several names per IP.
+func mergeHostAliases(hostAliases, added []corev1.HostAlias) []corev1.HostAlias {
+	for _, aha := range added {
+		contains := false
+
+		for i, ha := range hostAliases {
+			if ha.IP == aha.IP {
+				contains = true
+				hostAliases[i].Hostnames = unionStrings(ha.Hostnames, aha.Hostnames)
+			}
+		}
+
+		if !contains {
+			hostAliases = append(hostAliases, corev1.HostAlias{IP: aha.IP, Hostnames: unionStrings(nil, aha.Hostnames)})
+		}
+	}
+	return hostAliases
+}
+
+// unionStrings returns a followed by the elements of b not in a, without duplicates
+func unionStrings(a, b []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
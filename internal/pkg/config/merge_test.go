@@ -0,0 +1,398 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func containerByName(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+func TestMergeContainersStrategic(t *testing.T) {
+	ic, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/inheritance-strategic.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, c := range ic.Containers {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "foo,async-worker,kafka,a-new-image" {
+		t.Fatalf("expected containers foo,async-worker,kafka,a-new-image but got %v", names)
+	}
+
+	// scalars are overridden, everything else is inherited
+	foo := containerByName(ic.Containers, "foo")
+	if foo.Image != "some/container:1.2.4" {
+		t.Errorf("expected foo image to be overridden, but got %s", foo.Image)
+	}
+	if len(foo.Command) != 1 || foo.LivenessProbe == nil || len(foo.VolumeMounts) != 1 || !foo.Resources.Requests.Memory().Equal(resource.MustParse("1Gi")) {
+		t.Errorf("expected foo to inherit command, probe, mounts and resources, but got %+v", foo)
+	}
+
+	// env is merged by name; like in a strategic merge patch, entries of the patch come first
+	worker := containerByName(ic.Containers, "async-worker")
+	env := []string{}
+	for _, e := range worker.Env {
+		env = append(env, e.Name+"="+e.Value)
+	}
+	if strings.Join(env, ",") != "WORKERS_COUNT=5,NEW_VARIABLE=test,DAEMON_ENDPOINT=some.endpoint.798" {
+		t.Errorf("expected async-worker env to be merged, but got %v", env)
+	}
+	if worker.Image != "async-worker:1.5.6" || worker.ReadinessProbe == nil {
+		t.Errorf("expected async-worker to keep its image and readiness probe, but got %+v", worker)
+	}
+
+	// ports are merged by containerPort
+	kafka := containerByName(ic.Containers, "kafka")
+	if len(kafka.Ports) != 1 || kafka.Ports[0].Name != "kafka" {
+		t.Errorf("expected the jmx port of kafka to be deleted, but got %v", kafka.Ports)
+	}
+
+	newImage := containerByName(ic.Containers, "a-new-image")
+	if newImage == nil || newImage.Image != "some-value" {
+		t.Errorf("expected a-new-image to be added, but got %+v", newImage)
+	}
+}
+
+func TestMergeContainersStrategicByName(t *testing.T) {
+	ics := loadInjectionConfigs(t, `
+name: base
+containers:
+- name: app
+  image: app:1
+  env:
+  - name: A
+    value: a
+initContainers:
+- name: init
+  image: init:1
+  args: ["--verbose"]
+`, `
+name: child
+inherits: base
+containerMergeStrategy: strategic
+containers:
+- name: app
+  env:
+  - name: B
+    value: b
+initContainers:
+- name: init
+  image: init:2
+`)
+	resolved, errs := ResolveInheritance(ics)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	child := resolved[1]
+	if len(child.Containers) != 1 || child.Containers[0].Image != "app:1" || len(child.Containers[0].Env) != 2 {
+		t.Errorf("expected app to keep its image and get both env vars, but got %+v", child.Containers)
+	}
+	if len(child.InitContainers) != 1 || child.InitContainers[0].Image != "init:2" || len(child.InitContainers[0].Args) != 1 {
+		t.Errorf("expected init to get the new image and keep its args, but got %+v", child.InitContainers)
+	}
+	// the base must not be modified
+	if len(ics[0].Containers[0].Env) != 1 || ics[0].InitContainers[0].Image != "init:1" {
+		t.Errorf("expected the base config not to be modified")
+	}
+}
+
+func TestMergeHostAliases(t *testing.T) {
+	ics := loadInjectionConfigs(t, `
+name: base
+hostAliases:
+- ip: 1.2.3.4
+  hostnames: [a.example.com, b.example.com]
+- ip: 4.3.2.1
+  hostnames: [c.example.com]
+`, `
+name: child
+inherits: base
+hostAliases:
+- ip: 1.2.3.4
+  hostnames: [b.example.com, d.example.com]
+- ip: 5.6.7.8
+  hostnames: [e.example.com, e.example.com]
+- ip: 5.6.7.8
+  hostnames: [f.example.com]
+`)
+	resolved, errs := ResolveInheritance(ics)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	aliases := []string{}
+	for _, ha := range resolved[1].HostAliases {
+		aliases = append(aliases, ha.IP+"="+strings.Join(ha.Hostnames, "+"))
+	}
+	expected := "1.2.3.4=a.example.com+b.example.com+d.example.com,4.3.2.1=c.example.com,5.6.7.8=e.example.com+f.example.com"
+	if strings.Join(aliases, ",") != expected {
+		t.Errorf("expected hostAliases %s but got %s", expected, strings.Join(aliases, ","))
+	}
+}
+
+func TestMergeRemoveAndOrder(t *testing.T) {
+	ics := loadInjectionConfigs(t, `
+name: base
+containers:
+- name: app
+  image: app:1
+- name: proxy
+  image: proxy:1
+initContainers:
+- name: init
+  image: init:1
+volumes:
+- name: data
+  emptyDir: {}
+- name: cache
+  emptyDir: {}
+env:
+- name: A
+  value: a
+- name: B
+  value: b
+volumeMounts:
+- name: data
+  mountPath: /data
+- name: cache
+  mountPath: /cache
+`, `
+name: child
+inherits: base
+containerOrder: prepend
+remove:
+  containers: [proxy, not-inherited]
+  initContainers: [init]
+  volumes: [cache]
+  env: [A]
+  volumeMounts: [cache]
+containers:
+- name: new-proxy
+  image: proxy:2
+- name: app
+  image: app:2
+initContainers:
+- name: new-init
+  image: init:2
+env:
+# removed and redefined
+- name: A
+  value: child
+`)
+	resolved, errs := ResolveInheritance(ics)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	child := resolved[1]
+	names := func(containers []corev1.Container) string {
+		n := []string{}
+		for _, c := range containers {
+			n = append(n, c.Name+"="+c.Image)
+		}
+		return strings.Join(n, ",")
+	}
+	if names(child.Containers) != "new-proxy=proxy:2,app=app:2" {
+		t.Errorf("expected new containers first and proxy removed, but got %s", names(child.Containers))
+	}
+	if names(child.InitContainers) != "new-init=init:2" {
+		t.Errorf("expected init removed, but got %s", names(child.InitContainers))
+	}
+	if len(child.Volumes) != 1 || child.Volumes[0].Name != "data" {
+		t.Errorf("expected volume cache removed, but got %v", child.Volumes)
+	}
+	if len(child.VolumeMounts) != 1 || child.VolumeMounts[0].Name != "data" {
+		t.Errorf("expected volumeMount cache removed, but got %v", child.VolumeMounts)
+	}
+	env := []string{}
+	for _, e := range child.Environment {
+		env = append(env, e.Name+"="+e.Value)
+	}
+	if strings.Join(env, ",") != "B=b,A=child" {
+		t.Errorf("expected env A removed and redefined, but got %v", env)
+	}
+	// the base must not be modified
+	if names(ics[0].Containers) != "app=app:1,proxy=proxy:1" || len(ics[0].Volumes) != 2 || len(ics[0].Environment) != 2 {
+		t.Errorf("expected the base config not to be modified")
+	}
+}
+
+func TestMergeClearsRemove(t *testing.T) {
+	ics := loadInjectionConfigs(t, `
+name: base
+remove:
+  containers: [proxy]
+containers:
+- name: app
+  image: app:1
+`, `
+name: base
+containers:
+- name: app
+  image: app:1
+`, `
+name: child
+inherits: base
+remove:
+  containers: [app]
+`)
+	merged := ics[0].DeepCopy()
+	if err := merged.Merge(ics[2]); err != nil {
+		t.Fatal(err)
+	}
+	if merged.Remove != nil || len(merged.Containers) != 0 {
+		t.Errorf("expected the removals to be applied and cleared, but got %s", merged.String())
+	}
+	y, err := merged.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(y), "remove") {
+		t.Errorf("expected no removals in the yaml of the merged config, but got\n%s", y)
+	}
+
+	// what the base removed does not change the hash of the merged config either
+	withoutRemove := ics[1].DeepCopy()
+	if err := withoutRemove.Merge(ics[2]); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := merged.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, err := withoutRemove.Hash(); err != nil || hash != expected {
+		t.Errorf("expected the hash of the merged config to be %s, but got %s (%v)", expected, hash, err)
+	}
+}
+
+func TestMergePodSettings(t *testing.T) {
+	ics := loadInjectionConfigs(t, `
+name: base
+tolerations:
+- key: dedicated
+  operator: Equal
+  value: agents
+nodeSelector:
+  pool: agents
+  zone: a
+affinity:
+  nodeAffinity:
+    requiredDuringSchedulingIgnoredDuringExecution:
+      nodeSelectorTerms:
+      - matchExpressions:
+        - key: gpu
+          operator: DoesNotExist
+priorityClassName: low
+dnsConfig:
+  nameservers: [10.0.0.10]
+  options:
+  - name: ndots
+    value: "2"
+securityContext:
+  runAsUser: 1000
+  fsGroup: 1000
+`, `
+name: child
+inherits: base
+tolerations:
+- key: dedicated
+  operator: Equal
+  value: agents
+- key: gpu
+  operator: Exists
+nodeSelector:
+  zone: b
+affinity:
+  podAntiAffinity:
+    requiredDuringSchedulingIgnoredDuringExecution:
+    - topologyKey: kubernetes.io/hostname
+priorityClassName: high
+dnsConfig:
+  nameservers: [10.0.0.11]
+  options:
+  - name: ndots
+    value: "5"
+shareProcessNamespace: true
+securityContext:
+  fsGroup: 2000
+`)
+	resolved, errs := ResolveInheritance(ics)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	child := resolved[1]
+	if len(child.Tolerations) != 2 {
+		t.Errorf("expected 2 tolerations but got %d", len(child.Tolerations))
+	}
+	if child.NodeSelector["pool"] != "agents" || child.NodeSelector["zone"] != "b" {
+		t.Errorf("expected nodeSelector pool=agents,zone=b but got %v", child.NodeSelector)
+	}
+	if child.Affinity.NodeAffinity == nil || child.Affinity.PodAntiAffinity == nil {
+		t.Errorf("expected inherited nodeAffinity and child podAntiAffinity but got %+v", child.Affinity)
+	}
+	if child.PriorityClassName != "high" {
+		t.Errorf("expected priorityClassName high but got %s", child.PriorityClassName)
+	}
+	if strings.Join(child.DNSConfig.Nameservers, ",") != "10.0.0.10,10.0.0.11" {
+		t.Errorf("expected nameservers 10.0.0.10,10.0.0.11 but got %v", child.DNSConfig.Nameservers)
+	}
+	if len(child.DNSConfig.Options) != 1 || *child.DNSConfig.Options[0].Value != "5" {
+		t.Errorf("expected ndots option 5 but got %+v", child.DNSConfig.Options)
+	}
+	if child.ShareProcessNamespace == nil || !*child.ShareProcessNamespace {
+		t.Errorf("expected shareProcessNamespace true but got %v", child.ShareProcessNamespace)
+	}
+	if *child.SecurityContext.RunAsUser != 1000 || *child.SecurityContext.FSGroup != 2000 {
+		t.Errorf("expected securityContext runAsUser 1000 and fsGroup 2000 but got %+v", child.SecurityContext)
+	}
+	// the base config must not change
+	if *resolved[0].SecurityContext.FSGroup != 1000 || resolved[0].NodeSelector["zone"] != "a" {
+		t.Errorf("expected base config to be unchanged but got %+v", resolved[0])
+	}
+}
+
+func TestMergeLabelsAndAnnotations(t *testing.T) {
+	ics := loadInjectionConfigs(t, `
+name: base
+metadataPolicy: override
+labels:
+  team: observability
+annotations:
+  prometheus.io/scrape: "true"
+  prometheus.io/port: "9102"
+`, `
+name: child
+inherits: base
+labels:
+  tier: agents
+annotations:
+  prometheus.io/port: "9200"
+`)
+	resolved, errs := ResolveInheritance(ics)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	child := resolved[1]
+	if child.Labels["team"] != "observability" || child.Labels["tier"] != "agents" {
+		t.Errorf("expected labels team=observability,tier=agents but got %v", child.Labels)
+	}
+	if child.Annotations["prometheus.io/scrape"] != "true" || child.Annotations["prometheus.io/port"] != "9200" {
+		t.Errorf("expected annotations prometheus.io/scrape=true,prometheus.io/port=9200 but got %v", child.Annotations)
+	}
+	if child.GetMetadataPolicy() != PolicyOverride {
+		t.Errorf("expected inherited metadataPolicy %s but got %s", PolicyOverride, child.GetMetadataPolicy())
+	}
+	if resolved[0].Annotations["prometheus.io/port"] != "9102" {
+		t.Errorf("expected base annotations to be unchanged but got %v", resolved[0].Annotations)
+	}
+}
@@ -0,0 +1,296 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mergePodSettings merges the pod level settings of child into c. Like everywhere else in Merge, the child
+// wins: lists are combined, and the keys of maps and the fields of structs set by the child replace the
+// inherited ones.
+func (c *InjectionConfig) mergePodSettings(child *InjectionConfig) error {
+	for _, t := range child.Tolerations {
+		if !HasToleration(c.Tolerations, t) {
+			c.Tolerations = append(c.Tolerations, *t.DeepCopy())
+		}
+	}
+
+	c.NodeSelector = mergeStringMaps(c.NodeSelector, child.NodeSelector)
+
+	// affinity is merged by kind: a child setting podAntiAffinity keeps the inherited nodeAffinity
+	if child.Affinity != nil {
+		affinity := &corev1.Affinity{}
+		if err := overlayFields(c.Affinity, child.Affinity, affinity); err != nil {
+			return fmt.Errorf("unable to merge affinity of %s into %s: %s", child.FullName(), c.FullName(), err.Error())
+		}
+		c.Affinity = affinity
+	}
+
+	if child.PriorityClassName != "" {
+		c.PriorityClassName = child.PriorityClassName
+	}
+
+	if child.DNSConfig != nil {
+		dnsConfig := &corev1.PodDNSConfig{}
+		if c.DNSConfig != nil {
+			c.DNSConfig.DeepCopyInto(dnsConfig)
+		}
+		dnsConfig.Nameservers = unionStrings(dnsConfig.Nameservers, child.DNSConfig.Nameservers)
+		dnsConfig.Searches = unionStrings(dnsConfig.Searches, child.DNSConfig.Searches)
+		for _, o := range child.DNSConfig.Options {
+			contains := false
+			for i := range dnsConfig.Options {
+				if dnsConfig.Options[i].Name == o.Name {
+					contains = true
+					o.DeepCopyInto(&dnsConfig.Options[i])
+				}
+			}
+			if !contains {
+				dnsConfig.Options = append(dnsConfig.Options, *o.DeepCopy())
+			}
+		}
+		c.DNSConfig = dnsConfig
+	}
+
+	for _, s := range child.ImagePullSecrets {
+		if !hasImagePullSecret(c.ImagePullSecrets, s.Name) {
+			c.ImagePullSecrets = append(c.ImagePullSecrets, s)
+		}
+	}
+
+	if child.ShareProcessNamespace != nil {
+		shareProcessNamespace := *child.ShareProcessNamespace
+		c.ShareProcessNamespace = &shareProcessNamespace
+	}
+
+	// the security context is merged field by field, i.e. runAsUser and fsGroup can come from different configs
+	if child.SecurityContext != nil {
+		securityContext := &corev1.PodSecurityContext{}
+		if err := overlayFields(c.SecurityContext, child.SecurityContext, securityContext); err != nil {
+			return fmt.Errorf("unable to merge securityContext of %s into %s: %s", child.FullName(), c.FullName(), err.Error())
+		}
+		c.SecurityContext = securityContext
+	}
+	return nil
+}
+
+// combinePodSettings adds the pod level settings of ic to c, for CombineInjectionConfigs. It returns the
+// conflicts with what c already holds; owners tracks which config set what, like in CombineInjectionConfigs.
+func (c *InjectionConfig) combinePodSettings(ic *InjectionConfig, owner string, owners map[string]string) (conflicts []string, err error) {
+	// tolerations and image pull secrets only allow more, so neither can conflict
+	for _, t := range ic.Tolerations {
+		if !HasToleration(c.Tolerations, t) {
+			c.Tolerations = append(c.Tolerations, t)
+		}
+	}
+	for _, s := range ic.ImagePullSecrets {
+		if !hasImagePullSecret(c.ImagePullSecrets, s.Name) {
+			c.ImagePullSecrets = append(c.ImagePullSecrets, s)
+		}
+	}
+
+	c.NodeSelector, conflicts = combineStringMaps("nodeSelector", c.NodeSelector, ic.NodeSelector, owner, owners, conflicts)
+
+	if ic.Affinity != nil {
+		affinity := &corev1.Affinity{}
+		affinityConflicts, err := combineFields("affinity", c.Affinity, ic.Affinity, owner, owners, affinity)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, affinityConflicts...)
+		c.Affinity = affinity
+	}
+
+	if ic.PriorityClassName != "" {
+		if c.PriorityClassName == "" {
+			c.PriorityClassName = ic.PriorityClassName
+			owners["priorityClassName"] = owner
+		} else if c.PriorityClassName != ic.PriorityClassName {
+			conflicts = append(conflicts, fmt.Sprintf("priorityClassName is set to %s by %s and to %s by %s",
+				c.PriorityClassName, owners["priorityClassName"], ic.PriorityClassName, owner))
+		}
+	}
+
+	if ic.DNSConfig != nil {
+		if c.DNSConfig == nil {
+			c.DNSConfig = &corev1.PodDNSConfig{}
+		}
+		c.DNSConfig.Nameservers = unionStrings(c.DNSConfig.Nameservers, ic.DNSConfig.Nameservers)
+		c.DNSConfig.Searches = unionStrings(c.DNSConfig.Searches, ic.DNSConfig.Searches)
+		for _, o := range ic.DNSConfig.Options {
+			key := "dnsConfig option " + o.Name
+			contains := false
+			for _, existing := range c.DNSConfig.Options {
+				if existing.Name == o.Name {
+					contains = true
+					if !reflect.DeepEqual(existing, o) {
+						conflicts = append(conflicts, fmt.Sprintf("%s is defined by both %s and %s", key, owners[key], owner))
+					}
+				}
+			}
+			if !contains {
+				c.DNSConfig.Options = append(c.DNSConfig.Options, o)
+				owners[key] = owner
+			}
+		}
+	}
+
+	if ic.ShareProcessNamespace != nil {
+		if c.ShareProcessNamespace == nil {
+			c.ShareProcessNamespace = ic.ShareProcessNamespace
+			owners["shareProcessNamespace"] = owner
+		} else if *c.ShareProcessNamespace != *ic.ShareProcessNamespace {
+			conflicts = append(conflicts, fmt.Sprintf("shareProcessNamespace is set to %t by %s and to %t by %s",
+				*c.ShareProcessNamespace, owners["shareProcessNamespace"], *ic.ShareProcessNamespace, owner))
+		}
+	}
+
+	if ic.SecurityContext != nil {
+		securityContext := &corev1.PodSecurityContext{}
+		securityContextConflicts, err := combineFields("securityContext", c.SecurityContext, ic.SecurityContext, owner, owners, securityContext)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, securityContextConflicts...)
+		c.SecurityContext = securityContext
+	}
+	return conflicts, nil
+}
+
+// HasToleration returns true if existing has a toleration equal to t: one that matches it (see
+// corev1.Toleration.MatchToleration) and tolerates taints for as long
+func HasToleration(existing []corev1.Toleration, t corev1.Toleration) bool {
+	for _, e := range existing {
+		if e.MatchToleration(&t) && reflect.DeepEqual(e.TolerationSeconds, t.TolerationSeconds) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasImagePullSecret(existing []corev1.LocalObjectReference, name string) bool {
+	for _, e := range existing {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONFields returns the fields of v that are set, as serialized to JSON. A nil v has no fields.
+func JSONFields(v interface{}) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	if out == nil {
+		out = map[string]json.RawMessage{}
+	}
+	return out, nil
+}
+
+// overlayFields sets out to base, with the fields set in overlay replacing those of base
+func overlayFields(base, overlay, out interface{}) error {
+	merged, err := JSONFields(base)
+	if err != nil {
+		return err
+	}
+	overlayed, err := JSONFields(overlay)
+	if err != nil {
+		return err
+	}
+	for k, v := range overlayed {
+		merged[k] = v
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// combineFields sets out to the fields of current and added. Fields set differently by both are conflicts;
+// owners is keyed by "<kind>.<field>".
+func combineFields(kind string, current, added interface{}, owner string, owners map[string]string, out interface{}) (conflicts []string, err error) {
+	combined, err := JSONFields(current)
+	if err != nil {
+		return nil, err
+	}
+	addedFields, err := JSONFields(added)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(addedFields))
+	for name := range addedFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := kind + "." + name
+		if existing, ok := combined[name]; !ok {
+			combined[name] = addedFields[name]
+			owners[key] = owner
+		} else if !bytes.Equal(existing, addedFields[name]) {
+			conflicts = append(conflicts, fmt.Sprintf("%s is defined by both %s and %s", key, owners[key], owner))
+		}
+	}
+	data, err := json.Marshal(combined)
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, json.Unmarshal(data, out)
+}
+
+// mergeStringMaps returns a map with the keys of base and child, with the values of child for keys in both.
+// Neither base nor child are modified.
+func mergeStringMaps(base, child map[string]string) map[string]string {
+	if len(child) == 0 {
+		return base
+	}
+	merged := make(map[string]string, len(base)+len(child))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range child {
+		merged[k] = v
+	}
+	return merged
+}
+
+// combineStringMaps adds the keys of added to combined, for CombineInjectionConfigs, appending a conflict for
+// each key already set to a different value. owners is keyed by "<kind> <key>".
+func combineStringMaps(kind string, combined, added map[string]string, owner string, owners map[string]string, conflicts []string) (map[string]string, []string) {
+	for _, k := range SortedKeys(added) {
+		v := added[k]
+		key := kind + " " + k
+		if current, ok := combined[k]; !ok {
+			if combined == nil {
+				combined = map[string]string{}
+			}
+			combined[k] = v
+			owners[key] = owner
+		} else if current != v {
+			conflicts = append(conflicts, fmt.Sprintf("%s %s is set to %s by %s and to %s by %s", kind, k, current, owners[key], v, owner))
+		}
+	}
+	return combined, conflicts
+}
+
+// SortedKeys returns the keys of m, sorted
+func SortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
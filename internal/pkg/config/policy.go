@@ -0,0 +1,61 @@
+package config
+
+const (
+	// PolicyAddOnly only adds env vars or volume mounts that application containers do not define yet,
+	// and never touches the ones they do define. This is the default.
+	PolicyAddOnly = "add-only"
+	// PolicyOverride adds env vars or volume mounts, replacing the ones application containers already
+	// define with the same name
+	PolicyOverride = "override"
+	// PolicyRemove removes env vars or volume mounts with the same name from application containers,
+	// instead of adding them to any container
+	PolicyRemove = "remove"
+
+	// FailurePolicyIgnore admits pods without injection when the configs they request cannot be injected,
+	// i.e. because one of them is missing. This is the default.
+	FailurePolicyIgnore = "Ignore"
+	// FailurePolicyFail rejects pods when the configs they request cannot be injected
+	FailurePolicyFail = "Fail"
+)
+
+func validPolicy(policy string) bool {
+	switch policy {
+	case "", PolicyAddOnly, PolicyOverride, PolicyRemove:
+		return true
+	default:
+		return false
+	}
+}
+
+// effectivePolicy returns policy, or PolicyAddOnly if it is unset
+func effectivePolicy(policy string) string {
+	if policy == "" {
+		return PolicyAddOnly
+	}
+	return policy
+}
+
+// GetEnvPolicy returns how env vars are applied to the containers of a pod
+func (c *InjectionConfig) GetEnvPolicy() string {
+	return effectivePolicy(c.EnvPolicy)
+}
+
+// GetVolumeMountPolicy returns how volume mounts are applied to the containers of a pod
+func (c *InjectionConfig) GetVolumeMountPolicy() string {
+	return effectivePolicy(c.VolumeMountPolicy)
+}
+
+// GetMetadataPolicy returns how labels and annotations are applied to a pod
+func (c *InjectionConfig) GetMetadataPolicy() string {
+	return effectivePolicy(c.MetadataPolicy)
+}
+
+// ValidFailurePolicy returns true if policy is FailurePolicyIgnore, FailurePolicyFail, or unset
+func ValidFailurePolicy(policy string) bool {
+	switch policy {
+	case "", FailurePolicyIgnore, FailurePolicyFail:
+		return true
+	default:
+		return false
+	}
+}
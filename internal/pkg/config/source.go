@@ -0,0 +1,137 @@
+package config
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// InheritedConfig is a config in the inheritance chain of an InjectionConfig
+type InheritedConfig struct {
+	// Name is the full name of the config
+	Name string `json:"name"`
+	// Source is where the config was loaded from, see InjectionConfig.Source
+	Source string `json:"source"`
+}
+
+// LoadedInjectionConfig is an InjectionConfig loaded in a Config
+type LoadedInjectionConfig struct {
+	*InjectionConfig
+	// Hash is the Hash of the InjectionConfig
+	Hash string
+	// LoadedAt is when the InjectionConfig was loaded with this Hash, i.e. when it was first loaded, or last
+	// changed
+	LoadedAt time.Time
+}
+
+// loadedVersion is the hash a config was loaded with, and when
+type loadedVersion struct {
+	hash     string
+	loadedAt time.Time
+}
+
+// Source returns where the InjectionConfig was loaded from: the path of its file, "ConfigMap namespace/name
+// data[key]" or "SidecarInjection namespace/name", or "" if unknown
+func (c *InjectionConfig) Source() string {
+	return c.source
+}
+
+// SetSource sets where the InjectionConfig was loaded from, for configs loaded with LoadInjectionConfig
+func (c *InjectionConfig) SetSource(source string) {
+	c.source = source
+}
+
+// InheritanceChain returns the configs merged into this InjectionConfig, starting with itself and followed by
+// the config it inherits from, up to the one inheriting nothing. Configs that inherit nothing, or whose
+// inheritance is not resolved yet, only return themselves.
+func (c *InjectionConfig) InheritanceChain() []InheritedConfig {
+	if c.inheritance == nil {
+		return []InheritedConfig{{Name: c.FullName(), Source: c.source}}
+	}
+	return append([]InheritedConfig{}, c.inheritance...)
+}
+
+// YAML returns the InjectionConfig as yaml, without the fields it leaves unset, and named by its full name so
+// the version is kept. Once its inheritance is resolved, this is the effective config: what it inherits is
+// merged in, and it inherits nothing.
+func (c *InjectionConfig) YAML() ([]byte, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range fields {
+		switch v := value.(type) {
+		case nil:
+			delete(fields, key)
+		case bool:
+			if !v {
+				delete(fields, key)
+			}
+		case string:
+			if v == "" {
+				delete(fields, key)
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				delete(fields, key)
+			}
+		case map[string]interface{}:
+			if len(v) == 0 {
+				delete(fields, key)
+			}
+		}
+	}
+	if c.resolved {
+		delete(fields, "inherits")
+	}
+	fields["name"] = c.FullName()
+	return yaml.Marshal(fields)
+}
+
+// recordReload records that Injections were loaded at now. Configs whose hash did not change keep the time they
+// were loaded at. Must be called with c locked.
+func (c *Config) recordReload(now time.Time) {
+	loaded := make(map[string]loadedVersion, len(c.Injections))
+	for name, ic := range c.Injections {
+		hash, _ := ic.Hash()
+		if previous, ok := c.loaded[name]; ok && previous.hash == hash {
+			loaded[name] = previous
+			continue
+		}
+		loaded[name] = loadedVersion{hash: hash, loadedAt: now}
+	}
+	c.loaded = loaded
+	c.lastReload = now
+}
+
+// LastReload returns when the InjectionConfigs were last loaded or replaced, whether they changed or not
+func (c *Config) LastReload() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	return c.lastReload
+}
+
+// LoadedInjectionConfigs returns all InjectionConfigs, sorted by their FullName, with their hash and when they
+// were loaded
+func (c *Config) LoadedInjectionConfigs() []LoadedInjectionConfig {
+	c.RLock()
+	defer c.RUnlock()
+
+	loaded := make([]LoadedInjectionConfig, 0, len(c.Injections))
+	for name, ic := range c.Injections {
+		version, ok := c.loaded[name]
+		if !ok {
+			// not loaded through LoadConfigDirectory or ReplaceInjectionConfigs
+			version.hash, _ = ic.Hash()
+		}
+		loaded = append(loaded, LoadedInjectionConfig{InjectionConfig: ic, Hash: version.hash, LoadedAt: version.loadedAt})
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].FullName() < loaded[j].FullName() })
+	return loaded
+}
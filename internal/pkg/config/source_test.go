@@ -0,0 +1,133 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInheritanceChain(t *testing.T) {
+	deep, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/inheritance-deep-2.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ics := append([]*InjectionConfig{deep}, loadInjectionConfigs(t, `
+name: deeper
+inherits: inheritance-deep:v2
+`, `
+name: plain
+`)...)
+	ics[1].SetSource("ConfigMap default/sidecars data[deeper]")
+	ics[2].SetSource("ConfigMap default/sidecars data[plain]")
+
+	resolved, errs := ResolveInheritance(ics)
+	if len(errs) != 0 {
+		t.Fatalf("expected no inheritance errors, but got %v", errs)
+	}
+	diskChain := []InheritedConfig{
+		{Name: "inheritance-deep:v2", Source: fixtureSidecarsDir + "/inheritance-deep-2.yaml"},
+		{Name: "inheritance-complex:v1", Source: fixtureSidecarsDir + "/inheritance-1.yaml"},
+		{Name: "complex-sidecar:v420.69", Source: fixtureSidecarsDir + "/complex-sidecar.yaml"},
+	}
+	for _, test := range []struct {
+		ic     *InjectionConfig
+		source string
+		chain  []InheritedConfig
+	}{
+		{ic: resolved[0], source: fixtureSidecarsDir + "/inheritance-deep-2.yaml", chain: diskChain},
+		{
+			ic:     resolved[1],
+			source: "ConfigMap default/sidecars data[deeper]",
+			chain:  append([]InheritedConfig{{Name: "deeper:latest", Source: "ConfigMap default/sidecars data[deeper]"}}, diskChain...),
+		},
+		{
+			ic:     resolved[2],
+			source: "ConfigMap default/sidecars data[plain]",
+			chain:  []InheritedConfig{{Name: "plain:latest", Source: "ConfigMap default/sidecars data[plain]"}},
+		},
+	} {
+		if test.ic.Source() != test.source {
+			t.Errorf("%s: expected source %q but got %q", test.ic.FullName(), test.source, test.ic.Source())
+		}
+		if chain := test.ic.InheritanceChain(); !reflect.DeepEqual(chain, test.chain) {
+			t.Errorf("%s: expected inheritance chain %v but got %v", test.ic.FullName(), test.chain, chain)
+		}
+	}
+	// resolving does not touch the configs resolved
+	if chain := ics[1].InheritanceChain(); len(chain) != 1 {
+		t.Errorf("expected the unresolved config to only inherit from itself, but got %v", chain)
+	}
+}
+
+func TestLoadedInjectionConfigs(t *testing.T) {
+	cfg, err := LoadConfigDirectory(fixtureSidecarsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstLoad := cfg.LastReload()
+	if firstLoad.IsZero() {
+		t.Fatal("expected the load time to be recorded")
+	}
+	loaded := cfg.LoadedInjectionConfigs()
+	if len(loaded) != len(cfg.Injections) {
+		t.Fatalf("expected %d loaded configs but got %d", len(cfg.Injections), len(loaded))
+	}
+	for i, l := range loaded {
+		hash, err := l.InjectionConfig.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Hash != hash || !l.LoadedAt.Equal(firstLoad) {
+			t.Errorf("%s: expected hash %s loaded at %s, but got %s at %s", l.FullName(), hash, firstLoad, l.Hash, l.LoadedAt)
+		}
+		if i > 0 && loaded[i-1].FullName() >= l.FullName() {
+			t.Errorf("expected configs sorted by full name, but got %s before %s", loaded[i-1].FullName(), l.FullName())
+		}
+	}
+
+	// only configs that changed are reloaded
+	time.Sleep(time.Millisecond)
+	changed := loadInjectionConfigs(t, `
+name: sidecar-test
+containers:
+- name: changed
+  image: changed:1.0
+`)[0]
+	cfg.ReplaceInjectionConfigs([]*InjectionConfig{cfg.Injections["env1:latest"], changed})
+	if !cfg.LastReload().After(firstLoad) {
+		t.Errorf("expected the reload to be recorded after %s, but got %s", firstLoad, cfg.LastReload())
+	}
+	loaded = cfg.LoadedInjectionConfigs()
+	if len(loaded) != 2 || loaded[0].FullName() != "env1:latest" || loaded[1].FullName() != "sidecar-test:latest" {
+		t.Fatalf("expected env1:latest and sidecar-test:latest to be loaded, but got %v", loaded)
+	}
+	if !loaded[0].LoadedAt.Equal(firstLoad) {
+		t.Errorf("expected the unchanged env1:latest to keep its load time %s, but got %s", firstLoad, loaded[0].LoadedAt)
+	}
+	if !loaded[1].LoadedAt.Equal(cfg.LastReload()) {
+		t.Errorf("expected the changed sidecar-test:latest to be loaded at %s, but got %s", cfg.LastReload(), loaded[1].LoadedAt)
+	}
+}
+
+func TestInjectionConfigYAML(t *testing.T) {
+	ic := loadInjectionConfigs(t, `
+name: logger:v1
+containers:
+- name: logger
+  image: logger:1.0
+hostNetwork: false
+`)[0]
+	data, err := ic.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `containers:
+- image: logger:1.0
+  name: logger
+  resources: {}
+name: logger:v1
+`
+	if string(data) != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, data)
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Store keeps the InjectionConfigs of each source of configs (like the config directory, or ConfigMaps) in its
+// own layer, and replaces the InjectionConfigs of a Config with the merged view of all layers whenever one is
+// updated. When several layers define the same full name, the config of the layer with the highest precedence
+// is used, and the conflict is logged.
+type Store struct {
+	config *Config
+	// layers are the names of the layers, by increasing precedence
+	layers []string
+
+	lock    sync.Mutex
+	configs map[string][]*InjectionConfig
+	// conflicts describes the configs defined by several layers, by full name, as last logged
+	conflicts map[string]string
+}
+
+// NewStore creates a Store updating cfg, with layers in order of increasing precedence: a config overrides the
+// configs of the same full name in the layers before it
+func NewStore(cfg *Config, layers ...string) *Store {
+	return &Store{
+		config:    cfg,
+		layers:    layers,
+		configs:   map[string][]*InjectionConfig{},
+		conflicts: map[string]string{},
+	}
+}
+
+// Update replaces the InjectionConfigs of the layers in updates, and the InjectionConfigs of the Config with the
+// merged view of all layers, with their inheritance resolved by name across layers (see ResolveInheritance).
+// The configs that fail to resolve are left out, and their errors are returned keyed by full name. Layers
+// missing from updates keep their configs.
+func (s *Store) Update(updates map[string][]*InjectionConfig) (map[string]error, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for layer := range updates {
+		if !s.hasLayer(layer) {
+			return nil, fmt.Errorf("unknown config layer %s", layer)
+		}
+	}
+	for layer, ics := range updates {
+		s.configs[layer] = ics
+	}
+
+	merged := s.merge()
+	resolved, errs := ResolveInheritance(merged)
+	s.config.ReplaceInjectionConfigs(resolved)
+	return errs, nil
+}
+
+func (s *Store) hasLayer(layer string) bool {
+	for _, l := range s.layers {
+		if l == layer {
+			return true
+		}
+	}
+	return false
+}
+
+// merge returns the configs of all layers, sorted by full name, with overridden configs left out. Conflicts
+// that changed since the last merge are logged. Must be called with s locked.
+func (s *Store) merge() []*InjectionConfig {
+	byName := map[string]*InjectionConfig{}
+	// definitions are where each config is defined, by full name, by increasing precedence
+	definitions := map[string][]string{}
+	for _, layer := range s.layers {
+		for _, ic := range s.configs[layer] {
+			name := ic.FullName()
+			byName[name] = ic
+			definitions[name] = append(definitions[name], describeDefinition(layer, ic))
+		}
+	}
+
+	conflicts := map[string]string{}
+	for name, defined := range definitions {
+		if len(defined) < 2 {
+			continue
+		}
+		conflict := fmt.Sprintf("InjectionConfig %s is defined by %s; using the one from %s", name, strings.Join(defined, ", "), defined[len(defined)-1])
+		conflicts[name] = conflict
+		if s.conflicts[name] != conflict {
+			glog.Warning(conflict)
+		}
+	}
+	for name := range s.conflicts {
+		if _, ok := conflicts[name]; !ok {
+			glog.Infof("InjectionConfig %s is no longer defined more than once", name)
+		}
+	}
+	s.conflicts = conflicts
+
+	merged := make([]*InjectionConfig, 0, len(byName))
+	for _, ic := range byName {
+		merged = append(merged, ic)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].FullName() < merged[j].FullName() })
+	return merged
+}
+
+// describeDefinition describes where ic is defined, for logging conflicts
+func describeDefinition(layer string, ic *InjectionConfig) string {
+	if ic.Source() == "" {
+		return layer
+	}
+	return fmt.Sprintf("%s (%s)", layer, ic.Source())
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// injectionConfigNames returns the sorted full names of the InjectionConfigs of cfg
+func injectionConfigNames(cfg *Config) string {
+	names := []string{}
+	for name := range cfg.Injections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestStore(t *testing.T) {
+	disk, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/env1.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{}
+	s := NewStore(cfg, "directory", "configmaps", "sidecarinjections")
+	if _, err := s.Update(map[string][]*InjectionConfig{"directory": {disk}}); err != nil {
+		t.Fatal(err)
+	}
+	if names := injectionConfigNames(cfg); names != "env1:latest" {
+		t.Fatalf("expected env1:latest to be loaded, but got %s", names)
+	}
+
+	configMaps := loadInjectionConfigs(t, `
+name: logger
+inherits: env1
+containers:
+- name: logger
+  image: logger:1.0
+`, `
+name: env1
+env:
+- name: FROM
+  value: configmap
+`)
+	configMaps[1].SetSource("ConfigMap default/sidecars data[env1]")
+	errs, err := s.Update(map[string][]*InjectionConfig{"configmaps": configMaps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("expected no inheritance errors, but got %v", errs)
+	}
+	if names := injectionConfigNames(cfg); names != "env1:latest,logger:latest" {
+		t.Fatalf("expected env1:latest and logger:latest to be loaded, but got %s", names)
+	}
+	// configmaps override the directory, and configs inherit from the config that won
+	if source := cfg.Injections["env1:latest"].Source(); source != "ConfigMap default/sidecars data[env1]" {
+		t.Errorf("expected env1:latest to be loaded from the ConfigMap, but got %q", source)
+	}
+	if env := cfg.Injections["logger:latest"].Environment; len(env) != 1 || env[0].Value != "configmap" {
+		t.Errorf("expected logger:latest to inherit env1:latest from the ConfigMap, but got env %v", env)
+	}
+	if conflict := s.conflicts["env1:latest"]; conflict != "InjectionConfig env1:latest is defined by directory (test/fixtures/sidecars/env1.yaml), configmaps (ConfigMap default/sidecars data[env1]); using the one from configmaps (ConfigMap default/sidecars data[env1])" {
+		t.Errorf("expected the conflict on env1:latest to be recorded, but got %q", conflict)
+	}
+
+	// configs deleted from the api go away, but the directory is kept
+	errs, err = s.Update(map[string][]*InjectionConfig{"configmaps": configMaps[:1], "sidecarinjections": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("expected no inheritance errors, but got %v", errs)
+	}
+	if names := injectionConfigNames(cfg); names != "env1:latest,logger:latest" {
+		t.Fatalf("expected env1:latest and logger:latest to be loaded, but got %s", names)
+	}
+	if cfg.Injections["env1:latest"] != disk {
+		t.Errorf("expected env1:latest to be loaded from the directory again, but got %s", cfg.Injections["env1:latest"].Source())
+	}
+	if len(s.conflicts) != 0 {
+		t.Errorf("expected no conflicts, but got %v", s.conflicts)
+	}
+	errs, err = s.Update(map[string][]*InjectionConfig{"configmaps": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := injectionConfigNames(cfg); names != "env1:latest" {
+		t.Fatalf("expected only env1:latest to be loaded, but got %s", names)
+	}
+
+	// configs failing to resolve are not loaded
+	errs, err = s.Update(map[string][]*InjectionConfig{"sidecarinjections": loadInjectionConfigs(t, `
+name: orphan
+inherits: missing
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(errs["orphan:latest"], ErrInheritedConfigNotFound) || injectionConfigNames(cfg) != "env1:latest" {
+		t.Errorf("expected orphan:latest to fail to resolve, but got %v and configs %s", errs, injectionConfigNames(cfg))
+	}
+
+	if _, err := s.Update(map[string][]*InjectionConfig{"unknown": nil}); err == nil || err.Error() != "unknown config layer unknown" {
+		t.Errorf("expected an unknown layer to fail, but got %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// ErrTemplateRender indicates a templated InjectionConfig could not be rendered for a pod
+	ErrTemplateRender = fmt.Errorf("unable to render injection config template")
+
+	// templateFuncs are the only functions available to templates, besides the text/template builtins.
+	// "call" is overridden so templates can never invoke functions other than these.
+	templateFuncs = template.FuncMap{
+		"call": func(...interface{}) (string, error) {
+			return "", fmt.Errorf("call is not allowed in injection config templates")
+		},
+		"default": func(def, value string) string {
+			if value == "" {
+				return def
+			}
+			return value
+		},
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	}
+)
+
+// TemplateContext is the data templated fields of an InjectionConfig are rendered with. ObjectMeta is
+// embedded, so templates can refer to i.e. {{ .Name }}, {{ .Namespace }} or {{ index .Labels "app" }}.
+type TemplateContext struct {
+	metav1.ObjectMeta
+	Spec corev1.PodSpec
+}
+
+// Render returns a copy of this InjectionConfig with its templated fields rendered for the given pod.
+// Only configs with Template set are rendered; others are returned as is. Templated fields are container
+// args, environment variable values, volume mount paths, hostPath volume paths and label and annotation values.
+func (c *InjectionConfig) Render(pod *corev1.Pod) (*InjectionConfig, error) {
+	if !c.Template {
+		return c, nil
+	}
+
+	rendered := c.DeepCopy()
+	ctx := TemplateContext{
+		ObjectMeta: pod.ObjectMeta,
+		Spec:       pod.Spec,
+	}
+	err := rendered.visitTemplatedFields(func(field string, value *string) error {
+		out, err := renderTemplate(field, *value, ctx)
+		if err != nil {
+			return err
+		}
+		*value = out
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %s", ErrTemplateRender, c.FullName(), err.Error())
+	}
+	return rendered, nil
+}
+
+// validateTemplates makes sure all templated fields parse, so broken templates are found when
+// the config is loaded rather than when a pod is admitted
+func (c *InjectionConfig) validateTemplates() error {
+	if !c.Template {
+		return nil
+	}
+	return c.visitTemplatedFields(func(field string, value *string) error {
+		_, err := parseTemplate(field, *value)
+		return err
+	})
+}
+
+// visitTemplatedFields calls fn for each templated field, identified by its path in the config
+func (c *InjectionConfig) visitTemplatedFields(fn func(field string, value *string) error) error {
+	visitContainers := func(field string, containers []corev1.Container) error {
+		for i := range containers {
+			ctr := &containers[i]
+			for j := range ctr.Args {
+				if err := fn(fmt.Sprintf("%s[%s].args[%d]", field, ctr.Name, j), &ctr.Args[j]); err != nil {
+					return err
+				}
+			}
+			if err := visitEnv(fmt.Sprintf("%s[%s].env", field, ctr.Name), ctr.Env, fn); err != nil {
+				return err
+			}
+			if err := visitVolumeMounts(fmt.Sprintf("%s[%s].volumeMounts", field, ctr.Name), ctr.VolumeMounts, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := visitContainers("containers", c.Containers); err != nil {
+		return err
+	}
+	if err := visitContainers("initContainers", c.InitContainers); err != nil {
+		return err
+	}
+	if err := visitEnv("env", c.Environment, fn); err != nil {
+		return err
+	}
+	if err := visitVolumeMounts("volumeMounts", c.VolumeMounts, fn); err != nil {
+		return err
+	}
+	if err := visitStringMap("labels", c.Labels, fn); err != nil {
+		return err
+	}
+	if err := visitStringMap("annotations", c.Annotations, fn); err != nil {
+		return err
+	}
+	for i := range c.Volumes {
+		if c.Volumes[i].HostPath != nil {
+			if err := fn(fmt.Sprintf("volumes[%s].hostPath.path", c.Volumes[i].Name), &c.Volumes[i].HostPath.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func visitEnv(field string, env []corev1.EnvVar, fn func(string, *string) error) error {
+	for i := range env {
+		if err := fn(fmt.Sprintf("%s[%s].value", field, env[i].Name), &env[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func visitStringMap(field string, m map[string]string, fn func(string, *string) error) error {
+	for _, k := range SortedKeys(m) {
+		v := m[k]
+		if err := fn(fmt.Sprintf("%s[%s]", field, k), &v); err != nil {
+			return err
+		}
+		m[k] = v
+	}
+	return nil
+}
+
+func visitVolumeMounts(field string, mounts []corev1.VolumeMount, fn func(string, *string) error) error {
+	for i := range mounts {
+		if err := fn(fmt.Sprintf("%s[%s].mountPath", field, mounts[i].Name), &mounts[i].MountPath); err != nil {
+			return err
+		}
+		if err := fn(fmt.Sprintf("%s[%s].subPath", field, mounts[i].Name), &mounts[i].SubPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseTemplate(field, text string) (*template.Template, error) {
+	// missing map keys render as empty strings instead of "<no value>", so output only depends on the pod
+	// errors from text/template are prefixed with the template name, so they point at the field
+	return template.New(field).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+func renderTemplate(field, text string, ctx TemplateContext) (string, error) {
+	// skip the template machinery for the (common) case of a field without any actions
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	t, err := parseTemplate(field, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, ctx); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
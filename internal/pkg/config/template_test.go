@@ -0,0 +1,110 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	templatePod = corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "storefront-abc123",
+			Namespace: "shop",
+			Labels:    map[string]string{"app": "storefront"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}, {Name: "cache"}},
+		},
+	}
+)
+
+func TestRenderTemplatedConfig(t *testing.T) {
+	ic, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/templated.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := ic.Render(&templatePod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectations := map[string]string{
+		"env LOG_TAG":                    rendered.Environment[0].Value,
+		"container args[0]":              rendered.Containers[0].Args[0],
+		"container args[1]":              rendered.Containers[0].Args[1],
+		"volumeMount mountPath":          rendered.VolumeMounts[0].MountPath,
+		"volume hostPath":                rendered.Volumes[0].HostPath.Path,
+		"annotation logs.tumblr.com/tag": rendered.Annotations["logs.tumblr.com/tag"],
+		"untemplated container image":    rendered.Containers[0].Image,
+		"untemplated env name LOG_TAG":   rendered.Environment[0].Name,
+	}
+	expected := map[string]string{
+		"env LOG_TAG":                    "shop.storefront",
+		"container args[0]":              "--tag=shop/storefront",
+		"container args[1]":              "--containers=2",
+		"volumeMount mountPath":          "/var/log/shop",
+		"volume hostPath":                "/var/log/pods/shop",
+		"annotation logs.tumblr.com/tag": "shop.storefront",
+		"untemplated container image":    "log-shipper:1.0",
+		"untemplated env name LOG_TAG":   "LOG_TAG",
+	}
+	for k, v := range expected {
+		if expectations[k] != v {
+			t.Errorf("expected %s to render as %q but got %q", k, v, expectations[k])
+		}
+	}
+
+	// the loaded config must not be touched, it is shared between requests
+	if ic.Environment[0].Value != `{{ .Namespace }}.{{ index .Labels "app" | default "unknown" }}` {
+		t.Errorf("rendering mutated the original config: %s", ic.Environment[0].Value)
+	}
+
+	// missing labels render as empty strings, so default kicks in
+	unlabelled := templatePod.DeepCopy()
+	unlabelled.Labels = nil
+	rendered, err = ic.Render(unlabelled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.Environment[0].Value != "shop.unknown" {
+		t.Errorf("expected LOG_TAG to render as shop.unknown but got %s", rendered.Environment[0].Value)
+	}
+}
+
+func TestRenderUntemplatedConfig(t *testing.T) {
+	ic, err := LoadInjectionConfigFromFilePath(fixtureSidecarsDir + "/sidecar-test.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := ic.Render(&templatePod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered != ic {
+		t.Fatal("expected a config without template: true to be returned as is")
+	}
+}
+
+func TestRenderTemplateErrors(t *testing.T) {
+	ic, err := LoadInjectionConfig(strings.NewReader(`
+name: sneaky
+template: true
+env:
+  - name: SNEAKY
+    value: '{{ call .Spec }}'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ic.Render(&templatePod)
+	if !errors.Is(err, ErrTemplateRender) {
+		t.Fatalf("expected ErrTemplateRender, but got %v", err)
+	}
+	if !strings.Contains(err.Error(), "call is not allowed") {
+		t.Fatalf("expected call to be refused, but got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var (
+	// ErrInvalidInjectionConfig is wrapped by the errors of configs that fail Validate
+	ErrInvalidInjectionConfig = fmt.Errorf("invalid injection config")
+)
+
+// patchDirective is the key of strategic merge patch directives, like `$patch: delete`
+const patchDirective = "$patch"
+
+// Validate returns what is wrong with c, that would otherwise only surface when injecting pods: invalid or
+// duplicate container, volume, port and env var names, containers without an image, containers listening on
+// the same port, volume mounts without a mount path, and volume mounts of volumes c neither defines nor lists
+// in PodVolumes.
+//
+// A config that inherits a config it was not merged with yet (see ResolveInheritance) is partial: volume
+// mounts may refer to inherited volumes, and containers merged strategically only hold what they change, or
+// a `$patch` directive. These are checked once the config is resolved.
+func (c *InjectionConfig) Validate() field.ErrorList {
+	partial := c.Inherits != "" && !c.resolved
+	errs := field.ErrorList{}
+
+	volumes := map[string]bool{}
+	for i, v := range c.Volumes {
+		path := field.NewPath("volumes").Index(i).Child("name")
+		errs = append(errs, validateDNS1123Label(v.Name, path)...)
+		if volumes[v.Name] {
+			errs = append(errs, field.Duplicate(path, v.Name))
+		}
+		volumes[v.Name] = true
+	}
+	for i, name := range c.PodVolumes {
+		errs = append(errs, validateDNS1123Label(name, field.NewPath("podVolumes").Index(i))...)
+		volumes[name] = true
+	}
+
+	v := containerValidator{
+		config:    c,
+		partial:   partial,
+		volumes:   volumes,
+		ports:     map[string]*field.Path{},
+		strategic: c.ContainerMergeStrategy == ContainerMergeStrategyStrategic,
+	}
+	// once merged, the containers no longer line up with the ones written in the config
+	raw := c.rawContainers
+	if c.Inherits != "" && !partial {
+		raw = nil
+	}
+	errs = append(errs, v.validate(field.NewPath("containers"), c.Containers, rawContainerEntries(raw, false))...)
+	errs = append(errs, v.validate(field.NewPath("initContainers"), c.InitContainers, rawContainerEntries(raw, true))...)
+
+	// env and volume mounts at the top level are added to the containers of the pod, whose volumes we cannot know
+	errs = append(errs, validateEnv(c.Environment, field.NewPath("env"))...)
+	for i, vm := range c.VolumeMounts {
+		path := field.NewPath("volumeMounts").Index(i)
+		errs = append(errs, validateDNS1123Label(vm.Name, path.Child("name"))...)
+		if vm.MountPath == "" && effectivePolicy(c.VolumeMountPolicy) != PolicyRemove {
+			errs = append(errs, field.Required(path.Child("mountPath"), ""))
+		}
+	}
+	return errs
+}
+
+// ValidationError holds the errors of Validate for the config named Config. It wraps ErrInvalidInjectionConfig.
+type ValidationError struct {
+	Config string
+	Errors field.ErrorList
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s %s: %s", ErrInvalidInjectionConfig.Error(), e.Config, e.Errors.ToAggregate().Error())
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidInjectionConfig
+}
+
+// validate returns a ValidationError with the errors of Validate, if any
+func (c *InjectionConfig) validate() error {
+	if errs := c.Validate(); len(errs) > 0 {
+		return &ValidationError{Config: c.FullName(), Errors: errs}
+	}
+	return nil
+}
+
+// containerValidator validates the containers and init containers of a config, across both lists
+type containerValidator struct {
+	config  *InjectionConfig
+	partial bool
+	// volumes are the volumes containers may mount: the ones of the config, and the PodVolumes
+	volumes map[string]bool
+	// ports are the ports containers listen on so far, by port number and protocol
+	ports     map[string]*field.Path
+	strategic bool
+}
+
+func (v *containerValidator) validate(basePath *field.Path, containers []corev1.Container, raw []map[string]interface{}) field.ErrorList {
+	errs := field.ErrorList{}
+	// names are unique within containers, and within init containers
+	names := map[string]bool{}
+	for i, ctr := range containers {
+		path := basePath.Index(i)
+		errs = append(errs, validateDNS1123Label(ctr.Name, path.Child("name"))...)
+		if names[ctr.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), ctr.Name))
+		}
+		names[ctr.Name] = true
+
+		// the fields of a strategically merged container are only complete once merged
+		if v.strategic && i < len(raw) {
+			if directive, ok := raw[i][patchDirective]; ok {
+				if !v.partial {
+					errs = append(errs, field.Forbidden(path.Child(patchDirective), fmt.Sprintf("%v applies to inherited containers, and %s inherits none", directive, v.config.FullName())))
+				}
+				continue
+			}
+			if v.partial {
+				continue
+			}
+		}
+
+		if ctr.Image == "" {
+			errs = append(errs, field.Required(path.Child("image"), ""))
+		}
+		errs = append(errs, validateEnv(ctr.Env, path.Child("env"))...)
+		errs = append(errs, v.validatePorts(ctr.Ports, path.Child("ports"), basePath.String() == "containers")...)
+		for j, vm := range ctr.VolumeMounts {
+			if !v.partial && !v.volumes[vm.Name] {
+				errs = append(errs, field.NotFound(path.Child("volumeMounts").Index(j).Child("name"), vm.Name))
+			}
+			if vm.MountPath == "" {
+				errs = append(errs, field.Required(path.Child("volumeMounts").Index(j).Child("mountPath"), ""))
+			}
+		}
+	}
+	return errs
+}
+
+// validatePorts validates the ports of a container. Containers of a pod share its network, so unless
+// they are init containers, which run one after the other, no two containers may listen on the same port.
+func (v *containerValidator) validatePorts(ports []corev1.ContainerPort, basePath *field.Path, shared bool) field.ErrorList {
+	errs := field.ErrorList{}
+	names := map[string]bool{}
+	for i, port := range ports {
+		path := basePath.Index(i)
+		if port.Name != "" {
+			for _, msg := range validation.IsValidPortName(port.Name) {
+				errs = append(errs, field.Invalid(path.Child("name"), port.Name, msg))
+			}
+			if names[port.Name] {
+				errs = append(errs, field.Duplicate(path.Child("name"), port.Name))
+			}
+			names[port.Name] = true
+		}
+		for _, msg := range validation.IsValidPortNum(int(port.ContainerPort)) {
+			errs = append(errs, field.Invalid(path.Child("containerPort"), port.ContainerPort, msg))
+		}
+		if !shared {
+			continue
+		}
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		key := fmt.Sprintf("%d/%s", port.ContainerPort, protocol)
+		if other, ok := v.ports[key]; ok {
+			errs = append(errs, field.Duplicate(path.Child("containerPort"), fmt.Sprintf("%s, also used by %s", key, other)))
+			continue
+		}
+		v.ports[key] = path
+	}
+	return errs
+}
+
+// rawContainerEntries returns the containers or init containers as written, or nil if they were not kept
+func rawContainerEntries(raw *rawContainers, initContainers bool) []map[string]interface{} {
+	if raw == nil {
+		return nil
+	}
+	messages := raw.Containers
+	if initContainers {
+		messages = raw.InitContainers
+	}
+	entries := make([]map[string]interface{}, len(messages))
+	for i, m := range messages {
+		// these were unmarshalled from the same yaml as the containers, so they cannot fail to unmarshal again
+		_ = json.Unmarshal(m, &entries[i])
+	}
+	return entries
+}
+
+func validateDNS1123Label(name string, path *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	for _, msg := range validation.IsDNS1123Label(name) {
+		errs = append(errs, field.Invalid(path, name, msg))
+	}
+	return errs
+}
+
+func validateEnv(env []corev1.EnvVar, basePath *field.Path) field.ErrorList {
+	errs := field.ErrorList{}
+	for i, e := range env {
+		for _, msg := range validation.IsEnvVarName(e.Name) {
+			errs = append(errs, field.Invalid(basePath.Index(i).Child("name"), e.Name, msg))
+		}
+	}
+	return errs
+}
@@ -1,11 +1,20 @@
 package watcher
 
+import (
+	"time"
+)
+
+// DefaultResyncPeriod is how often watchers replay their cache by default, triggering a reconciliation
+// even if nothing changed
+const DefaultResyncPeriod = 10 * time.Minute
+
 // Config is a configuration struct for the Watcher type
 type Config struct {
 	Namespace       string
 	ConfigMapLabels map[string]string
 	MasterURL       string
 	Kubeconfig      string
+	ResyncPeriod    time.Duration
 }
 
 // NewConfig returns a new initialized Config
@@ -15,5 +24,6 @@ func NewConfig() *Config {
 		ConfigMapLabels: map[string]string{},
 		MasterURL:       "",
 		Kubeconfig:      "",
+		ResyncPeriod:    DefaultResyncPeriod,
 	}
 }
@@ -0,0 +1,160 @@
+package watcher
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// EventReasonLoaded is the reason of Events recorded on ConfigMaps whose InjectionConfigs were loaded
+	EventReasonLoaded = "InjectionConfigsLoaded"
+	// EventReasonInvalid is the reason of Events recorded on ConfigMaps whose InjectionConfigs failed to load
+	EventReasonInvalid = "InvalidInjectionConfig"
+)
+
+var (
+	configMapLoadStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "configmap_load_status",
+			Help: "Whether the InjectionConfigs of a watched ConfigMap loaded (1) or failed to load (0)",
+		},
+		[]string{"namespace", "configmap"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(configMapLoadStatus)
+}
+
+// ConfigMapStatus describes the outcome of loading the InjectionConfigs of a watched ConfigMap
+type ConfigMapStatus struct {
+	Namespace       string `json:"namespace"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+	Loaded          bool   `json:"loaded"`
+	Error           string `json:"error,omitempty"`
+	// InjectionConfigs are the full names of the InjectionConfigs served from this ConfigMap. If the ConfigMap
+	// failed to load, these are the last-known-good InjectionConfigs.
+	InjectionConfigs []string `json:"injectionConfigs"`
+	// LastKnownGoodResourceVersion is the version of the ConfigMap the InjectionConfigs are served from, if
+	// the current version failed to load
+	LastKnownGoodResourceVersion string `json:"lastKnownGoodResourceVersion,omitempty"`
+	// LastTransitionTime is when the ResourceVersion or outcome last changed
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+	// InheritanceErrors are the errors resolving the inheritance of InjectionConfigs, keyed by their full name.
+	// These InjectionConfigs are not served.
+	InheritanceErrors map[string]string `json:"inheritanceErrors,omitempty"`
+}
+
+// configMapState is what we remember about a watched ConfigMap across reconciliations
+type configMapState struct {
+	status               ConfigMapStatus
+	lastKnownGood        []*config.InjectionConfig
+	lastKnownGoodVersion string
+}
+
+// load parses the InjectionConfigs of cm, and records the outcome. If cm fails to load, the InjectionConfigs
+// of the last version that loaded are returned instead, so one broken ConfigMap does not hold back the rest.
+func (c *K8sConfigMapWatcher) load(cm *corev1.ConfigMap) []*config.InjectionConfig {
+	ics, err := InjectionConfigsFromConfigMap(*cm)
+
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	state, seen := c.configMaps[cm.Name]
+	if !seen {
+		state = &configMapState{}
+		c.configMaps[cm.Name] = state
+	}
+	previous := state.status
+
+	status := ConfigMapStatus{
+		Namespace:       cm.Namespace,
+		Name:            cm.Name,
+		ResourceVersion: cm.ResourceVersion,
+		Loaded:          err == nil,
+	}
+	if err == nil {
+		state.lastKnownGood = ics
+		state.lastKnownGoodVersion = cm.ResourceVersion
+		glog.V(1).Infof("Found %d InjectionConfigs in %s", len(ics), cm.Name)
+	} else {
+		status.Error = err.Error()
+		if state.lastKnownGood != nil {
+			status.LastKnownGoodResourceVersion = state.lastKnownGoodVersion
+		}
+		glog.Errorf("Error loading ConfigMap %s/%s (serving %d last-known-good InjectionConfigs): %s", cm.Namespace, cm.Name, len(state.lastKnownGood), err.Error())
+	}
+	status.InjectionConfigs = make([]string, len(state.lastKnownGood))
+	for i, ic := range state.lastKnownGood {
+		status.InjectionConfigs[i] = ic.FullName()
+	}
+	sort.Strings(status.InjectionConfigs)
+
+	// resyncs reconcile unchanged ConfigMaps over and over; only report what changed
+	if !seen || previous.ResourceVersion != status.ResourceVersion || previous.Loaded != status.Loaded {
+		status.LastTransitionTime = time.Now()
+		if err == nil {
+			c.recorder.Eventf(cm, corev1.EventTypeNormal, EventReasonLoaded, "Loaded InjectionConfigs %v", status.InjectionConfigs)
+		} else {
+			c.recorder.Eventf(cm, corev1.EventTypeWarning, EventReasonInvalid, "Failed to load InjectionConfigs, serving last-known-good %v: %s", status.InjectionConfigs, err.Error())
+		}
+	} else {
+		status.LastTransitionTime = previous.LastTransitionTime
+	}
+	state.status = status
+
+	if err == nil {
+		configMapLoadStatus.WithLabelValues(cm.Namespace, cm.Name).Set(1)
+	} else {
+		configMapLoadStatus.WithLabelValues(cm.Namespace, cm.Name).Set(0)
+	}
+	return state.lastKnownGood
+}
+
+// forget drops everything we remember about ConfigMaps that are no longer watched
+func (c *K8sConfigMapWatcher) forget(watched map[string]bool) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	for name, state := range c.configMaps {
+		if !watched[name] {
+			glog.V(2).Infof("ConfigMap %s/%s is gone, forgetting its InjectionConfigs", state.status.Namespace, name)
+			configMapLoadStatus.DeleteLabelValues(state.status.Namespace, name)
+			delete(c.configMaps, name)
+		}
+	}
+}
+
+// SetInheritanceErrors records the errors resolving the inheritance of InjectionConfigs, keyed by FullName
+// (see config.ResolveInheritance), to be reported by ConfigMapStatuses
+func (c *K8sConfigMapWatcher) SetInheritanceErrors(errs map[string]error) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.inheritanceErrors = errs
+}
+
+// ConfigMapStatuses returns the load status of each watched ConfigMap, as of the last reconciliation
+func (c *K8sConfigMapWatcher) ConfigMapStatuses() []ConfigMapStatus {
+	c.statusLock.RLock()
+	defer c.statusLock.RUnlock()
+	statuses := make([]ConfigMapStatus, 0, len(c.configMaps))
+	for _, state := range c.configMaps {
+		status := state.status
+		status.InjectionConfigs = append([]string{}, status.InjectionConfigs...)
+		for _, name := range status.InjectionConfigs {
+			if err, ok := c.inheritanceErrors[name]; ok {
+				if status.InheritanceErrors == nil {
+					status.InheritanceErrors = map[string]string{}
+				}
+				status.InheritanceErrors[name] = err.Error()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
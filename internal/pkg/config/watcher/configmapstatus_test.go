@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// drainEvents returns the events recorded so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestGetKeepsLastKnownGood(t *testing.T) {
+	w, err := newConfigMapWatcher(testConfig, fake.NewSimpleClientset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	w.recorder = recorder
+	// drive the cache directly, instead of running the informer
+	store := w.informer.GetStore()
+	ctx := context.Background()
+
+	good := testConfigMap("team-a", testConfig.ConfigMapLabels, map[string]string{"env": "name: env1"})
+	good.ResourceVersion = "1"
+	other := testConfigMap("team-b", testConfig.ConfigMapLabels, map[string]string{"env": "name: env2"})
+	other.ResourceVersion = "1"
+	store.Add(good)
+	store.Add(other)
+	ics, err := w.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ics) != 2 {
+		t.Fatalf("expected 2 InjectionConfigs, but got %v", ics)
+	}
+	if events := drainEvents(recorder); len(events) != 2 || !strings.HasPrefix(events[0], "Normal "+EventReasonLoaded) {
+		t.Fatalf("expected a %s event per ConfigMap, but got %v", EventReasonLoaded, events)
+	}
+
+	// break team-a; team-b must be unaffected, and team-a must keep serving env1
+	broken := testConfigMap("team-a", testConfig.ConfigMapLabels, map[string]string{"env": "name: not:a:valid:name"})
+	broken.ResourceVersion = "2"
+	store.Update(broken)
+	ics, err = w.Get(ctx)
+	if err != nil {
+		t.Fatalf("expected a broken ConfigMap not to fail Get, but got %s", err)
+	}
+	names := []string{}
+	for _, ic := range ics {
+		names = append(names, ic.FullName())
+	}
+	if strings.Join(names, ",") != "env1:latest,env2:latest" {
+		t.Fatalf("expected the last-known-good env1:latest and env2:latest, but got %v", names)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+EventReasonInvalid) {
+		t.Fatalf("expected a %s event for the broken ConfigMap, but got %v", EventReasonInvalid, events)
+	}
+
+	statuses := w.ConfigMapStatuses()
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 ConfigMap statuses, but got %v", statuses)
+	}
+	a := statuses[0]
+	if a.Name != "team-a" || a.Loaded || a.Error == "" || a.ResourceVersion != "2" || a.LastKnownGoodResourceVersion != "1" || strings.Join(a.InjectionConfigs, ",") != "env1:latest" {
+		t.Errorf("unexpected status for the broken ConfigMap: %+v", a)
+	}
+	b := statuses[1]
+	if b.Name != "team-b" || !b.Loaded || b.Error != "" || b.LastKnownGoodResourceVersion != "" || strings.Join(b.InjectionConfigs, ",") != "env2:latest" {
+		t.Errorf("unexpected status for the healthy ConfigMap: %+v", b)
+	}
+
+	w.SetInheritanceErrors(map[string]error{"env2:latest": errors.New("inherited injection config not found")})
+	if statuses := w.ConfigMapStatuses(); statuses[1].InheritanceErrors["env2:latest"] != "inherited injection config not found" || statuses[0].InheritanceErrors != nil {
+		t.Errorf("expected the inheritance error of env2:latest to be reported on team-b only, but got %+v", statuses)
+	}
+
+	// resyncs of unchanged ConfigMaps must not record events again
+	if _, err := w.Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events when nothing changed, but got %v", events)
+	}
+
+	// deleted ConfigMaps are forgotten
+	store.Delete(broken)
+	ics, err = w.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ics) != 1 || ics[0].FullName() != "env2:latest" {
+		t.Fatalf("expected only env2:latest after deleting team-a, but got %v", ics)
+	}
+	if statuses := w.ConfigMapStatuses(); len(statuses) != 1 || statuses[0].Name != "team-b" {
+		t.Errorf("expected only the status of team-b after deleting team-a, but got %v", statuses)
+	}
+}
+
+func TestGetBrokenWithoutLastKnownGood(t *testing.T) {
+	w, err := newConfigMapWatcher(testConfig, fake.NewSimpleClientset())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.recorder = record.NewFakeRecorder(10)
+	w.informer.GetStore().Add(testConfigMap("broken", testConfig.ConfigMapLabels, map[string]string{"env": "name: not:a:valid:name"}))
+
+	ics, err := w.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ics) != 0 {
+		t.Fatalf("expected no InjectionConfigs, but got %v", ics)
+	}
+	statuses := w.ConfigMapStatuses()
+	if len(statuses) != 1 || statuses[0].Loaded || len(statuses[0].InjectionConfigs) != 0 || statuses[0].LastKnownGoodResourceVersion != "" {
+		t.Errorf("unexpected status for a ConfigMap that never loaded: %+v", statuses)
+	}
+}
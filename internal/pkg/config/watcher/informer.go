@@ -0,0 +1,43 @@
+package watcher
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/tools/cache"
+)
+
+// runInformer registers a handler signalling notifyMe on every event of informer, and runs informer until
+// ctx is done. Resyncs are delivered as updates, so they trigger a reconciliation too. A nil notifyMe is never
+// signalled, for informers that only serve as a cache.
+func runInformer(ctx context.Context, kind string, informer cache.SharedIndexInformer, notifyMe chan<- interface{}) error {
+	if notifyMe == nil {
+		return runCache(ctx, kind, informer)
+	}
+	notify := func(event string, obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			key = "<unknown>"
+		}
+		// signal reconciliation of all InjectionConfigs
+		glog.V(3).Infof("signalling %s event received for %s %s", event, kind, key)
+		notifyMe <- struct{}{}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { notify("add", obj) },
+		UpdateFunc: func(_, obj interface{}) { notify("update", obj) },
+		DeleteFunc: func(obj interface{}) { notify("delete", obj) },
+	})
+	return runCache(ctx, kind, informer)
+}
+
+// runCache runs informer until ctx is done
+func runCache(ctx context.Context, kind string, informer cache.SharedIndexInformer) error {
+	go informer.Run(ctx.Done())
+	if cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		glog.V(2).Infof("%s cache synced", kind)
+	}
+	<-ctx.Done()
+	glog.V(2).Infof("stopping %s watcher, context indicated we are done", kind)
+	return nil
+}
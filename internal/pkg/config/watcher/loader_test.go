@@ -179,6 +179,11 @@ func TestLoadFromConfigMap(t *testing.T) {
 		if strings.Join(expectedNames, ",") != strings.Join(actualNames, ",") {
 			t.Fatalf("expected InjectionConfigs loaded with names %v but got %v", expectedNames, actualNames)
 		}
+		for _, x := range ics {
+			if !strings.HasPrefix(x.Source(), fmt.Sprintf("ConfigMap %s/%s data[", cm.Namespace, cm.Name)) {
+				t.Errorf("expected %s to be loaded from ConfigMap %s/%s, but got source %q", x.FullName(), cm.Namespace, cm.Name, x.Source())
+			}
+		}
 
 		for _, expectedICF := range expectedFixtures {
 			expectedicFile := expectedICF.Path
@@ -0,0 +1,75 @@
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8sv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NamespaceCache caches the Namespaces of the cluster with an informer, so looking up their labels for
+// admission requests never hits the apiserver
+type NamespaceCache struct {
+	informer cache.SharedIndexInformer
+	lister   corelisters.NamespaceLister
+}
+
+// NamespaceCache returns a NamespaceCache sharing this watcher's k8s client and resync period. It is empty until
+// Watch is running.
+func (c *K8sConfigMapWatcher) NamespaceCache() *NamespaceCache {
+	return NewNamespaceCache(c.client, c.ResyncPeriod)
+}
+
+// NewNamespaceCache returns a NamespaceCache of the Namespaces of client. It is empty until Watch is running.
+func NewNamespaceCache(client k8sv1.NamespacesGetter, resyncPeriod time.Duration) *NamespaceCache {
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return client.Namespaces().List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return client.Namespaces().Watch(context.TODO(), options)
+		},
+	}, &v1.Namespace{}, resyncPeriod, cache.Indexers{})
+	return &NamespaceCache{
+		informer: informer,
+		lister:   corelisters.NewNamespaceLister(informer.GetIndexer()),
+	}
+}
+
+// Watch runs the informer caching Namespaces. Watch only returns once ctx is done, and must only be called once.
+func (n *NamespaceCache) Watch(ctx context.Context) error {
+	glog.V(3).Infof("Watching Namespaces")
+	return runInformer(ctx, "Namespace", n.informer, nil)
+}
+
+// HasSynced returns true once the cache holds all Namespaces
+func (n *NamespaceCache) HasSynced() bool {
+	return n.informer.HasSynced()
+}
+
+// WaitForSync blocks until the cache holds all Namespaces, and returns false if ctx is done first. Until then,
+// NamespaceLabels fails, so the opt-out label of namespaces is not honored.
+func (n *NamespaceCache) WaitForSync(ctx context.Context) bool {
+	return cache.WaitForCacheSync(ctx.Done(), n.HasSynced)
+}
+
+// NamespaceLabels returns the labels of the named Namespace, as cached. It fails until the cache has synced, and
+// for Namespaces that are not cached.
+func (n *NamespaceCache) NamespaceLabels(namespace string) (map[string]string, error) {
+	if !n.HasSynced() {
+		return nil, fmt.Errorf("namespaces are not cached yet")
+	}
+	ns, err := n.lister.Get(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Labels, nil
+}
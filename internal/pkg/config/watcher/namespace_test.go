@@ -0,0 +1,68 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNamespaceCache(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "team-a",
+			Labels: map[string]string{"team": "a"},
+		},
+	})
+	namespaces := NewNamespaceCache(client.CoreV1(), 0)
+
+	if _, err := namespaces.NamespaceLabels("team-a"); err == nil {
+		t.Fatal("expected an error looking up a Namespace before the cache synced")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go namespaces.Watch(ctx)
+	if !namespaces.WaitForSync(ctx) {
+		t.Fatal("timed out waiting for the Namespace cache to sync")
+	}
+
+	// lookups are served from the cache, even for missing Namespaces
+	client.ClearActions()
+	l, err := namespaces.NamespaceLabels("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l["team"] != "a" {
+		t.Fatalf("expected label team=a but got %v", l)
+	}
+	if _, err := namespaces.NamespaceLabels("missing"); err == nil {
+		t.Fatal("expected an error looking up a missing Namespace")
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Fatalf("expected lookups not to call the api but got %v", actions)
+	}
+
+	// changes in the api are picked up by the informer
+	ns, err := client.CoreV1().Namespaces().Get(ctx, "team-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Labels["team"] = "b"
+	if _, err := client.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for l["team"] != "b" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected updated label team=b but got %v", l)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if l, err = namespaces.NamespaceLabels("team-a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
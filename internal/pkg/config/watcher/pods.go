@@ -0,0 +1,72 @@
+package watcher
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// K8sPodWatcher caches the pods of all namespaces, so the pods that were injected can be listed without
+// hitting the apiserver. ReplicaSets are cached too, to find the Deployment owning a pod.
+type K8sPodWatcher struct {
+	corelisters.PodLister
+	// ReplicaSets lists the cached ReplicaSets of all namespaces
+	ReplicaSets appslisters.ReplicaSetLister
+	// Recorder records Events about the workloads owning the pods
+	Recorder record.EventRecorder
+
+	informer           cache.SharedIndexInformer
+	replicaSetInformer cache.SharedIndexInformer
+}
+
+// NewPodWatcher creates a new K8sPodWatcher. Only the connection settings and resync period of cfg are
+// used; pods are watched in all namespaces.
+func NewPodWatcher(cfg Config) (*K8sPodWatcher, error) {
+	k8sConfig, err := cfg.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := newPodWatcher(cfg, clientset)
+	glog.V(2).Infof("Created Pod watcher: apiserver=%s resync=%s", k8sConfig.Host, cfg.ResyncPeriod)
+	return c, nil
+}
+
+func newPodWatcher(cfg Config, clientset kubernetes.Interface) *K8sPodWatcher {
+	factory := informers.NewSharedInformerFactory(clientset, cfg.ResyncPeriod)
+	pods := factory.Core().V1().Pods()
+	replicaSets := factory.Apps().V1().ReplicaSets()
+	return &K8sPodWatcher{
+		PodLister:          pods.Lister(),
+		ReplicaSets:        replicaSets.Lister(),
+		Recorder:           newEventRecorder(clientset.CoreV1()),
+		informer:           pods.Informer(),
+		replicaSetInformer: replicaSets.Informer(),
+	}
+}
+
+// Watch runs the informers caching pods and ReplicaSets. Watch only returns once ctx is done, and must only be
+// called once.
+func (c *K8sPodWatcher) Watch(ctx context.Context) error {
+	glog.V(3).Infof("Watching Pods and ReplicaSets in all namespaces")
+	go func() {
+		if err := runInformer(ctx, "ReplicaSet", c.replicaSetInformer, nil); err != nil {
+			glog.Errorf("error watching ReplicaSets: %s", err.Error())
+		}
+	}()
+	return runInformer(ctx, "Pod", c.informer, nil)
+}
+
+// HasSynced returns true once the cache holds all pods and ReplicaSets
+func (c *K8sPodWatcher) HasSynced() bool {
+	return c.informer.HasSynced() && c.replicaSetInformer.HasSynced()
+}
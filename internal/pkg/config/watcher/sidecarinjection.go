@@ -0,0 +1,232 @@
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// SidecarInjectionPhaseLoaded indicates the SidecarInjection was loaded as an InjectionConfig
+	SidecarInjectionPhaseLoaded = "Loaded"
+	// SidecarInjectionPhaseInvalid indicates the SidecarInjection spec is not a valid InjectionConfig
+	SidecarInjectionPhaseInvalid = "Invalid"
+	// SidecarInjectionPhaseInheritanceError indicates the InjectionConfig could not inherit from its parent
+	SidecarInjectionPhaseInheritanceError = "InheritanceError"
+)
+
+var (
+	// SidecarInjectionGVR identifies the SidecarInjection custom resource
+	SidecarInjectionGVR = schema.GroupVersionResource{
+		Group:    "injector.tumblr.com",
+		Version:  "v1alpha1",
+		Resource: "sidecarinjections",
+	}
+)
+
+// SidecarInjectionStatus is the status subresource of a SidecarInjection
+type SidecarInjectionStatus struct {
+	// Phase is one of Loaded, Invalid or InheritanceError
+	Phase string `json:"phase"`
+	// Message describes why the SidecarInjection was not loaded
+	Message string `json:"message,omitempty"`
+	// InjectionConfig is the full name of the loaded InjectionConfig, as requested by pods
+	InjectionConfig string `json:"injectionConfig,omitempty"`
+	// ObservedGeneration is the generation of the spec this status describes
+	ObservedGeneration int64 `json:"observedGeneration"`
+}
+
+// K8sSidecarInjectionWatcher is a struct that connects to the API and collects, parses, and emits sidecar
+// configurations from SidecarInjection custom resources
+type K8sSidecarInjectionWatcher struct {
+	Config
+	client   dynamic.Interface
+	informer cache.SharedIndexInformer
+	lister   cache.GenericNamespaceLister
+
+	// pending holds the statuses determined by the last Get, until UpdateStatuses writes them
+	pending []pendingSidecarInjectionStatus
+}
+
+type pendingSidecarInjectionStatus struct {
+	si     *unstructured.Unstructured
+	status SidecarInjectionStatus
+}
+
+// NewSidecarInjectionWatcher creates a new K8sSidecarInjectionWatcher
+func NewSidecarInjectionWatcher(cfg Config) (*K8sSidecarInjectionWatcher, error) {
+	if err := cfg.inferNamespace(); err != nil {
+		return nil, err
+	}
+	k8sConfig, err := cfg.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newSidecarInjectionWatcher(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Created SidecarInjection watcher: apiserver=%s namespace=%s resync=%s", k8sConfig.Host, c.Namespace, c.ResyncPeriod)
+	return c, nil
+}
+
+// newSidecarInjectionWatcher creates a K8sSidecarInjectionWatcher using the given client, whose informer
+// caches SidecarInjections in the watched namespace
+func newSidecarInjectionWatcher(cfg Config, client dynamic.Interface) (*K8sSidecarInjectionWatcher, error) {
+	if cfg.Namespace == "" {
+		return nil, fmt.Errorf("validation failed for K8sSidecarInjectionWatcher: namespace is empty")
+	}
+	c := K8sSidecarInjectionWatcher{
+		Config: cfg,
+		client: client,
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, c.ResyncPeriod, c.Namespace, nil)
+	sidecarInjections := factory.ForResource(SidecarInjectionGVR)
+	c.informer = sidecarInjections.Informer()
+	c.lister = sidecarInjections.Lister().ByNamespace(c.Namespace)
+	return &c, nil
+}
+
+func (c *K8sSidecarInjectionWatcher) resource() dynamic.ResourceInterface {
+	return c.client.Resource(SidecarInjectionGVR).Namespace(c.Namespace)
+}
+
+// Watch runs the informer caching SidecarInjections, and signals notifyMe whenever one is added, updated
+// or deleted, as well as on every resync. Watch only returns once ctx is done, and must only be called once.
+func (c *K8sSidecarInjectionWatcher) Watch(ctx context.Context, notifyMe chan<- interface{}) error {
+	glog.V(3).Infof("Watching for SidecarInjections for changes on namespace=%s", c.Namespace)
+	return runInformer(ctx, "SidecarInjection", c.informer, notifyMe)
+}
+
+// Get returns the InjectionConfigs of all cached SidecarInjections that parsed successfully. Their
+// inheritance is not resolved yet; once it is, UpdateStatuses must be called to report the outcome in the
+// status of each SidecarInjection.
+func (c *K8sSidecarInjectionWatcher) Get(ctx context.Context) (cfgs []*config.InjectionConfig, err error) {
+	glog.V(1).Infof("Fetching SidecarInjections from cache...")
+	objs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return cfgs, err
+	}
+	sis := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		si, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return cfgs, fmt.Errorf("unexpected object %T in SidecarInjection cache", obj)
+		}
+		sis = append(sis, si)
+	}
+	// the cache is unordered; keep reconciliation deterministic
+	sort.Slice(sis, func(i, j int) bool { return sis[i].GetName() < sis[j].GetName() })
+	glog.V(1).Infof("Fetched %d SidecarInjections", len(sis))
+
+	c.pending = make([]pendingSidecarInjectionStatus, 0, len(sis))
+	for _, si := range sis {
+		status := SidecarInjectionStatus{
+			Phase:              SidecarInjectionPhaseLoaded,
+			ObservedGeneration: si.GetGeneration(),
+		}
+		ic, err := InjectionConfigFromSidecarInjection(si)
+		if err != nil {
+			glog.Errorf("Error loading SidecarInjection %s/%s: %s", si.GetNamespace(), si.GetName(), err.Error())
+			status.Phase = SidecarInjectionPhaseInvalid
+			status.Message = err.Error()
+		} else {
+			status.InjectionConfig = ic.FullName()
+			glog.V(2).Infof("Loaded InjectionConfig %s from SidecarInjection %s/%s", ic.FullName(), si.GetNamespace(), si.GetName())
+			cfgs = append(cfgs, ic)
+		}
+		c.pending = append(c.pending, pendingSidecarInjectionStatus{si: si, status: status})
+	}
+	return cfgs, nil
+}
+
+// UpdateStatuses writes the status of each SidecarInjection seen by the last Get. inheritanceErrors are
+// the errors resolving the inheritance of InjectionConfigs, keyed by FullName (see
+// config.ResolveInheritance); SidecarInjections whose config failed to resolve are reported as such.
+func (c *K8sSidecarInjectionWatcher) UpdateStatuses(ctx context.Context, inheritanceErrors map[string]error) {
+	for _, p := range c.pending {
+		status := p.status
+		if err, ok := inheritanceErrors[status.InjectionConfig]; ok && status.Phase == SidecarInjectionPhaseLoaded {
+			status.Phase = SidecarInjectionPhaseInheritanceError
+			status.Message = err.Error()
+		}
+		if err := c.updateStatus(ctx, p.si, status); err != nil {
+			// a stale status is no reason to not load the configs
+			glog.Errorf("Error updating status of SidecarInjection %s/%s: %s", p.si.GetNamespace(), p.si.GetName(), err.Error())
+		}
+	}
+	c.pending = nil
+}
+
+// updateStatus writes status to the SidecarInjection, if it changed. Writing the status triggers another
+// watch event, so we must not write it when nothing changed, or we would reconcile forever.
+func (c *K8sSidecarInjectionWatcher) updateStatus(ctx context.Context, si *unstructured.Unstructured, status SidecarInjectionStatus) error {
+	currentMap, _, err := unstructured.NestedMap(si.Object, "status")
+	if err != nil {
+		return err
+	}
+	var current SidecarInjectionStatus
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(currentMap, &current); err != nil {
+		return err
+	}
+	if current == status {
+		return nil
+	}
+
+	statusMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return err
+	}
+	updated := si.DeepCopy()
+	if err := unstructured.SetNestedField(updated.Object, statusMap, "status"); err != nil {
+		return err
+	}
+	glog.V(2).Infof("Updating status of SidecarInjection %s/%s to %s", si.GetNamespace(), si.GetName(), status.Phase)
+	_, err = c.resource().UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+// InjectionConfigFromSidecarInjection parses the spec of a SidecarInjection into an InjectionConfig. If the spec
+// does not set a name, the name of the SidecarInjection is used. Like for ConfigMaps, inherits names another
+// InjectionConfig, and is left to config.ResolveInheritance.
+func InjectionConfigFromSidecarInjection(si *unstructured.Unstructured) (*config.InjectionConfig, error) {
+	spec, ok, err := unstructured.NestedMap(si.Object, "spec")
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SidecarInjection %s spec: %s", si.GetName(), err.Error())
+	}
+	if !ok {
+		return nil, fmt.Errorf("SidecarInjection %s has no spec", si.GetName())
+	}
+	if name, _ := spec["name"].(string); name == "" {
+		spec["name"] = si.GetName()
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	// json is yaml, so we can use the same loader as for files and ConfigMaps
+	ic, err := config.LoadInjectionConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing SidecarInjection %s into injection config: %w", si.GetName(), err)
+	}
+	ic.SetSource(fmt.Sprintf("SidecarInjection %s/%s", si.GetNamespace(), si.GetName()))
+	return ic, nil
+}
@@ -0,0 +1,166 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	// maps a SidecarInjection fixture in test/fixtures/k8s/ => its expected status after reconciliation
+	expectedSidecarInjectionStatuses = map[string]SidecarInjectionStatus{
+		"sidecarinjection-logger": {
+			Phase:              SidecarInjectionPhaseLoaded,
+			InjectionConfig:    "logger:v1",
+			ObservedGeneration: 2,
+		},
+		"sidecarinjection-unnamed": {
+			Phase:              SidecarInjectionPhaseLoaded,
+			InjectionConfig:    "unnamed:latest",
+			ObservedGeneration: 1,
+		},
+		"sidecarinjection-bad-name": {
+			Phase:              SidecarInjectionPhaseInvalid,
+			Message:            "error parsing SidecarInjection bad-name into injection config: not a valid name or name:version format",
+			ObservedGeneration: 1,
+		},
+		"sidecarinjection-inherits": {
+			Phase:              SidecarInjectionPhaseLoaded,
+			InjectionConfig:    "inherits:latest",
+			ObservedGeneration: 1,
+		},
+		"sidecarinjection-inherits-missing": {
+			Phase:              SidecarInjectionPhaseInheritanceError,
+			Message:            "inherited injection config not found: inherits-missing:latest inherits base-logging:v3",
+			InjectionConfig:    "inherits-missing:latest",
+			ObservedGeneration: 3,
+		},
+	}
+)
+
+func loadSidecarInjectionFixture(t *testing.T, fixture string) *unstructured.Unstructured {
+	data, err := ioutil.ReadFile(k8sFixture(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(jsonData); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestSidecarInjectionGet(t *testing.T) {
+	objs := []runtime.Object{}
+	for fixture := range expectedSidecarInjectionStatuses {
+		objs = append(objs, loadSidecarInjectionFixture(t, fixture))
+	}
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objs...)
+	w, err := newSidecarInjectionWatcher(testConfig, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigChan := make(chan interface{}, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Watch(ctx, sigChan)
+	waitForSignal(t, sigChan)
+	if !cache.WaitForCacheSync(ctx.Done(), w.informer.HasSynced) {
+		t.Fatal("SidecarInjection cache did not sync")
+	}
+
+	ics, err := w.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, ic := range ics {
+		names = append(names, ic.FullName())
+		if ic.FullName() == "logger:v1" && ic.Source() != "SidecarInjection default/logger" {
+			t.Errorf("expected logger:v1 to be loaded from SidecarInjection default/logger, but got source %q", ic.Source())
+		}
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "inherits-missing:latest,inherits:latest,logger:v1,unnamed:latest" {
+		t.Fatalf("expected inherits-missing:latest, inherits:latest, logger:v1 and unnamed:latest to be loaded, but got %v", names)
+	}
+	resolved, inheritanceErrors := config.ResolveInheritance(ics)
+	if len(resolved) != 3 {
+		t.Fatalf("expected 3 InjectionConfigs to resolve, but got %v", resolved)
+	}
+	w.UpdateStatuses(ctx, inheritanceErrors)
+
+	for fixture, expected := range expectedSidecarInjectionStatuses {
+		name := strings.TrimPrefix(fixture, "sidecarinjection-")
+		si, err := client.Resource(SidecarInjectionGVR).Namespace("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for field, value := range map[string]interface{}{
+			"phase":              expected.Phase,
+			"message":            expected.Message,
+			"injectionConfig":    expected.InjectionConfig,
+			"observedGeneration": expected.ObservedGeneration,
+		} {
+			actual, _, _ := unstructured.NestedFieldNoCopy(si.Object, "status", field)
+			if actual == nil {
+				actual = map[string]interface{}{"phase": "", "message": "", "injectionConfig": "", "observedGeneration": int64(0)}[field]
+			}
+			if actual != value {
+				t.Errorf("%s: expected status.%s to be %v but got %v", fixture, field, value, actual)
+			}
+		}
+	}
+
+	// wait for the status updates to reach the cache, then a second reconciliation must not write
+	// unchanged statuses again
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		objs, err := w.lister.List(labels.Everything())
+		if err != nil {
+			t.Fatal(err)
+		}
+		withStatus := 0
+		for _, obj := range objs {
+			if _, ok := obj.(*unstructured.Unstructured).Object["status"]; ok {
+				withStatus++
+			}
+		}
+		if withStatus == len(expectedSidecarInjectionStatuses) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for status updates to reach the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.ClearActions()
+	ics, err = w.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, inheritanceErrors = config.ResolveInheritance(ics)
+	w.UpdateStatuses(ctx, inheritanceErrors)
+	for _, action := range client.Actions() {
+		if action.GetSubresource() == "status" {
+			t.Fatalf("expected no status updates when nothing changed, but got %v", action)
+		}
+	}
+}
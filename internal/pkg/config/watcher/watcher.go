@@ -4,81 +4,127 @@ package watcher
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
 	"k8s.io/api/core/v1"
-	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	k8sv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
 	serviceAccountNamespaceFilePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	// eventComponent is the source of Events we record
+	eventComponent = "k8s-sidecar-injector"
 )
 
-// ErrWatchChannelClosed should restart watcher
-var ErrWatchChannelClosed = errors.New("watcher channel has closed")
-
 // K8sConfigMapWatcher is a struct that connects to the API and collects, parses, and emits sidecar configurations
 type K8sConfigMapWatcher struct {
 	Config
-	client k8sv1.CoreV1Interface
+	client   k8sv1.CoreV1Interface
+	informer cache.SharedIndexInformer
+	lister   corelisters.ConfigMapNamespaceLister
+	recorder record.EventRecorder
+
+	statusLock        sync.RWMutex
+	configMaps        map[string]*configMapState
+	inheritanceErrors map[string]error
 }
 
 // New creates a new K8sConfigMapWatcher
 func New(cfg Config) (*K8sConfigMapWatcher, error) {
-	c := K8sConfigMapWatcher{Config: cfg}
+	if err := cfg.inferNamespace(); err != nil {
+		return nil, err
+	}
+	k8sConfig, err := cfg.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newConfigMapWatcher(cfg, clientset)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("Created ConfigMap watcher: apiserver=%s namespace=%s watchlabels=%v resync=%s", k8sConfig.Host, c.Namespace, c.ConfigMapLabels, c.ResyncPeriod)
+	return c, nil
+}
+
+// newConfigMapWatcher creates a K8sConfigMapWatcher using the given clientset, whose informer only caches
+// ConfigMaps in the watched namespace with the watched labels
+func newConfigMapWatcher(cfg Config, clientset kubernetes.Interface) (*K8sConfigMapWatcher, error) {
+	c := K8sConfigMapWatcher{
+		Config:     cfg,
+		client:     clientset.CoreV1(),
+		configMaps: map[string]*configMapState{},
+	}
+	if err := validate(&c); err != nil {
+		return nil, fmt.Errorf("validation failed for K8sConfigMapWatcher: %s", err.Error())
+	}
+
+	c.recorder = newEventRecorder(c.client)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, c.ResyncPeriod,
+		informers.WithNamespace(c.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = mapStringStringToLabelSelector(c.ConfigMapLabels)
+		}),
+	)
+	configMaps := factory.Core().V1().ConfigMaps()
+	c.informer = configMaps.Informer()
+	c.lister = configMaps.Lister().ConfigMaps(c.Namespace)
+	return &c, nil
+}
+
+// newEventRecorder creates a recorder writing Events through client, in the namespace of the object they are about
+func newEventRecorder(client k8sv1.EventsGetter) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&k8sv1.EventSinkImpl{Interface: client.Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+}
+
+// inferNamespace defaults Namespace to the namespace we are running in
+func (c *Config) inferNamespace() error {
 	if c.Namespace == "" {
 		// ENHANCEMENT: support downward API/env vars instead? https://github.com/kubernetes/kubernetes/blob/release-1.0/docs/user-guide/downward-api.md
 		// load from file on disk for serviceaccount: /var/run/secrets/kubernetes.io/serviceaccount/namespace
 		ns, err := ioutil.ReadFile(serviceAccountNamespaceFilePath)
 		if err != nil {
-			return nil, fmt.Errorf("%s: maybe you should specify --configmap-namespace if you are running outside of kubernetes", err.Error())
+			return fmt.Errorf("%s: maybe you should specify --configmap-namespace if you are running outside of kubernetes", err.Error())
 		}
 		if string(ns) != "" {
 			c.Namespace = string(ns)
 			glog.V(2).Infof("Inferred ConfigMap search namespace=%s from %s", c.Namespace, serviceAccountNamespaceFilePath)
 		}
 	}
-	var (
-		err       error
-		k8sConfig *rest.Config
-	)
+	return nil
+}
+
+// restConfig returns the configuration to reach the k8s api with
+func (c *Config) restConfig() (*rest.Config, error) {
 	if c.Kubeconfig != "" || c.MasterURL != "" {
 		glog.V(2).Infof("Creating Kubernetes client from kubeconfig=%s with masterurl=%s", c.Kubeconfig, c.MasterURL)
-		k8sConfig, err = clientcmd.BuildConfigFromFlags(c.MasterURL, c.Kubeconfig)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		glog.V(2).Infof("Creating Kubernetes client from in-cluster discovery")
-		k8sConfig, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
-		}
+		return clientcmd.BuildConfigFromFlags(c.MasterURL, c.Kubeconfig)
 	}
-	clientset, err := kubernetes.NewForConfig(k8sConfig)
-	if err != nil {
-		return nil, err
-	}
-
-	c.client = clientset.CoreV1()
-	err = validate(&c)
-	if err != nil {
-		return nil, fmt.Errorf("validation failed for K8sConfigMapWatcher: %s", err.Error())
-	}
-	glog.V(2).Infof("Created ConfigMap watcher: apiserver=%s namespace=%s watchlabels=%v", k8sConfig.Host, c.Namespace, c.ConfigMapLabels)
-	return &c, nil
+	glog.V(2).Infof("Creating Kubernetes client from in-cluster discovery")
+	return rest.InClusterConfig()
 }
 
 func validate(c *K8sConfigMapWatcher) error {
@@ -97,48 +143,12 @@ func validate(c *K8sConfigMapWatcher) error {
 	return nil
 }
 
-// Watch watches for events impacting watched ConfigMaps and emits their events across a channel
+// Watch runs the informer caching watched ConfigMaps, and signals notifyMe whenever one is added, updated
+// or deleted, as well as on every resync. Dropped watches are re-established by the informer, so Watch
+// only returns once ctx is done. Watch must only be called once.
 func (c *K8sConfigMapWatcher) Watch(ctx context.Context, notifyMe chan<- interface{}) error {
 	glog.V(3).Infof("Watching for ConfigMaps for changes on namespace=%s with labels=%v", c.Namespace, c.ConfigMapLabels)
-	watcher, err := c.client.ConfigMaps(c.Namespace).Watch(ctx, metav1.ListOptions{
-		LabelSelector: mapStringStringToLabelSelector(c.ConfigMapLabels),
-	})
-	if err != nil {
-		return fmt.Errorf("unable to create watcher (possible serviceaccount RBAC/ACL failure?): %s", err.Error())
-	}
-	defer watcher.Stop()
-	for {
-		select {
-		case e, ok := <-watcher.ResultChan():
-			// channel may closed caused by HTTP timeout, should restart watcher
-			// detail at https://github.com/kubernetes/client-go/issues/334
-			if !ok {
-				glog.Errorf("channel has closed, should restart watcher")
-				return ErrWatchChannelClosed
-			}
-			if e.Type == watch.Error {
-				return apierrs.FromObject(e.Object)
-			}
-			glog.V(3).Infof("event: %s %s", e.Type, e.Object.GetObjectKind())
-			switch e.Type {
-			case watch.Added:
-				fallthrough
-			case watch.Modified:
-				fallthrough
-			case watch.Deleted:
-				// signal reconciliation of all InjectionConfigs
-				glog.V(3).Infof("signalling event received from watch channel: %s %s", e.Type, e.Object.GetObjectKind())
-				notifyMe <- struct{}{}
-			default:
-				glog.Errorf("got unsupported event %s for %s! skipping", e.Type, e.Object.GetObjectKind())
-			}
-			// events! yay!
-		case <-ctx.Done():
-			glog.V(2).Infof("stopping configmap watcher, context indicated we are done")
-			// clean up, we cancelled the context, so stop the watch
-			return nil
-		}
-	}
+	return runInformer(ctx, "ConfigMap", c.informer, notifyMe)
 }
 
 func mapStringStringToLabelSelector(m map[string]string) string {
@@ -146,24 +156,25 @@ func mapStringStringToLabelSelector(m map[string]string) string {
 	return labels.Set(m).String()
 }
 
-// Get fetches all matching ConfigMaps
+// Get returns the InjectionConfigs of all watched ConfigMaps. ConfigMaps are read from the informer cache,
+// so this does not call the API. A ConfigMap that fails to load does not fail Get; its last-known-good
+// InjectionConfigs are returned instead, and the failure is reported by ConfigMapStatuses, the
+// configmap_load_status metric and an Event on the ConfigMap.
 func (c *K8sConfigMapWatcher) Get(ctx context.Context) (cfgs []*config.InjectionConfig, err error) {
-	glog.V(1).Infof("Fetching ConfigMaps...")
-	clist, err := c.client.ConfigMaps(c.Namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: mapStringStringToLabelSelector(c.ConfigMapLabels),
-	})
+	glog.V(1).Infof("Fetching ConfigMaps from cache...")
+	cms, err := c.lister.List(labels.Everything())
 	if err != nil {
 		return cfgs, err
 	}
-	glog.V(1).Infof("Fetched %d ConfigMaps", len(clist.Items))
-	for _, cm := range clist.Items {
-		injectionConfigsForCM, err := InjectionConfigsFromConfigMap(cm)
-		if err != nil {
-			return cfgs, fmt.Errorf("error getting ConfigMaps from API: %s", err.Error())
-		}
-		glog.V(1).Infof("Found %d InjectionConfigs in %s", len(injectionConfigsForCM), cm.ObjectMeta.Name)
-		cfgs = append(cfgs, injectionConfigsForCM...)
+	// the cache is unordered; keep reconciliation deterministic
+	sort.Slice(cms, func(i, j int) bool { return cms[i].Name < cms[j].Name })
+	glog.V(1).Infof("Fetched %d ConfigMaps", len(cms))
+	watched := map[string]bool{}
+	for _, cm := range cms {
+		watched[cm.Name] = true
+		cfgs = append(cfgs, c.load(cm)...)
 	}
+	c.forget(watched)
 	return cfgs, nil
 }
 
@@ -174,8 +185,9 @@ func InjectionConfigsFromConfigMap(cm v1.ConfigMap) ([]*config.InjectionConfig,
 		glog.V(3).Infof("Parsing %s/%s:%s into InjectionConfig", cm.ObjectMeta.Namespace, cm.ObjectMeta.Name, name)
 		ic, err := config.LoadInjectionConfig(strings.NewReader(payload))
 		if err != nil {
-			return nil, fmt.Errorf("error parsing ConfigMap %s item %s into injection config: %s", cm.ObjectMeta.Name, name, err.Error())
+			return nil, fmt.Errorf("error parsing ConfigMap %s item %s into injection config: %w", cm.ObjectMeta.Name, name, err)
 		}
+		ic.SetSource(fmt.Sprintf("ConfigMap %s/%s data[%s]", cm.ObjectMeta.Namespace, cm.ObjectMeta.Name, name))
 		glog.V(2).Infof("Loaded InjectionConfig %s from ConfigMap %s:%s", ic.Name, cm.ObjectMeta.Name, name)
 		ics = append(ics, ic)
 	}
@@ -2,12 +2,12 @@ package watcher
 
 import (
 	"context"
-	"errors"
-	"k8s.io/apimachinery/pkg/watch"
-	testcore "k8s.io/client-go/testing"
 	"testing"
+	"time"
 
 	_ "github.com/tumblr/k8s-sidecar-injector/internal/pkg/testing"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
@@ -20,10 +20,31 @@ var (
 	}
 )
 
+func testConfigMap(name string, labels map[string]string, data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    labels,
+		},
+		Data: data,
+	}
+}
+
+// waitForSignal fails the test if nothing is signalled on ch within a reasonable time
+func waitForSignal(t *testing.T, ch <-chan interface{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the watcher to signal a reconciliation")
+	}
+}
+
 func TestGet(t *testing.T) {
-	w := K8sConfigMapWatcher{
-		Config: testConfig,
-		client: fake.NewSimpleClientset().CoreV1(),
+	w, err := newConfigMapWatcher(testConfig, fake.NewSimpleClientset())
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	ctx := context.Background()
@@ -36,44 +57,68 @@ func TestGet(t *testing.T) {
 	}
 }
 
-func TestWatcherChannelClose(t *testing.T) {
-	client := fake.NewSimpleClientset()
-	watcher := watch.NewEmptyWatch()
-	client.PrependWatchReactor("configmaps", testcore.DefaultWatchReactor(watcher, nil))
-
-	w := K8sConfigMapWatcher{
-		Config: testConfig,
-		client: client.CoreV1(),
+func TestWatchGetFromCache(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testConfigMap("watched", testConfig.ConfigMapLabels, map[string]string{"env": "name: env1"}),
+		testConfigMap("unwatched", map[string]string{"thing": "other"}, map[string]string{"env": "name: env2"}),
+	)
+	w, err := newConfigMapWatcher(testConfig, client)
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	sigChan := make(chan interface{}, 10)
-	// background context never canceled, no deadline
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Watch(ctx, sigChan) }()
 
-	err := w.Watch(ctx, sigChan)
-	if err != nil && err != ErrWatchChannelClosed {
-		t.Errorf("expect catch ErrWatchChannelClosed, but got %s", err)
+	// the initial list is delivered as adds
+	waitForSignal(t, sigChan)
+	ics, err := w.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ics) != 1 || ics[0].FullName() != "env1:latest" {
+		t.Fatalf("expected only env1:latest to be loaded from the cache, but got %v", ics)
 	}
-}
 
-func TestWatcherWatchCreateError(t *testing.T) {
-	client := fake.NewSimpleClientset()
+	// reading the cache must not hit the API
+	client.ClearActions()
+	if _, err := w.Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.Actions()) != 0 {
+		t.Fatalf("expected Get to read from the cache, but got API calls %v", client.Actions())
+	}
 
-	client.PrependWatchReactor("configmaps", func(_ testcore.Action) (
-		handled bool,
-		ret watch.Interface,
-		err error,
-	) {
-		return true, nil, errors.New("did not construct a watcher")
-	})
+	_, err = client.CoreV1().ConfigMaps("default").Create(ctx, testConfigMap("added", testConfig.ConfigMapLabels, map[string]string{"env": "name: env3"}), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForSignal(t, sigChan)
+	ics, err = w.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ics) != 2 || ics[0].FullName() != "env3:latest" || ics[1].FullName() != "env1:latest" {
+		t.Fatalf("expected env3:latest and env1:latest to be loaded from the cache, but got %v", ics)
+	}
 
-	w := K8sConfigMapWatcher{
-		Config: testConfig,
-		client: client.CoreV1(),
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected Watch to stop cleanly when the context is done, but got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Watch to return after the context was done")
 	}
+}
 
-	err := w.Watch(context.Background(), make(chan interface{}, 10))
-	if err == nil {
-		t.Error("expected Watch to fail when the watcher couldn't be created")
+func TestWatcherValidation(t *testing.T) {
+	cfg := testConfig
+	cfg.ConfigMapLabels = nil
+	if _, err := newConfigMapWatcher(cfg, fake.NewSimpleClientset()); err == nil {
+		t.Error("expected creating a watcher without ConfigMap labels to fail")
 	}
 }
@@ -22,6 +22,11 @@ type ConfigExpectation struct {
 	HostPID            bool
 	InitContainerCount int
 	ServiceAccount     string
+	// EnvPolicy and VolumeMountPolicy are the expected policies, or empty for the default
+	EnvPolicy         string
+	VolumeMountPolicy string
+	// FailurePolicy is the expected failurePolicy, or empty if unset
+	FailurePolicy string
 
 	// LoadError is an error, if any, that is expected during load
 	LoadError error
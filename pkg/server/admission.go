@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	// admissionv1GVK is the GroupVersionKind of an admission.k8s.io/v1 AdmissionReview
+	admissionv1GVK = admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")
+	// admissionv1beta1GVK is the GroupVersionKind of an admission.k8s.io/v1beta1 AdmissionReview
+	admissionv1beta1GVK = v1beta1.SchemeGroupVersion.WithKind("AdmissionReview")
+)
+
+// decodeAdmissionReview decodes an AdmissionReview of any supported version. The request is converted
+// to admission.k8s.io/v1 so the rest of the webhook only deals with one version; the returned
+// GroupVersionKind is the version the API server sent, which we must answer in.
+func decodeAdmissionReview(body []byte) (*admissionv1.AdmissionRequest, *schema.GroupVersionKind, error) {
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		return nil, gvk, err
+	}
+
+	switch ar := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		return ar.Request, gvk, nil
+	case *v1beta1.AdmissionReview:
+		return admissionRequestFromV1beta1(ar.Request), gvk, nil
+	default:
+		return nil, gvk, fmt.Errorf("unsupported AdmissionReview type %s", gvk)
+	}
+}
+
+// encodeAdmissionReview wraps an AdmissionResponse into an AdmissionReview of the given version, and
+// serializes it to JSON. A nil gvk results in an admission.k8s.io/v1beta1 AdmissionReview, which was the
+// only version understood by the webhook historically.
+func encodeAdmissionReview(gvk *schema.GroupVersionKind, res *admissionv1.AdmissionResponse) ([]byte, error) {
+	if gvk != nil && *gvk == admissionv1GVK {
+		ar := admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: admissionv1GVK.GroupVersion().String(),
+				Kind:       admissionv1GVK.Kind,
+			},
+			Response: res,
+		}
+		return json.Marshal(ar)
+	}
+
+	ar := v1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionv1beta1GVK.GroupVersion().String(),
+			Kind:       admissionv1beta1GVK.Kind,
+		},
+		Response: admissionResponseToV1beta1(res),
+	}
+	return json.Marshal(ar)
+}
+
+func admissionRequestFromV1beta1(req *v1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if req == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          admissionv1.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+func admissionResponseToV1beta1(res *admissionv1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	if res == nil {
+		return nil
+	}
+	out := &v1beta1.AdmissionResponse{
+		UID:              res.UID,
+		Allowed:          res.Allowed,
+		Result:           res.Result,
+		Patch:            res.Patch,
+		AuditAnnotations: res.AuditAnnotations,
+	}
+	if res.PatchType != nil {
+		pt := v1beta1.PatchType(*res.PatchType)
+		out.PatchType = &pt
+	}
+	return out
+}
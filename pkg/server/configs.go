@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+)
+
+// configsPath is the path ConfigsHandler is served on. Single configs are served below it.
+const configsPath = "/configs"
+
+// InjectionConfigStatus describes a loaded InjectionConfig
+type InjectionConfigStatus struct {
+	// Name is the full name of the config
+	Name string `json:"name"`
+	// Source is where the config was loaded from: a file, or a ConfigMap item or SidecarInjection
+	Source string `json:"source"`
+	// InheritanceChain are the configs merged into this one, starting with itself
+	InheritanceChain []config.InheritedConfig `json:"inheritanceChain"`
+	// Hash is the hash of the config as loaded, as recorded on the pods injected with it
+	Hash string `json:"hash"`
+	// LoadedAt is when the config was loaded with this hash, i.e. when it was first loaded, or last changed
+	LoadedAt time.Time `json:"loadedAt"`
+}
+
+// InjectionConfigsStatus describes the InjectionConfigs the server has loaded
+type InjectionConfigsStatus struct {
+	// LastReload is when the configs were last loaded or reconciled, whether they changed or not
+	LastReload time.Time `json:"lastReload"`
+	// InjectionConfigs are sorted by name
+	InjectionConfigs []InjectionConfigStatus `json:"injectionConfigs"`
+}
+
+// InjectionConfigsStatus returns the InjectionConfigs loaded, with where they were loaded from
+func (whsvr *WebhookServer) InjectionConfigsStatus() InjectionConfigsStatus {
+	status := InjectionConfigsStatus{
+		LastReload:       whsvr.Config.LastReload(),
+		InjectionConfigs: []InjectionConfigStatus{},
+	}
+	for _, loaded := range whsvr.Config.LoadedInjectionConfigs() {
+		status.InjectionConfigs = append(status.InjectionConfigs, InjectionConfigStatus{
+			Name:             loaded.FullName(),
+			Source:           loaded.Source(),
+			InheritanceChain: loaded.InheritanceChain(),
+			Hash:             loaded.Hash,
+			LoadedAt:         loaded.LoadedAt,
+		})
+	}
+	return status
+}
+
+// ConfigsHandler lists the loaded InjectionConfigs on /configs, as InjectionConfigsStatus, and returns the
+// effective config of one on /configs/{name}, as yaml. The name may omit the version, like in the request
+// annotation.
+func (whsvr *WebhookServer) ConfigsHandler() http.Handler {
+	return instrumentHandler("configs", http.HandlerFunc(whsvr.configsHandler))
+}
+
+func (whsvr *WebhookServer) configsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, configsPath), "/")
+	if name != "" {
+		whsvr.configHandler(w, name)
+		return
+	}
+
+	resp, err := json.Marshal(whsvr.InjectionConfigsStatus())
+	if err != nil {
+		glog.Errorf("Can't encode injection configs: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
+
+// configHandler writes the effective config named name
+func (whsvr *WebhookServer) configHandler(w http.ResponseWriter, name string) {
+	ic, err := whsvr.Config.GetInjectionConfig(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	resp, err := ic.YAML()
+	if err != nil {
+		glog.Errorf("Can't encode injection config %s: %v", ic.FullName(), err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
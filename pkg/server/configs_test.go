@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+)
+
+func TestConfigsHandler(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &WebhookServer{Config: c}
+
+	w := httptest.NewRecorder()
+	s.configsHandler(w, httptest.NewRequest(http.MethodGet, "/configs", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", w.Code, w.Body.String())
+	}
+	var status InjectionConfigsStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("unable to unmarshal configs: %v", err)
+	}
+	if !status.LastReload.Equal(c.LastReload()) || len(status.InjectionConfigs) != len(c.Injections) {
+		t.Fatalf("expected %d configs reloaded at %s, but got %+v", len(c.Injections), c.LastReload(), status)
+	}
+	var inheriting *InjectionConfigStatus
+	for i := range status.InjectionConfigs {
+		if status.InjectionConfigs[i].Name == "inheritance-complex:v1" {
+			inheriting = &status.InjectionConfigs[i]
+		}
+	}
+	if inheriting == nil {
+		t.Fatalf("expected inheritance-complex:v1 to be listed, but got %+v", status.InjectionConfigs)
+	}
+	hash, err := c.Injections["inheritance-complex:v1"].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inheriting.Source != sidecars+"/inheritance-1.yaml" || inheriting.Hash != hash || !inheriting.LoadedAt.Equal(c.LastReload()) {
+		t.Errorf("expected inheritance-complex:v1 from %s/inheritance-1.yaml with hash %s, but got %+v", sidecars, hash, inheriting)
+	}
+	if len(inheriting.InheritanceChain) != 2 || inheriting.InheritanceChain[1].Name != "complex-sidecar:v420.69" {
+		t.Errorf("expected inheritance-complex:v1 to inherit complex-sidecar:v420.69, but got %+v", inheriting.InheritanceChain)
+	}
+
+	for name, test := range map[string]struct {
+		target string
+		code   int
+		config string
+	}{
+		"full name":       {target: "/configs/inheritance-complex:v1", code: http.StatusOK, config: "inheritance-complex:v1"},
+		"without version": {target: "/configs/sidecar-test", code: http.StatusOK, config: "sidecar-test:latest"},
+		"not loaded":      {target: "/configs/does-not-exist", code: http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		s.configsHandler(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d but got %d: %s", name, test.code, w.Code, w.Body.String())
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		expected, err := c.Injections[test.config].YAML()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Body.String() != string(expected) {
+			t.Errorf("%s: expected\n%s\nbut got\n%s", name, expected, w.Body.String())
+		}
+		// the effective config is named by its full name, so it keeps its version
+		var loaded map[string]interface{}
+		if err := yaml.Unmarshal(w.Body.Bytes(), &loaded); err != nil || loaded["name"] != test.config {
+			t.Errorf("%s: expected yaml of %s, but got %v (%v)", name, test.config, loaded, err)
+		}
+	}
+}
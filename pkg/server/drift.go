@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// EventReasonStaleInjection is the reason of Events recorded on workloads whose pods were injected with
+	// an outdated InjectionConfig
+	EventReasonStaleInjection = "StaleInjection"
+	// DefaultDriftInterval is how often DriftReconciler looks for stale pods by default
+	DefaultDriftInterval = 5 * time.Minute
+)
+
+var (
+	stalePodsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "stale_pods",
+			Help: "Number of pods injected with an outdated InjectionConfig, as of the last drift reconciliation",
+		},
+		[]string{"config", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(stalePodsGauge)
+}
+
+// DriftReport lists the workloads whose pods were injected with an outdated InjectionConfig
+type DriftReport struct {
+	// Time is when the report was made
+	Time      time.Time       `json:"time"`
+	Workloads []StaleWorkload `json:"workloads"`
+}
+
+// StaleWorkload is a workload with pods injected with an outdated InjectionConfig, that needs a rollout to
+// inject the current one. Pods without a controller are reported as their own workload.
+type StaleWorkload struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	// InjectedConfig is the full name of the InjectionConfig(s) the pods were injected with
+	InjectedConfig string `json:"injectedConfig"`
+	// CurrentHash is the hash of the currently loaded InjectionConfig, if it is still loaded
+	CurrentHash string `json:"currentHash,omitempty"`
+	// Reason is one of ConfigChanged or ConfigNotFound
+	Reason string `json:"reason"`
+	// Pods are the names of the stale pods
+	Pods []string `json:"pods"`
+
+	ref *corev1.ObjectReference
+	// drifts are the drifts of the pods, see podDrift
+	drifts map[string]bool
+}
+
+// key identifies the workload and the config its pods were injected with
+func (w *StaleWorkload) key() string {
+	return fmt.Sprintf("%s/%s/%s/%s", w.Kind, w.Namespace, w.Name, w.InjectedConfig)
+}
+
+// podDrift identifies why the pod is stale: the hash of the config it was injected with, as loaded then, and
+// what became of that config. Pods injected with the same config, at the same time, drift the same way.
+func podDrift(s StalePod) string {
+	return fmt.Sprintf("%s/%s/%s", s.InjectedHash, s.Reason, s.CurrentHash)
+}
+
+// DriftReconciler periodically looks for pods injected with an outdated InjectionConfig (see
+// WebhookServer.StalePods), and reports the workloads owning them through the stale_pods metric, Events on
+// the workloads, and a DriftReport.
+type DriftReconciler struct {
+	Server *WebhookServer
+	// ReplicaSets is used to report the Deployment owning a pod, rather than its ReplicaSet. If nil,
+	// ReplicaSets are reported.
+	ReplicaSets appslisters.ReplicaSetLister
+	// Recorder records Events on stale workloads. If nil, no Events are recorded.
+	Recorder record.EventRecorder
+
+	lock   sync.RWMutex
+	report *DriftReport
+	// reported holds the drifts of the pods of each stale workload, as of the last reconciliation, so workloads
+	// are only reported again when their pods drift in a new way, i.e. the config was updated again
+	reported map[string]bool
+}
+
+// Run reconciles every interval, once synced returns true. Run only returns once ctx is done.
+func (r *DriftReconciler) Run(ctx context.Context, interval time.Duration, synced ...cache.InformerSynced) {
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return
+	}
+	// the first reconciliation waits for an interval too, giving configs from the k8s api the time to load;
+	// until they are, all pods injected with them would be reported
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			glog.V(2).Infof("stopping drift reconciler, context indicated we are done")
+			return
+		case <-ticker.C:
+			if err := r.Reconcile(); err != nil {
+				glog.Errorf("error reconciling drift: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Reconcile finds the workloads with stale pods, updates the stale_pods metric and the report, and records
+// an Event on each workload that became stale since the last reconciliation
+func (r *DriftReconciler) Reconcile() error {
+	stale, err := r.Server.StalePods()
+	if err != nil {
+		return err
+	}
+
+	type metricLabels struct{ config, reason string }
+	counts := map[metricLabels]int{}
+	byKey := map[string]*StaleWorkload{}
+	workloads := []*StaleWorkload{}
+	for _, s := range stale {
+		counts[metricLabels{s.InjectedConfig, s.Reason}]++
+		ref := r.owner(s.pod)
+		w := &StaleWorkload{
+			APIVersion:     ref.APIVersion,
+			Kind:           ref.Kind,
+			Namespace:      ref.Namespace,
+			Name:           ref.Name,
+			InjectedConfig: s.InjectedConfig,
+			CurrentHash:    s.CurrentHash,
+			Reason:         s.Reason,
+			Pods:           []string{},
+			ref:            ref,
+			drifts:         map[string]bool{},
+		}
+		if existing, ok := byKey[w.key()]; ok {
+			w = existing
+		} else {
+			byKey[w.key()] = w
+			workloads = append(workloads, w)
+		}
+		w.Pods = append(w.Pods, s.Name)
+		w.drifts[podDrift(s)] = true
+	}
+	sort.SliceStable(workloads, func(i, j int) bool {
+		a, b := workloads[i], workloads[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+
+	stalePodsGauge.Reset()
+	for l, count := range counts {
+		stalePodsGauge.With(prometheus.Labels{"config": l.config, "reason": l.reason}).Set(float64(count))
+	}
+
+	report := &DriftReport{
+		Time:      time.Now(),
+		Workloads: make([]StaleWorkload, 0, len(workloads)),
+	}
+	for _, w := range workloads {
+		report.Workloads = append(report.Workloads, *w)
+	}
+	glog.V(1).Infof("Found %d stale pods in %d workloads", len(stale), len(workloads))
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.report = report
+	r.recordEvents(workloads)
+	return nil
+}
+
+// recordEvents records an Event on each workload with pods that drifted in a way not reported yet, and forgets
+// the workloads that are no longer stale. r.lock must be held.
+func (r *DriftReconciler) recordEvents(workloads []*StaleWorkload) {
+	reported := map[string]bool{}
+	for _, w := range workloads {
+		drifted := false
+		for drift := range w.drifts {
+			key := w.key() + "/" + drift
+			reported[key] = true
+			if !r.reported[key] {
+				drifted = true
+			}
+		}
+		if !drifted || r.Recorder == nil {
+			continue
+		}
+		switch w.Reason {
+		case StalePodReasonConfigNotFound:
+			r.Recorder.Eventf(w.ref, corev1.EventTypeWarning, EventReasonStaleInjection,
+				"%d pods were injected with InjectionConfig %s, which is no longer loaded", len(w.Pods), w.InjectedConfig)
+		default:
+			r.Recorder.Eventf(w.ref, corev1.EventTypeWarning, EventReasonStaleInjection,
+				"%d pods were injected with an outdated InjectionConfig %s, roll them out to inject the current one", len(w.Pods), w.InjectedConfig)
+		}
+	}
+	r.reported = reported
+}
+
+// owner returns a reference to the workload owning pod: the controller of the pod, or the Deployment
+// owning its ReplicaSet. Pods without a controller own themselves.
+func (r *DriftReconciler) owner(pod *corev1.Pod) *corev1.ObjectReference {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  pod.Namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		}
+	}
+	if controller.Kind == "ReplicaSet" && r.ReplicaSets != nil {
+		rs, err := r.ReplicaSets.ReplicaSets(pod.Namespace).Get(controller.Name)
+		if err != nil {
+			glog.V(2).Infof("Unable to find ReplicaSet %s/%s owning pod %s: %s", pod.Namespace, controller.Name, pod.Name, err.Error())
+		} else if deployment := metav1.GetControllerOf(rs); deployment != nil {
+			controller = deployment
+		}
+	}
+	return &corev1.ObjectReference{
+		APIVersion: controller.APIVersion,
+		Kind:       controller.Kind,
+		Namespace:  pod.Namespace,
+		Name:       controller.Name,
+		UID:        controller.UID,
+	}
+}
+
+// Report returns the report of the last reconciliation, or nil if none ran yet
+func (r *DriftReconciler) Report() *DriftReport {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.report
+}
+
+// DriftHandler handles requests for the workloads whose pods were injected with an outdated InjectionConfig
+func (whsvr *WebhookServer) DriftHandler() http.Handler {
+	return instrumentHandler("drift", http.HandlerFunc(whsvr.driftHandler))
+}
+
+func (whsvr *WebhookServer) driftHandler(w http.ResponseWriter, r *http.Request) {
+	if whsvr.Drift == nil {
+		http.Error(w, "pods are not watched, see --watch-pods", http.StatusNotImplemented)
+		return
+	}
+	report := whsvr.Drift.Report()
+	if report == nil {
+		http.Error(w, "drift was not reconciled yet", http.StatusServiceUnavailable)
+		return
+	}
+	resp, err := json.Marshal(report)
+	if err != nil {
+		glog.Errorf("Can't encode drift report: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
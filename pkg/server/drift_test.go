@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func ownedBy(pod *corev1.Pod, apiVersion, kind, name string) *corev1.Pod {
+	controller := true
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: apiVersion, Kind: kind, Name: name, Controller: &controller}}
+	return pod
+}
+
+func TestDriftReconciler(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+	s := &WebhookServer{Config: c}
+	current, err := s.injectionConfigHash("env1:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Pods = fakePodLister{
+		ownedBy(injectedPod("web-abc-1", "env1:latest", "outdated"), "apps/v1", "ReplicaSet", "web-abc"),
+		ownedBy(injectedPod("web-abc-2", "env1:latest", "outdated"), "apps/v1", "ReplicaSet", "web-abc"),
+		ownedBy(injectedPod("web-abc-3", "env1:latest", current), "apps/v1", "ReplicaSet", "web-abc"),
+		ownedBy(injectedPod("db-0", "removed:latest", "outdated"), "apps/v1", "StatefulSet", "db"),
+		injectedPod("bare", "env1:latest", "outdated"),
+	}
+
+	replicaSets := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "unittest", Name: "web-abc"}}
+	ownedByDeployment := ownedBy(&corev1.Pod{}, "apps/v1", "Deployment", "web")
+	rs.OwnerReferences = ownedByDeployment.OwnerReferences
+	if err := replicaSets.Add(rs); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	r := &DriftReconciler{
+		Server:      s,
+		ReplicaSets: appslisters.NewReplicaSetLister(replicaSets),
+		Recorder:    recorder,
+	}
+	s.Drift = r
+	if err := r.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []StaleWorkload{
+		{Kind: "Deployment", Name: "web", InjectedConfig: "env1:latest", Reason: StalePodReasonConfigChanged, Pods: []string{"web-abc-1", "web-abc-2"}},
+		{Kind: "Pod", Name: "bare", InjectedConfig: "env1:latest", Reason: StalePodReasonConfigChanged, Pods: []string{"bare"}},
+		{Kind: "StatefulSet", Name: "db", InjectedConfig: "removed:latest", Reason: StalePodReasonConfigNotFound, Pods: []string{"db-0"}},
+	}
+	report := r.Report()
+	if report == nil || len(report.Workloads) != len(expected) {
+		t.Fatalf("expected %d stale workloads but got %+v", len(expected), report)
+	}
+	for i, e := range expected {
+		w := report.Workloads[i]
+		if w.Kind != e.Kind || w.Name != e.Name || w.Namespace != "unittest" || w.InjectedConfig != e.InjectedConfig || w.Reason != e.Reason || len(w.Pods) != len(e.Pods) {
+			t.Errorf("expected stale workload %d to be %+v but got %+v", i, e, w)
+			continue
+		}
+		for j := range e.Pods {
+			if w.Pods[j] != e.Pods[j] {
+				t.Errorf("expected stale workload %s to have pods %v but got %v", w.Name, e.Pods, w.Pods)
+			}
+		}
+	}
+	if len(recorder.Events) != len(expected) {
+		t.Fatalf("expected %d events but got %d", len(expected), len(recorder.Events))
+	}
+	for range expected {
+		<-recorder.Events
+	}
+
+	// the same drift is only reported once
+	if err := r.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no events for workloads already reported but got %s", <-recorder.Events)
+	}
+
+	// pods injected with another outdated version of the config are a new drift of their workload
+	s.Pods = append(s.Pods.(fakePodLister), ownedBy(injectedPod("web-abc-4", "env1:latest", "older"), "apps/v1", "ReplicaSet", "web-abc"))
+	if err := r.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected an event for the new drift of web but got %d", len(recorder.Events))
+	}
+	<-recorder.Events
+
+	rec := httptest.NewRecorder()
+	s.DriftHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/drift", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var served DriftReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served.Workloads) != len(expected) || len(served.Workloads[0].Pods) != 3 {
+		t.Errorf("expected %d stale workloads to be served but got %+v", len(expected), served)
+	}
+}
+
+func TestDriftHandlerWithoutReconciler(t *testing.T) {
+	s := &WebhookServer{Config: &config.Config{}}
+	rec := httptest.NewRecorder()
+	s.DriftHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/drift", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected status %d but got %d", http.StatusNotImplemented, rec.Code)
+	}
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
 )
 
 var (
@@ -31,7 +34,15 @@ func GetErrorReason(err error) string {
 	case nil:
 		reason = ""
 	default:
-		reason = "unknown_error"
+		// errors from loading configs are wrapped with details, so we have to unwrap them
+		switch {
+		case errors.Is(err, config.ErrConflictingInjectionConfigs):
+			reason = "conflicting_configs"
+		case errors.Is(err, config.ErrTemplateRender):
+			reason = "template_error"
+		default:
+			reason = "unknown_error"
+		}
 	}
 	return reason
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// failurePolicy returns the failure policy for pods requesting the comma separated configs: Fail if any of them
+// fails closed. Configs that are not loaded, or that do not set a failurePolicy, get DefaultFailurePolicy.
+func (whsvr *WebhookServer) failurePolicy(requested string) string {
+	for _, key := range strings.Split(requested, ",") {
+		policy := whsvr.DefaultFailurePolicy
+		if ic, err := whsvr.Config.GetInjectionConfig(strings.TrimSpace(key)); err == nil && ic.FailurePolicy != "" {
+			policy = ic.FailurePolicy
+		}
+		if policy == config.FailurePolicyFail {
+			return config.FailurePolicyFail
+		}
+	}
+	return config.FailurePolicyIgnore
+}
+
+// failureStatus returns the status reason and code rejecting a pod that could not be injected, given the
+// reason reported in metrics (see GetErrorReason)
+func failureStatus(reason string) (metav1.StatusReason, int32) {
+	switch reason {
+	case "unmarshal_error":
+		return metav1.StatusReasonBadRequest, http.StatusBadRequest
+	case "missing_config":
+		return metav1.StatusReasonNotFound, http.StatusNotFound
+	case "conflicting_configs":
+		return metav1.StatusReasonConflict, http.StatusConflict
+	default:
+		return metav1.StatusReasonInternalError, http.StatusInternalServerError
+	}
+}
+
+// injectionFailed returns the response to a pod that could not be injected with the requested configs because of
+// err, and counts it in the injections metric: with config.FailurePolicyFail the pod is rejected (and counted as
+// denied), otherwise it is admitted without injection (and counted with status)
+func injectionFailed(policy, requested, reason, status string, err error) *admissionv1.AdmissionResponse {
+	if policy != config.FailurePolicyFail {
+		injectionCounter.With(prometheus.Labels{"status": status, "reason": reason, "requested": requested}).Inc()
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	injectionCounter.With(prometheus.Labels{"status": "denied", "reason": reason, "requested": requested}).Inc()
+	statusReason, code := failureStatus(reason)
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: fmt.Sprintf("sidecar injection failed (%s): %s", reason, err.Error()),
+			Reason:  statusReason,
+			Code:    code,
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+type failurePolicyTest struct {
+	name string
+	// request is the AdmissionRequest fixture to mutate; if empty, the request carries no valid pod
+	request              string
+	defaultFailurePolicy string
+	allowed              bool
+	reason               metav1.StatusReason
+	code                 int32
+}
+
+var failurePolicyTests = []failurePolicyTest{
+	{name: "missing config ignored by default", request: "missing-sidecar-config", allowed: true},
+	{name: "missing config", request: "missing-sidecar-config", defaultFailurePolicy: config.FailurePolicyFail, reason: metav1.StatusReasonNotFound, code: http.StatusNotFound},
+	{name: "missing config with a config failing closed", request: "failure-policy-missing", reason: metav1.StatusReasonNotFound, code: http.StatusNotFound},
+	{name: "conflicting configs", request: "multiple-sidecars-conflict", defaultFailurePolicy: config.FailurePolicyFail, reason: metav1.StatusReasonConflict, code: http.StatusConflict},
+	{name: "unmarshal error ignored", defaultFailurePolicy: config.FailurePolicyIgnore, allowed: true},
+	{name: "unmarshal error", defaultFailurePolicy: config.FailurePolicyFail, reason: metav1.StatusReasonBadRequest, code: http.StatusBadRequest},
+	{name: "not requested", request: "not-requested", defaultFailurePolicy: config.FailurePolicyFail, allowed: true},
+}
+
+func TestFailurePolicy(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+
+	for _, test := range failurePolicyTests {
+		s := &WebhookServer{
+			Config:               c,
+			Namespaces:           testNamespaces,
+			DefaultFailurePolicy: test.defaultFailurePolicy,
+		}
+		req := admissionv1.AdmissionRequest{Object: runtime.RawExtension{Raw: []byte("not a pod")}}
+		if test.request != "" {
+			reqFile := fmt.Sprintf("test/fixtures/k8s/admissioncontrol/request/%s.yaml", test.request)
+			reqData, err := ioutil.ReadFile(reqFile)
+			if err != nil {
+				t.Fatalf("%s: unable to load AdmissionRequest object: %v", reqFile, err)
+			}
+			if err := yaml.Unmarshal(reqData, &req); err != nil {
+				t.Fatalf("%s: unable to unmarshal AdmissionRequest yaml: %v", reqFile, err)
+			}
+		}
+
+		res := s.mutate(&req)
+		if res.Allowed != test.allowed {
+			t.Fatalf("%s: expected AdmissionResponse.Allowed=%v but got %v (%+v)", test.name, test.allowed, res.Allowed, res.Result)
+		}
+		if res.Patch != nil {
+			t.Fatalf("%s: expected no patch but got %s", test.name, string(res.Patch))
+		}
+		if test.allowed {
+			continue
+		}
+		if res.Result == nil {
+			t.Fatalf("%s: expected a status explaining the denial", test.name)
+		}
+		if res.Result.Status != metav1.StatusFailure || res.Result.Reason != test.reason || res.Result.Code != test.code {
+			t.Errorf("%s: expected status %s with reason %s and code %d but got %+v", test.name, metav1.StatusFailure, test.reason, test.code, res.Result)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// podTemplatePaths are the JSON pointers to the pod templates of the workloads InjectManifest injects, by kind.
+// Pods themselves are injected at the root.
+var podTemplatePaths = map[string]string{
+	"Pod":         "",
+	"Deployment":  "/spec/template",
+	"ReplicaSet":  "/spec/template",
+	"StatefulSet": "/spec/template",
+	"DaemonSet":   "/spec/template",
+	"Job":         "/spec/template",
+	"CronJob":     "/spec/jobTemplate/spec/template",
+}
+
+// InjectManifest injects the pod, or the pod template of the workload, in the json manifest data like the webhook
+// would inject the pods created from it, and returns the patched manifest with the full names of the configs
+// injected. Other kinds, and pods that would not be injected, are returned as is, as are pods that could not be
+// injected unless the configs they request fail closed (see failurePolicy). Templates of workloads without a
+// namespace are injected as if in namespace.
+func (whsvr *WebhookServer) InjectManifest(data []byte, namespace string) ([]byte, string, error) {
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, "", err
+	}
+	path, ok := podTemplatePaths[object.Kind]
+	if !ok {
+		return data, "", nil
+	}
+	name := fmt.Sprintf("%s %s", object.Kind, object.Name)
+
+	template, withMetadata, err := podTemplate(data, path)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", name, err.Error())
+	}
+	// pods created from templates have no name yet, and are named when created, like by the webhook
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	if path == "" {
+		pod.Name = object.Name
+	}
+	pod.Namespace = object.Namespace
+	if pod.Namespace == "" {
+		pod.Namespace = namespace
+	}
+
+	injectionKey, err := whsvr.getSidecarConfigurationRequested(whsvr.IgnoredNamespaces, &pod.ObjectMeta)
+	if err == ErrRequestedSidecarNotFound {
+		requested := pod.Annotations[whsvr.requestAnnotationKey()]
+		return whsvr.injectManifestFailed(data, name, requested, fmt.Errorf("%s: %s", err.Error(), requested))
+	}
+	if err != nil {
+		glog.V(2).Infof("Not injecting %s: %v", name, err)
+		return data, "", nil
+	}
+	patch, _, err := whsvr.patchPod(pod, injectionKey)
+	if err != nil {
+		return whsvr.injectManifestFailed(data, name, injectionKey, err)
+	}
+
+	// the patch is relative to the pod, so it has to be moved to the template
+	if path != "" {
+		var ops []patchOperation
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, "", fmt.Errorf("%s: %s", name, err.Error())
+		}
+		for i := range ops {
+			ops[i].Path = path + ops[i].Path
+		}
+		if patch, err = json.Marshal(ops); err != nil {
+			return nil, "", fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	patched, err := applyPatch(withMetadata, patch)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return patched, injectionKey, nil
+}
+
+// injectManifestFailed handles the manifest data named name that could not be injected with the requested configs
+// because of err, like injectionFailed: with config.FailurePolicyFail it fails, otherwise it is returned as is
+func (whsvr *WebhookServer) injectManifestFailed(data []byte, name, requested string, err error) ([]byte, string, error) {
+	policy := whsvr.failurePolicy(requested)
+	if policy == config.FailurePolicyFail {
+		return nil, "", fmt.Errorf("%s: %s", name, err.Error())
+	}
+	glog.Warningf("Not injecting %s (failurePolicy=%s): %s", name, policy, err.Error())
+	return data, "", nil
+}
+
+// InjectManifests reads a stream of yaml or json manifests from r, injects them with InjectManifest, and writes
+// them to w as yaml documents. Empty documents are dropped; the fields of the others are sorted.
+func (whsvr *WebhookServer) InjectManifests(r io.Reader, w io.Writer, namespace string) error {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	first := true
+	for {
+		var doc json.RawMessage
+		if err := decoder.Decode(&doc); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(doc) == 0 || string(doc) == "null" {
+			continue
+		}
+
+		injected, injectionKey, err := whsvr.InjectManifest(doc, namespace)
+		if err != nil {
+			return err
+		}
+		if injectionKey != "" {
+			glog.V(1).Infof("Injected %s", injectionKey)
+		}
+		out, err := yaml.JSONToYAML(injected)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// podTemplate returns the pod template at the JSON pointer path of the manifest data, and data with an empty
+// metadata added to the template if it had none, so patches can add labels and annotations to it
+func podTemplate(data []byte, path string) (*corev1.PodTemplateSpec, []byte, error) {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, nil, err
+	}
+	fields := object
+	for _, key := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		if key == "" {
+			continue
+		}
+		next, ok := fields[key].(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("no pod template at %s", path)
+		}
+		fields = next
+	}
+	if _, ok := fields["metadata"].(map[string]interface{}); !ok {
+		fields["metadata"] = map[string]interface{}{}
+	}
+
+	templateData, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	var template corev1.PodTemplateSpec
+	if err := json.Unmarshal(templateData, &template); err != nil {
+		return nil, nil, err
+	}
+	if data, err = json.Marshal(object); err != nil {
+		return nil, nil, err
+	}
+	return &template, data, nil
+}
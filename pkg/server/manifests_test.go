@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+)
+
+func TestInjectManifests(t *testing.T) {
+	s := previewServer(t)
+
+	in, err := os.Open("test/fixtures/k8s/manifests/workloads.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	expected, err := ioutil.ReadFile("test/fixtures/k8s/manifests/workloads-injected.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := s.InjectManifests(in, &out, "default"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(expected) {
+		t.Errorf("expected injected manifests\n%s\nbut got\n%s", string(expected), out.String())
+	}
+}
+
+// TestInjectManifestMatchesPreview injects a Deployment, whose pod template must be patched like a pod would be
+func TestInjectManifestMatchesPreview(t *testing.T) {
+	s := previewServer(t)
+
+	deployment := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web"},"spec":{"template":` +
+		`{"metadata":{"annotations":{"injector.unittest.com/request":"volume-mounts"}},"spec":{"containers":[{"name":"web","image":"web:1.0"}]}}}}`
+	injected, injectionKey, err := s.InjectManifest([]byte(deployment), "unittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if injectionKey != "volume-mounts:latest" {
+		t.Errorf("expected volume-mounts:latest to be injected, but got %q", injectionKey)
+	}
+	template, _, err := podTemplate(injected, "/spec/template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := `{"apiVersion":"v1","kind":"Pod","metadata":{"annotations":{"injector.unittest.com/request":"volume-mounts"}},` +
+		`"spec":{"containers":[{"name":"web","image":"web:1.0"}]}}`
+	preview, err := s.Preview([]byte(pod), "unittest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(template.Spec.Containers) != len(preview.Pod.Spec.Containers) || len(template.Spec.Volumes) != len(preview.Pod.Spec.Volumes) {
+		t.Errorf("expected the template to be injected like the pod, but got %+v and %+v", template.Spec, preview.Pod.Spec)
+	}
+	for key, value := range preview.Pod.Annotations {
+		if template.Annotations[key] != value {
+			t.Errorf("expected the template to be annotated %s=%s like the pod, but got %v", key, value, template.Annotations)
+		}
+	}
+}
+
+func TestInjectManifestsErrors(t *testing.T) {
+	s := previewServer(t)
+	s.DefaultFailurePolicy = config.FailurePolicyFail
+
+	in, err := ioutil.ReadFile("test/fixtures/k8s/manifests/missing-config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.InjectManifests(bytes.NewReader(in), ioutil.Discard, "default")
+	expected := "Job migrate: Requested sidecar not found in configuration: does-not-exist"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q but got %v", expected, err)
+	}
+
+	// failing open, the manifest is written as is
+	s.DefaultFailurePolicy = config.FailurePolicyIgnore
+	var out bytes.Buffer
+	if err := s.InjectManifests(bytes.NewReader(in), &out, "default"); err != nil {
+		t.Fatalf("expected the manifest not to be injected, but got %v", err)
+	}
+	unchanged := `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+spec:
+  template:
+    metadata:
+      annotations:
+        injector.unittest.com/request: does-not-exist
+    spec:
+      containers:
+      - image: migrate:1.0
+        name: migrate
+      restartPolicy: Never
+`
+	if out.String() != unchanged {
+		t.Errorf("expected the manifest as is, but got\n%s", out.String())
+	}
+
+	err = s.InjectManifests(strings.NewReader("kind: Deployment\nmetadata:\n  name: broken\nspec:\n  template: []\n"), ioutil.Discard, "default")
+	expected = "Deployment broken: no pod template at /spec/template"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q but got %v", expected, err)
+	}
+}
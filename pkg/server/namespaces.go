@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultIgnoredNamespaces are the namespaces pods are never injected into, unless overridden
+var DefaultIgnoredNamespaces = []string{
+	metav1.NamespaceSystem,
+	metav1.NamespacePublic,
+}
+
+// NamespaceMatcher matches namespace names against a list of patterns. A pattern is either a literal
+// namespace name, a glob as understood by path.Match (i.e. "openshift-*"), or a regular expression
+// wrapped in slashes (i.e. "/^openshift-(infra|node)$/"). A nil NamespaceMatcher matches nothing.
+type NamespaceMatcher struct {
+	patterns []string
+	globs    []string
+	regexps  []*regexp.Regexp
+}
+
+// NewNamespaceMatcher parses patterns into a NamespaceMatcher
+func NewNamespaceMatcher(patterns []string) (*NamespaceMatcher, error) {
+	m := NamespaceMatcher{}
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if len(p) > 2 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile(p[1 : len(p)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid namespace regexp %s: %s", p, err.Error())
+			}
+			m.regexps = append(m.regexps, re)
+		} else {
+			// validate the glob now, path.Match only reports bad patterns when matching
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid namespace pattern %s: %s", p, err.Error())
+			}
+			m.globs = append(m.globs, p)
+		}
+		m.patterns = append(m.patterns, p)
+	}
+	return &m, nil
+}
+
+// Matches returns true if namespace matches any of the patterns
+func (m *NamespaceMatcher) Matches(namespace string) bool {
+	if m == nil {
+		return false
+	}
+	for _, g := range m.globs {
+		if ok, _ := path.Match(g, namespace); ok {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the patterns of the matcher, comma separated
+func (m *NamespaceMatcher) String() string {
+	if m == nil {
+		return ""
+	}
+	return strings.Join(m.patterns, ",")
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestNamespaceMatcher(t *testing.T) {
+	m, err := NewNamespaceMatcher([]string{"kube-system", "openshift-*", "/^team-(a|b)$/", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"kube-system":          true,
+		"kube-public":          false,
+		"openshift-monitoring": true,
+		"openshift":            false,
+		"team-a":               true,
+		"team-b":               true,
+		"team-c":               false,
+		"my-team-a":            false,
+		"":                     false,
+	}
+	for namespace, expected := range tests {
+		if m.Matches(namespace) != expected {
+			t.Errorf("expected Matches(%q) to be %v", namespace, expected)
+		}
+	}
+	if m.String() != "kube-system,openshift-*,/^team-(a|b)$/" {
+		t.Errorf("unexpected String() %s", m.String())
+	}
+
+	var nilMatcher *NamespaceMatcher
+	if nilMatcher.Matches("kube-system") {
+		t.Error("expected a nil NamespaceMatcher to match nothing")
+	}
+
+	for _, bad := range []string{"/team-(/", "team-["} {
+		if _, err := NewNamespaceMatcher([]string{bad}); err == nil {
+			t.Errorf("expected pattern %s to be rejected", bad)
+		}
+	}
+}
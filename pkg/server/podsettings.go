@@ -0,0 +1,209 @@
+package server
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// escapeJSONPointer escapes a map key for use in a JSON pointer, i.e. the path of a patch operation
+// (see RFC 6901)
+func escapeJSONPointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// setPodSettings patches the pod level settings of inj into the pod. What the pod sets itself always wins:
+// tolerations and imagePullSecrets are added to, nodeSelector, affinity, dnsConfig and securityContext only
+// get the keys and fields the pod does not set, and priorityClassName and shareProcessNamespace are only set
+// if the pod does not set them.
+func setPodSettings(pod *corev1.Pod, inj *config.InjectionConfig, basePath string) (patch []patchOperation, err error) {
+	patch = append(patch, addTolerations(pod.Spec.Tolerations, inj.Tolerations, path.Join(basePath, "tolerations"))...)
+	patch = append(patch, addNodeSelector(pod.Spec.NodeSelector, inj.NodeSelector, path.Join(basePath, "nodeSelector"))...)
+	if inj.Affinity != nil {
+		ops, err := addMissingFields(pod.Spec.Affinity, inj.Affinity, path.Join(basePath, "affinity"))
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, ops...)
+	}
+	patch = append(patch, setPriorityClassName(&pod.Spec, inj.PriorityClassName, basePath)...)
+	patch = append(patch, addDNSConfig(pod.Spec.DNSConfig, inj.DNSConfig, path.Join(basePath, "dnsConfig"))...)
+	patch = append(patch, addImagePullSecrets(pod.Spec.ImagePullSecrets, inj.ImagePullSecrets, path.Join(basePath, "imagePullSecrets"))...)
+	if inj.ShareProcessNamespace != nil && pod.Spec.ShareProcessNamespace == nil {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path.Join(basePath, "shareProcessNamespace"),
+			Value: *inj.ShareProcessNamespace,
+		})
+	}
+	if inj.SecurityContext != nil {
+		ops, err := addMissingFields(pod.Spec.SecurityContext, inj.SecurityContext, path.Join(basePath, "securityContext"))
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, ops...)
+	}
+	return patch, nil
+}
+
+func addTolerations(target, added []corev1.Toleration, basePath string) (patch []patchOperation) {
+	values := []interface{}{}
+	for _, add := range added {
+		// a toleration the pod already has would only be a duplicate. one tolerating the taint for a
+		// different time is a different toleration, like when configs are merged, and is added
+		if config.HasToleration(target, add) {
+			continue
+		}
+		values = append(values, add)
+	}
+	return addToList(basePath, len(target) == 0, values)
+}
+
+// addNodeSelector adds the keys of added the pod does not select on yet
+func addNodeSelector(target, added map[string]string, basePath string) (patch []patchOperation) {
+	if len(added) == 0 {
+		return nil
+	}
+	if target == nil {
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: added,
+		})
+	}
+	for _, key := range config.SortedKeys(added) {
+		if _, ok := target[key]; ok {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/" + escapeJSONPointer(key),
+			Value: added[key],
+		})
+	}
+	return patch
+}
+
+// addMissingFields adds the fields set in added that are not set in target, which are both structs (or
+// pointers to them) of the same type. If target sets no fields, like when it is nil, added is added as a whole.
+func addMissingFields(target, added interface{}, basePath string) (patch []patchOperation, err error) {
+	targetFields, err := config.JSONFields(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(targetFields) == 0 {
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: added,
+		}), nil
+	}
+	addedFields, err := config.JSONFields(added)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(addedFields))
+	for name := range addedFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := targetFields[name]; ok {
+			continue
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/" + escapeJSONPointer(name),
+			Value: addedFields[name],
+		})
+	}
+	return patch, nil
+}
+
+// setPriorityClassName sets the priorityClassName, if the pod does not set one. By the time we see the pod,
+// the Priority admission plugin already resolved its priority and preemptionPolicy from the default class, so
+// we drop them; the plugin resolves them again from our class when it is rerun after the webhooks (k8s >= 1.15).
+func setPriorityClassName(spec *corev1.PodSpec, added string, basePath string) (patch []patchOperation) {
+	if added == "" || spec.PriorityClassName != "" {
+		return nil
+	}
+	patch = append(patch, patchOperation{
+		Op:    "add",
+		Path:  path.Join(basePath, "priorityClassName"),
+		Value: added,
+	})
+	if spec.Priority != nil {
+		patch = append(patch, patchOperation{
+			Op:   "remove",
+			Path: path.Join(basePath, "priority"),
+		})
+	}
+	if spec.PreemptionPolicy != nil {
+		patch = append(patch, patchOperation{
+			Op:   "remove",
+			Path: path.Join(basePath, "preemptionPolicy"),
+		})
+	}
+	return patch
+}
+
+// addDNSConfig adds the nameservers, searches and options (by name) the pod does not have yet
+func addDNSConfig(target, added *corev1.PodDNSConfig, basePath string) (patch []patchOperation) {
+	if added == nil {
+		return nil
+	}
+	if target == nil {
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: added,
+		})
+	}
+	patch = append(patch, addStrings(target.Nameservers, added.Nameservers, path.Join(basePath, "nameservers"))...)
+	patch = append(patch, addStrings(target.Searches, added.Searches, path.Join(basePath, "searches"))...)
+
+	options := []interface{}{}
+	for _, add := range added.Options {
+		hasOption := false
+		for _, o := range target.Options {
+			if o.Name == add.Name {
+				hasOption = true
+				break
+			}
+		}
+		if !hasOption {
+			options = append(options, add)
+		}
+	}
+	return append(patch, addToList(path.Join(basePath, "options"), len(target.Options) == 0, options)...)
+}
+
+func addStrings(target, added []string, basePath string) (patch []patchOperation) {
+	values := []interface{}{}
+	for _, add := range added {
+		if !containsString(target, add) {
+			values = append(values, add)
+		}
+	}
+	return addToList(basePath, len(target) == 0, values)
+}
+
+func addImagePullSecrets(target, added []corev1.LocalObjectReference, basePath string) (patch []patchOperation) {
+	values := []interface{}{}
+	for _, add := range added {
+		hasSecret := false
+		for _, s := range target {
+			if s.Name == add.Name {
+				hasSecret = true
+				break
+			}
+		}
+		if !hasSecret {
+			values = append(values, add)
+		}
+	}
+	return addToList(basePath, len(target) == 0, values)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/pmezard/go-difflib/difflib"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// previewDefaultNamespace is the namespace of previewed pods that do not set one, like kubectl would
+	previewDefaultNamespace = "default"
+	// previewDiffContext is the number of unchanged lines shown around changes in Preview.Diff
+	previewDiffContext = 3
+	// previewMaxBodyBytes is the size of the largest pod manifest PreviewHandler previews. The API server
+	// rejects larger requests anyway.
+	previewMaxBodyBytes = 3 * 1024 * 1024
+)
+
+// Preview is what the webhook would do to a pod, without creating it
+type Preview struct {
+	// Requested is the full name of the InjectionConfig(s) injected into the pod, as a comma separated list
+	Requested string `json:"requested,omitempty"`
+	// Skipped is why the pod would not be injected, like "no_annotation" (see GetErrorReason)
+	Skipped string `json:"skipped,omitempty"`
+	// Message explains why the pod would not be injected
+	Message string `json:"message,omitempty"`
+	// Patch is the JSON patch the webhook would respond with
+	Patch json.RawMessage `json:"patch"`
+	// Pod is the pod with Patch applied
+	Pod *corev1.Pod `json:"pod"`
+	// Diff is a unified diff of the pod before and after Patch, as yaml
+	Diff string `json:"diff"`
+}
+
+// PreviewError is returned by Preview when the pod could not be injected, and would be rejected by configs
+// failing closed (see failurePolicy)
+type PreviewError struct {
+	// Reason is the reason reported in metrics, see GetErrorReason
+	Reason string
+	Err    error
+}
+
+func (e *PreviewError) Error() string {
+	return fmt.Sprintf("sidecar injection failed (%s): %s", e.Reason, e.Err.Error())
+}
+
+func (e *PreviewError) Unwrap() error {
+	return e.Err
+}
+
+// Preview injects the pod manifest in data (yaml or json) like the webhook would, and returns the patch and
+// the patched pod. Pods without a namespace are previewed in namespace, or "default". If requested is set, it
+// replaces the request annotation of the pod. Nothing is counted in metrics.
+func (whsvr *WebhookServer) Preview(data []byte, namespace, requested string) (*Preview, error) {
+	podJSON, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, &PreviewError{Reason: "unmarshal_error", Err: err}
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(podJSON, &pod); err != nil {
+		return nil, &PreviewError{Reason: "unmarshal_error", Err: err}
+	}
+	if pod.Kind != "" && pod.Kind != "Pod" {
+		return nil, &PreviewError{Reason: "unmarshal_error", Err: fmt.Errorf("expected a Pod, but got a %s", pod.Kind)}
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = namespace
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = previewDefaultNamespace
+	}
+	if requested != "" {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[whsvr.requestAnnotationKey()] = requested
+	}
+
+	preview := &Preview{Patch: json.RawMessage("[]"), Pod: &pod}
+	injectionKey, err := whsvr.getSidecarConfigurationRequested(whsvr.IgnoredNamespaces, &pod.ObjectMeta)
+	if err == ErrRequestedSidecarNotFound {
+		return nil, &PreviewError{Reason: GetErrorReason(err), Err: fmt.Errorf("%s: %s", err.Error(), pod.Annotations[whsvr.requestAnnotationKey()])}
+	}
+	if err != nil {
+		preview.Skipped = GetErrorReason(err)
+		preview.Message = err.Error()
+		return preview, nil
+	}
+	preview.Requested = injectionKey
+
+	patch, reason, err := whsvr.patchPod(&pod, injectionKey)
+	if err != nil {
+		return nil, &PreviewError{Reason: reason, Err: err}
+	}
+	preview.Patch = patch
+
+	// apply the patch to the pod as the API server would see it
+	original, err := json.Marshal(&pod)
+	if err != nil {
+		return nil, &PreviewError{Reason: "patching_error", Err: err}
+	}
+	patched, err := applyPatch(original, patch)
+	if err != nil {
+		return nil, &PreviewError{Reason: "patching_error", Err: err}
+	}
+	var patchedPod corev1.Pod
+	if err := json.Unmarshal(patched, &patchedPod); err != nil {
+		return nil, &PreviewError{Reason: "patching_error", Err: err}
+	}
+	preview.Pod = &patchedPod
+
+	before, err := yaml.Marshal(&pod)
+	if err != nil {
+		return nil, &PreviewError{Reason: "patching_error", Err: err}
+	}
+	after, err := yaml.Marshal(&patchedPod)
+	if err != nil {
+		return nil, &PreviewError{Reason: "patching_error", Err: err}
+	}
+	preview.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(before)),
+		B:        difflib.SplitLines(string(after)),
+		FromFile: "pod",
+		ToFile:   "injected pod",
+		Context:  previewDiffContext,
+	})
+	if err != nil {
+		return nil, &PreviewError{Reason: "patching_error", Err: err}
+	}
+	return preview, nil
+}
+
+// applyPatch applies the JSON patch to the json document doc
+func applyPatch(doc, patch []byte) ([]byte, error) {
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := decoded.Apply(doc)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply patch: %s", err.Error())
+	}
+	return patched, nil
+}
+
+// PreviewHandler handles pod manifests POSTed as yaml or json, and returns the Preview of their injection.
+// The optional "config" query parameter requests configs like the request annotation, and "namespace" sets the
+// namespace of pods that do not set one.
+func (whsvr *WebhookServer) PreviewHandler() http.Handler {
+	return instrumentHandler("preview", http.HandlerFunc(whsvr.previewHandler))
+}
+
+func (whsvr *WebhookServer) previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a pod manifest to preview its injection", http.StatusMethodNotAllowed)
+		return
+	}
+	var body []byte
+	if r.Body != nil {
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, previewMaxBodyBytes))
+		if err != nil && len(data) >= previewMaxBodyBytes {
+			http.Error(w, fmt.Sprintf("pod manifest larger than %d bytes", previewMaxBodyBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == nil {
+			body = data
+		}
+	}
+	if len(body) == 0 {
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	preview, err := whsvr.Preview(body, r.URL.Query().Get("namespace"), r.URL.Query().Get("config"))
+	if err != nil {
+		code := http.StatusInternalServerError
+		var previewErr *PreviewError
+		if errors.As(err, &previewErr) {
+			_, statusCode := failureStatus(previewErr.Reason)
+			code = int(statusCode)
+		}
+		glog.Infof("Unable to preview injection: %v", err)
+		http.Error(w, err.Error(), code)
+		return
+	}
+	resp, err := json.Marshal(preview)
+	if err != nil {
+		glog.Errorf("Can't encode preview: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
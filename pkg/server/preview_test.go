@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/nsf/jsondiff"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+var previewPod = `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: preview
+  annotations:
+    injector.unittest.com/request: sidecar-test
+spec:
+  containers:
+  - name: app
+    image: app:1.0
+`
+
+func previewServer(t *testing.T) *WebhookServer {
+	t.Helper()
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+	return &WebhookServer{
+		Config:     c,
+		Namespaces: testNamespaces,
+	}
+}
+
+// TestPreviewMatchesMutate previews the pods of the mutation tests, which must get the same patch as from mutate
+func TestPreviewMatchesMutate(t *testing.T) {
+	s := previewServer(t)
+	for _, test := range mutationTests {
+		if !test.patchExpected {
+			continue
+		}
+		reqFile := fmt.Sprintf("test/fixtures/k8s/admissioncontrol/request/%s.yaml", test.name)
+		resPatchFile := fmt.Sprintf("test/fixtures/k8s/admissioncontrol/patch/%s.json", test.name)
+		reqData, err := ioutil.ReadFile(reqFile)
+		if err != nil {
+			t.Fatalf("%s: unable to load AdmissionRequest object: %v", reqFile, err)
+		}
+		var req admissionv1.AdmissionRequest
+		if err := yaml.Unmarshal(reqData, &req); err != nil {
+			t.Fatalf("%s: unable to unmarshal AdmissionRequest yaml: %v", reqFile, err)
+		}
+
+		preview, err := s.Preview(req.Object.Raw, req.Namespace, "")
+		if err != nil {
+			t.Fatalf("%s: unable to preview: %v", reqFile, err)
+		}
+		expectedPatchData, err := ioutil.ReadFile(resPatchFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		difference, diffString := jsondiff.Compare(expectedPatchData, preview.Patch, &jsondiffopts)
+		if difference != jsondiff.FullMatch {
+			t.Fatalf("%s: previewed patch differed from %s (%s):\n%s", reqFile, resPatchFile, difference.String(), diffString)
+		}
+		if preview.Pod.Annotations[s.statusAnnotationKey()] != StatusInjected {
+			t.Errorf("%s: expected the previewed pod to be annotated %s=%s, but got %v", reqFile, s.statusAnnotationKey(), StatusInjected, preview.Pod.Annotations)
+		}
+		if !strings.HasPrefix(preview.Diff, "--- pod\n+++ injected pod\n@@ ") {
+			t.Errorf("%s: expected a unified diff, but got %q", reqFile, preview.Diff)
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	s := previewServer(t)
+
+	preview, err := s.Preview([]byte(previewPod), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Requested != "sidecar-test:latest" {
+		t.Errorf("expected sidecar-test:latest to be injected, but got %q", preview.Requested)
+	}
+	if preview.Pod.Namespace != "default" {
+		t.Errorf("expected the pod to be previewed in the default namespace, but got %q", preview.Pod.Namespace)
+	}
+	names := []string{}
+	for _, c := range preview.Pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	if strings.Join(names, ",") != "app,sidecar-nginx,another-sidecar" {
+		t.Errorf("expected the sidecars to be added after app, but got containers %v", names)
+	}
+	for _, expected := range []string{"+    name: sidecar-nginx\n", "+    injector.unittest.com/status: injected\n", " spec:\n"} {
+		if !strings.Contains(preview.Diff, expected) {
+			t.Errorf("expected the diff to contain %q, but got\n%s", expected, preview.Diff)
+		}
+	}
+
+	// the config parameter replaces the annotation
+	preview, err = s.Preview([]byte(previewPod), "unittest", "init-containers:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Requested != "init-containers:v2" || preview.Pod.Namespace != "unittest" {
+		t.Errorf("expected init-containers:v2 to be injected in namespace unittest, but got %q in %q", preview.Requested, preview.Pod.Namespace)
+	}
+
+	// skipped pods are returned as is
+	preview, err = s.Preview([]byte(strings.Replace(previewPod, "request: sidecar-test", "status: injected", 1)), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Skipped != "already_injected" || string(preview.Patch) != "[]" || preview.Diff != "" {
+		t.Errorf("expected the pod to be skipped as already injected, but got %+v", preview)
+	}
+
+	_, err = s.Preview([]byte(previewPod), "", "does-not-exist")
+	var previewErr *PreviewError
+	if !errors.As(err, &previewErr) || previewErr.Reason != "missing_config" {
+		t.Errorf("expected a missing_config PreviewError, but got %v", err)
+	}
+	_, err = s.Preview([]byte("kind: Deployment"), "", "")
+	if !errors.As(err, &previewErr) || previewErr.Reason != "unmarshal_error" {
+		t.Errorf("expected an unmarshal_error PreviewError, but got %v", err)
+	}
+}
+
+func TestPreviewHandler(t *testing.T) {
+	s := previewServer(t)
+	for name, test := range map[string]struct {
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		"yaml":           {method: http.MethodPost, target: "/preview", body: previewPod, code: http.StatusOK},
+		"missing config": {method: http.MethodPost, target: "/preview?config=does-not-exist", body: previewPod, code: http.StatusNotFound},
+		"empty body":     {method: http.MethodPost, target: "/preview", code: http.StatusBadRequest},
+		"not a pod":      {method: http.MethodPost, target: "/preview", body: "[]", code: http.StatusBadRequest},
+		"GET":            {method: http.MethodGet, target: "/preview", code: http.StatusMethodNotAllowed},
+		"too large":      {method: http.MethodPost, target: "/preview", body: previewPod + strings.Repeat("#", previewMaxBodyBytes), code: http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		s.previewHandler(w, httptest.NewRequest(test.method, test.target, bytes.NewBufferString(test.body)))
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d but got %d: %s", name, test.code, w.Code, w.Body.String())
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var preview Preview
+		if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+			t.Fatalf("%s: unable to unmarshal preview: %v", name, err)
+		}
+		if preview.Requested != "sidecar-test:latest" || preview.Pod == nil || preview.Diff == "" {
+			t.Errorf("%s: expected a preview of the injection of sidecar-test:latest, but got %+v", name, preview)
+		}
+	}
+}
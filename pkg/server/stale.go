@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// StalePodReasonConfigChanged indicates the InjectionConfig changed since the pod was injected
+	StalePodReasonConfigChanged = "ConfigChanged"
+	// StalePodReasonConfigNotFound indicates the InjectionConfig the pod was injected with is no longer loaded
+	StalePodReasonConfigNotFound = "ConfigNotFound"
+)
+
+// PodLister lists pods, i.e. from an informer cache
+type PodLister interface {
+	List(selector labels.Selector) ([]*corev1.Pod, error)
+}
+
+// StalePod is a pod injected with an InjectionConfig that changed since
+type StalePod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// InjectedConfig is the full name of the InjectionConfig(s) the pod was injected with
+	InjectedConfig string `json:"injectedConfig"`
+	// InjectedHash is the hash of the InjectionConfig as loaded when the pod was injected
+	InjectedHash string `json:"injectedHash"`
+	// CurrentHash is the hash of the currently loaded InjectionConfig, if it is still loaded
+	CurrentHash string `json:"currentHash,omitempty"`
+	// Reason is one of ConfigChanged or ConfigNotFound
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+
+	pod *corev1.Pod
+}
+
+func (whsvr *WebhookServer) injectedConfigAnnotationKey() string {
+	return whsvr.Config.AnnotationNamespace + "/injected-config"
+}
+
+func (whsvr *WebhookServer) injectedConfigHashAnnotationKey() string {
+	return whsvr.Config.AnnotationNamespace + "/injected-config-hash"
+}
+
+func (whsvr *WebhookServer) injectedConfigLoadedHashAnnotationKey() string {
+	return whsvr.Config.AnnotationNamespace + "/injected-config-loaded-hash"
+}
+
+// injectionConfigHash returns the hash of the InjectionConfigs named by injectionKey, as loaded and combined for
+// injection. Unlike the hash recorded by injectedConfigHashAnnotationKey, the configs are not rendered for a
+// pod, so all pods injected with the same configs record the same one.
+func (whsvr *WebhookServer) injectionConfigHash(injectionKey string) (string, error) {
+	ics := []*config.InjectionConfig{}
+	for _, key := range strings.Split(injectionKey, ",") {
+		ic, err := whsvr.Config.GetInjectionConfig(key)
+		if err != nil {
+			return "", err
+		}
+		ics = append(ics, ic)
+	}
+	combined, err := config.CombineInjectionConfigs(ics...)
+	if err != nil {
+		return "", err
+	}
+	return combined.Hash()
+}
+
+// StalePods returns the pods whose recorded InjectionConfig hash does not match the currently loaded
+// InjectionConfig, sorted by namespace and name. The hashes of the configs as loaded are compared, as the pods
+// they were rendered for may have changed since. Pods injected before these hashes were recorded are not
+// reported.
+func (whsvr *WebhookServer) StalePods() ([]StalePod, error) {
+	stale := []StalePod{}
+	if whsvr.Pods == nil {
+		return stale, nil
+	}
+	pods, err := whsvr.Pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	type currentHash struct {
+		hash string
+		err  error
+	}
+	// many pods share a config, so only hash each once
+	hashes := map[string]currentHash{}
+	for _, pod := range pods {
+		injected := pod.Annotations[whsvr.injectedConfigAnnotationKey()]
+		injectedHash := pod.Annotations[whsvr.injectedConfigLoadedHashAnnotationKey()]
+		if injected == "" || injectedHash == "" {
+			continue
+		}
+		current, ok := hashes[injected]
+		if !ok {
+			current.hash, current.err = whsvr.injectionConfigHash(injected)
+			hashes[injected] = current
+		}
+
+		s := StalePod{
+			Namespace:      pod.Namespace,
+			Name:           pod.Name,
+			InjectedConfig: injected,
+			InjectedHash:   injectedHash,
+			CurrentHash:    current.hash,
+			pod:            pod,
+		}
+		switch {
+		case current.err != nil:
+			s.Reason = StalePodReasonConfigNotFound
+			s.Message = current.err.Error()
+		case current.hash != injectedHash:
+			s.Reason = StalePodReasonConfigChanged
+		default:
+			continue
+		}
+		stale = append(stale, s)
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].Namespace != stale[j].Namespace {
+			return stale[i].Namespace < stale[j].Namespace
+		}
+		return stale[i].Name < stale[j].Name
+	})
+	return stale, nil
+}
+
+// StalePodsHandler handles requests for the pods injected with an outdated InjectionConfig
+func (whsvr *WebhookServer) StalePodsHandler() http.Handler {
+	return instrumentHandler("stalepods", http.HandlerFunc(whsvr.stalePodsHandler))
+}
+
+func (whsvr *WebhookServer) stalePodsHandler(w http.ResponseWriter, r *http.Request) {
+	if whsvr.Pods == nil {
+		http.Error(w, "pods are not watched, see --watch-pods", http.StatusNotImplemented)
+		return
+	}
+	stale, err := whsvr.StalePods()
+	if err != nil {
+		glog.Errorf("Can't list stale pods: %v", err)
+		http.Error(w, fmt.Sprintf("could not list stale pods: %v", err), http.StatusInternalServerError)
+		return
+	}
+	resp, err := json.Marshal(stale)
+	if err != nil {
+		glog.Errorf("Can't encode stale pods: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
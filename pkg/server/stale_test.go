@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type fakePodLister []*corev1.Pod
+
+func (f fakePodLister) List(selector labels.Selector) ([]*corev1.Pod, error) {
+	return f, nil
+}
+
+func injectedPod(name, injectedConfig, hash string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "unittest",
+			Name:        name,
+			Annotations: map[string]string{},
+		},
+	}
+	if injectedConfig != "" {
+		pod.Annotations["injector.unittest.com/injected-config"] = injectedConfig
+		pod.Annotations["injector.unittest.com/injected-config-hash"] = hash
+		pod.Annotations["injector.unittest.com/injected-config-loaded-hash"] = hash
+	}
+	return pod
+}
+
+func TestStalePods(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+	s := &WebhookServer{Config: c}
+
+	current, err := s.injectionConfigHash("env1:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined, err := s.injectionConfigHash("sidecar-test:latest,init-containers:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if combined == current {
+		t.Fatal("expected different configs to hash differently")
+	}
+	s.Pods = fakePodLister{
+		injectedPod("up-to-date", "env1:latest", current),
+		injectedPod("combined-up-to-date", "sidecar-test:latest,init-containers:v2", combined),
+		injectedPod("changed", "env1:latest", "outdated"),
+		injectedPod("removed", "removed:latest", "outdated"),
+		injectedPod("not-injected", "", ""),
+	}
+
+	stale, err := s.StalePods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 {
+		t.Fatalf("expected 2 stale pods but got %+v", stale)
+	}
+	if stale[0].Name != "changed" || stale[0].Reason != StalePodReasonConfigChanged || stale[0].CurrentHash != current {
+		t.Errorf("expected pod changed to be stale with reason %s and current hash %s but got %+v", StalePodReasonConfigChanged, current, stale[0])
+	}
+	if stale[1].Name != "removed" || stale[1].Reason != StalePodReasonConfigNotFound {
+		t.Errorf("expected pod removed to be stale with reason %s but got %+v", StalePodReasonConfigNotFound, stale[1])
+	}
+}
+
+func TestStalePodsTemplated(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+	s := &WebhookServer{Config: c}
+
+	// pods created by controllers have no name when they are admitted
+	manifest := `
+metadata:
+  generateName: web-
+  namespace: unittest
+  labels:
+    app: web
+  annotations:
+    injector.unittest.com/request: templated
+spec:
+  containers:
+  - name: web
+    image: web:1.0
+`
+	preview, err := s.Preview([]byte(manifest), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	injected := preview.Pod
+	loaded, err := s.injectionConfigHash("templated:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if injected.Annotations[s.injectedConfigLoadedHashAnnotationKey()] != loaded {
+		t.Fatalf("expected the pod to record the hash %s of the loaded config but got %v", loaded, injected.Annotations)
+	}
+	if injected.Annotations[s.injectedConfigHashAnnotationKey()] == loaded {
+		t.Fatalf("expected the pod to record the hash of the config as rendered for it, but got the loaded one")
+	}
+
+	// what the pod looks like now does not matter, only whether the loaded config changed
+	named := injected.DeepCopy()
+	named.Name = "web-abcde"
+	named.Labels["app"] = "api"
+	s.Pods = fakePodLister{named}
+	stale, err := s.StalePods()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 0 {
+		t.Fatalf("expected no stale pods but got %+v", stale)
+	}
+}
+
+func TestStalePodsHandlerWithoutPods(t *testing.T) {
+	s := &WebhookServer{Config: &config.Config{}}
+	rec := httptest.NewRecorder()
+	s.StalePodsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stalepods", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected status %d but got %d", http.StatusNotImplemented, rec.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config/watcher"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var (
+	validationCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "validations",
+			Help: "Count of validations of ConfigMaps and SidecarInjections holding InjectionConfigs",
+		},
+		[]string{"kind", "status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(validationCounter)
+}
+
+// ValidateHandler handles AdmissionReviews for ConfigMaps and SidecarInjections holding InjectionConfigs, and
+// rejects the ones that would fail to load, so mistakes are caught by kubectl apply
+func (whsvr *WebhookServer) ValidateHandler() http.Handler {
+	return instrumentHandler("validate", http.HandlerFunc(whsvr.validateHandler))
+}
+
+func (whsvr *WebhookServer) validateHandler(w http.ResponseWriter, r *http.Request) {
+	whsvr.serveAdmissionReview(w, r, whsvr.validate)
+}
+
+// NewConfigMapSelector returns the ConfigMapSelector of the ConfigMaps watched with the labels set. No labels
+// means no ConfigMaps are watched, so none are selected.
+func NewConfigMapSelector(set map[string]string) labels.Selector {
+	if len(set) == 0 {
+		return labels.Nothing()
+	}
+	return labels.SelectorFromSet(set)
+}
+
+// validate admits ConfigMaps and SidecarInjections whose InjectionConfigs load. Deletions, objects outside of
+// ConfigNamespace, and ConfigMaps not matched by ConfigMapSelector, are always admitted.
+func (whsvr *WebhookServer) validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	if req.Operation == admissionv1.Delete {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	if whsvr.ConfigNamespace != "" && req.Namespace != whsvr.ConfigNamespace {
+		glog.V(2).Infof("Admitting %s %s/%s, outside of the namespace watched for InjectionConfigs", req.Kind.Kind, req.Namespace, req.Name)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	var (
+		kind string
+		errs []string
+	)
+	switch {
+	case req.Kind.Group == "" && req.Kind.Kind == "ConfigMap":
+		kind = "ConfigMap"
+		var cm corev1.ConfigMap
+		if err := json.Unmarshal(req.Object.Raw, &cm); err != nil {
+			errs = []string{fmt.Sprintf("could not unmarshal ConfigMap: %s", err.Error())}
+			break
+		}
+		if whsvr.ConfigMapSelector != nil && !whsvr.ConfigMapSelector.Matches(labels.Set(cm.Labels)) {
+			glog.V(2).Infof("Admitting ConfigMap %s/%s, which is not watched for InjectionConfigs", req.Namespace, cm.Name)
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		}
+		errs = validateConfigMap(&cm)
+	case req.Kind.Group == watcher.SidecarInjectionGVR.Group && req.Kind.Kind == "SidecarInjection":
+		kind = "SidecarInjection"
+		var si unstructured.Unstructured
+		if err := si.UnmarshalJSON(req.Object.Raw); err != nil {
+			errs = []string{fmt.Sprintf("could not unmarshal SidecarInjection: %s", err.Error())}
+			break
+		}
+		errs = validateSidecarInjection(&si)
+	default:
+		glog.Errorf("Admitting %s %s/%s, which does not hold InjectionConfigs", req.Kind, req.Namespace, req.Name)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	if len(errs) == 0 {
+		glog.Infof("Admitting valid %s %s/%s", kind, req.Namespace, req.Name)
+		validationCounter.With(prometheus.Labels{"kind": kind, "status": "valid"}).Inc()
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	glog.Infof("Rejecting invalid %s %s/%s: %s", kind, req.Namespace, req.Name, strings.Join(errs, "; "))
+	validationCounter.With(prometheus.Labels{"kind": kind, "status": "invalid"}).Inc()
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: fmt.Sprintf("invalid InjectionConfig in %s %s: %s", kind, req.Name, strings.Join(errs, "; ")),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+// validateConfigMap returns why each item of cm is not a valid InjectionConfig, or why items conflict with
+// each other. Items are validated in order, so the errors are stable.
+func validateConfigMap(cm *corev1.ConfigMap) []string {
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	errs := []string{}
+	definedBy := map[string]string{}
+	for _, key := range keys {
+		// LoadInjectionConfig validates the config, see InjectionConfig.Validate
+		ic, err := config.LoadInjectionConfig(strings.NewReader(cm.Data[key]))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("data[%s]: %s", key, err.Error()))
+			continue
+		}
+		if other, ok := definedBy[ic.FullName()]; ok {
+			errs = append(errs, fmt.Sprintf("data[%s]: %s is already defined by data[%s]", key, ic.FullName(), other))
+			continue
+		}
+		definedBy[ic.FullName()] = key
+	}
+	return errs
+}
+
+// validateSidecarInjection returns why the spec of si is not a valid InjectionConfig
+func validateSidecarInjection(si *unstructured.Unstructured) []string {
+	if _, err := watcher.InjectionConfigFromSidecarInjection(si); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
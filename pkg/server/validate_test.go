@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type validationTest struct {
+	// name is the AdmissionRequest fixture in test/fixtures/k8s/validation/
+	name    string
+	allowed bool
+	message string
+}
+
+var validationTests = []validationTest{
+	{name: "configmap-valid", allowed: true},
+	{name: "configmap-unwatched", allowed: true},
+	{name: "configmap-delete", allowed: true},
+	{name: "configmap-other-namespace", allowed: true},
+	{name: "sidecarinjection-valid", allowed: true},
+	{name: "sidecarinjection-other-namespace", allowed: true},
+	{
+		name: "configmap-invalid",
+		message: `invalid InjectionConfig in ConfigMap sidecars: data[bad-version]: not a valid name or name:version format; ` +
+			`data[containers]: invalid injection config logger:latest: [` +
+			`containers[0].name: Invalid value: "Logger": a DNS-1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?'), ` +
+			`containers[1].image: Required value, ` +
+			`initContainers[1].name: Duplicate value: "shipper", ` +
+			`initContainers[1].volumeMounts[0].name: Not found: "logs"]; ` +
+			`data[logger]: logger:latest is already defined by data[duplicate]`,
+	},
+	{
+		name:    "sidecarinjection-invalid",
+		message: `invalid InjectionConfig in SidecarInjection logger: error parsing SidecarInjection logger into injection config: invalid injection config logger:latest: volumes[1].name: Duplicate value: "logs"`,
+	},
+}
+
+func TestValidate(t *testing.T) {
+	s := &WebhookServer{
+		Config:            &config.Config{},
+		ConfigMapSelector: NewConfigMapSelector(map[string]string{"app": "k8s-sidecar-injector"}),
+		ConfigNamespace:   "kube-system",
+	}
+
+	for _, test := range validationTests {
+		reqFile := fmt.Sprintf("test/fixtures/k8s/validation/%s.yaml", test.name)
+		res := s.validate(loadValidationRequest(t, reqFile))
+		if res.Allowed != test.allowed {
+			t.Fatalf("%s: expected AdmissionResponse.Allowed=%v but got %v (%+v)", reqFile, test.allowed, res.Allowed, res.Result)
+		}
+		if test.allowed {
+			continue
+		}
+		if res.Result == nil {
+			t.Fatalf("%s: expected a status explaining the rejection", reqFile)
+		}
+		if res.Result.Reason != metav1.StatusReasonInvalid || res.Result.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected reason %s and code %d but got %+v", reqFile, metav1.StatusReasonInvalid, http.StatusUnprocessableEntity, res.Result)
+		}
+		if res.Result.Message != test.message {
+			t.Errorf("%s: expected message\n%s\nbut got\n%s", reqFile, test.message, res.Result.Message)
+		}
+	}
+}
+
+func TestValidateWithoutConfigMapLabels(t *testing.T) {
+	// no ConfigMaps are watched without labels, but SidecarInjections still are
+	s := &WebhookServer{
+		Config:            &config.Config{},
+		ConfigMapSelector: NewConfigMapSelector(map[string]string{}),
+		ConfigNamespace:   "kube-system",
+	}
+	for name, allowed := range map[string]bool{
+		"configmap-invalid":        true,
+		"sidecarinjection-invalid": false,
+	} {
+		reqFile := fmt.Sprintf("test/fixtures/k8s/validation/%s.yaml", name)
+		if res := s.validate(loadValidationRequest(t, reqFile)); res.Allowed != allowed {
+			t.Errorf("%s: expected AdmissionResponse.Allowed=%v but got %v (%+v)", reqFile, allowed, res.Allowed, res.Result)
+		}
+	}
+}
+
+func loadValidationRequest(t *testing.T, reqFile string) *admissionv1.AdmissionRequest {
+	reqData, err := ioutil.ReadFile(reqFile)
+	if err != nil {
+		t.Fatalf("%s: unable to load AdmissionRequest object: %v", reqFile, err)
+	}
+	var req admissionv1.AdmissionRequest
+	if err := yaml.Unmarshal(reqData, &req); err != nil {
+		t.Fatalf("%s: unable to unmarshal AdmissionRequest yaml: %v", reqFile, err)
+	}
+	return &req
+}
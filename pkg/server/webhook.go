@@ -6,16 +6,21 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config/watcher"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 )
@@ -78,15 +83,40 @@ var (
 	)
 )
 
-var ignoredNamespaces = []string{
-	metav1.NamespaceSystem,
-	metav1.NamespacePublic,
+// NamespaceLabeler looks up the labels of a Namespace
+type NamespaceLabeler interface {
+	NamespaceLabels(namespace string) (map[string]string, error)
+}
+
+// ConfigMapStatusReporter reports the load status of each watched ConfigMap
+type ConfigMapStatusReporter interface {
+	ConfigMapStatuses() []watcher.ConfigMapStatus
 }
 
 // WebhookServer is a server that handles mutating admission webhooks
 type WebhookServer struct {
 	Config *config.Config
 	Server *http.Server
+	// Namespaces is used to evaluate the namespaceSelector of InjectionConfigs, and the opt-out label
+	// of namespaces. If nil, configs with a namespaceSelector never select any pods.
+	Namespaces NamespaceLabeler
+	// IgnoredNamespaces are never injected into
+	IgnoredNamespaces *NamespaceMatcher
+	// ConfigMaps is reported by ConfigMapsHandler. If nil, no ConfigMaps are reported.
+	ConfigMaps ConfigMapStatusReporter
+	// Pods is used to find pods injected with an outdated InjectionConfig. If nil, StalePods finds none.
+	Pods PodLister
+	// Drift is reported by DriftHandler. If nil, no drift is reported.
+	Drift *DriftReconciler
+	// ConfigMapSelector selects the ConfigMaps ValidateHandler validates; others are admitted as is. If nil, all
+	// ConfigMaps are validated. See NewConfigMapSelector.
+	ConfigMapSelector labels.Selector
+	// ConfigNamespace is the namespace watched for ConfigMaps and SidecarInjections. ValidateHandler admits the
+	// ones in other namespaces as is. If empty, all namespaces are validated.
+	ConfigNamespace string
+	// DefaultFailurePolicy applies to requested configs that do not set a failurePolicy, or are not loaded.
+	// If empty, pods are admitted without injection (see config.FailurePolicyIgnore).
+	DefaultFailurePolicy string
 }
 
 type patchOperation struct {
@@ -98,6 +128,9 @@ type patchOperation struct {
 func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
 	_ = admissionregistrationv1beta1.AddToScheme(runtimeScheme)
+	// we accept both versions of AdmissionReview, and respond in kind
+	_ = admissionv1.AddToScheme(runtimeScheme)
+	_ = v1beta1.AddToScheme(runtimeScheme)
 	// defaulting with webhooks:
 	// https://github.com/kubernetes/kubernetes/issues/57982
 	_ = corev1.AddToScheme(runtimeScheme)
@@ -134,15 +167,19 @@ func (whsvr *WebhookServer) requestAnnotationKey() string {
 	return whsvr.Config.AnnotationNamespace + "/request"
 }
 
+// namespaces labelled with disabledLabelKey()=true opt out of injection
+func (whsvr *WebhookServer) disabledLabelKey() string {
+	return whsvr.Config.AnnotationNamespace + "/disabled"
+}
+
 // Check whether the target resoured need to be mutated. returns the canonicalized full name of the injection config
-// if found, or an error if not.
-func (whsvr *WebhookServer) getSidecarConfigurationRequested(ignoredList []string, metadata *metav1.ObjectMeta) (string, error) {
+// if found, or an error if not. When several configs are requested, their full names are returned as a
+// comma separated list, in the order they were requested.
+func (whsvr *WebhookServer) getSidecarConfigurationRequested(ignored *NamespaceMatcher, metadata *metav1.ObjectMeta) (string, error) {
 	// skip special kubernetes system namespaces
-	for _, namespace := range ignoredList {
-		if metadata.Namespace == namespace {
-			glog.Infof("Pod %s/%s should skip injection due to ignored namespace", metadata.Name, metadata.Namespace)
-			return "", ErrSkipIgnoredNamespace
-		}
+	if ignored.Matches(metadata.Namespace) {
+		glog.Infof("Pod %s/%s should skip injection due to ignored namespace", metadata.Namespace, metadata.Name)
+		return "", ErrSkipIgnoredNamespace
 	}
 
 	annotations := metadata.GetAnnotations()
@@ -162,75 +199,261 @@ func (whsvr *WebhookServer) getSidecarConfigurationRequested(ignoredList []strin
 	// determine whether to perform mutation based on annotation for the target resource
 	requestedInjection, ok := annotations[requestAnnotationKey]
 	if !ok {
-		glog.Infof("Pod %s/%s annotation %s is missing, skipping injection", metadata.Namespace, metadata.Name, requestAnnotationKey)
-		return "", ErrMissingRequestAnnotation
+		// without an annotation, fall back to any configs that select this pod automatically
+		selected := whsvr.getSidecarConfigurationsSelected(metadata)
+		if len(selected) == 0 {
+			glog.Infof("Pod %s/%s annotation %s is missing, skipping injection", metadata.Namespace, metadata.Name, requestAnnotationKey)
+			return "", ErrMissingRequestAnnotation
+		}
+		// namespaces are only looked up once a config could be injected
+		if whsvr.namespaceOptedOut(metadata) {
+			return "", ErrSkipIgnoredNamespace
+		}
+		injectionKey := strings.Join(selected, ",")
+		glog.Infof("Pod %s/%s is selected by sidecar config %s", metadata.Namespace, metadata.Name, injectionKey)
+		return injectionKey, nil
 	}
-	ic, err := whsvr.Config.GetInjectionConfig(requestedInjection)
-	if err != nil {
-		glog.Errorf("Mutation policy for pod %s/%s: %v", metadata.Namespace, metadata.Name, err)
+	if whsvr.namespaceOptedOut(metadata) {
+		return "", ErrSkipIgnoredNamespace
+	}
+
+	// the annotation may request several configs, i.e. "logging:v2,tracing"
+	fullNames := []string{}
+	for _, requested := range strings.Split(requestedInjection, ",") {
+		requested = strings.TrimSpace(requested)
+		if requested == "" {
+			continue
+		}
+		ic, err := whsvr.Config.GetInjectionConfig(requested)
+		if err != nil {
+			glog.Errorf("Mutation policy for pod %s/%s: %v", metadata.Namespace, metadata.Name, err)
+			return "", ErrRequestedSidecarNotFound
+		}
+		if !containsString(fullNames, ic.FullName()) {
+			fullNames = append(fullNames, ic.FullName())
+		}
+	}
+	if len(fullNames) == 0 {
+		glog.Errorf("Mutation policy for pod %s/%s: annotation %s=%q does not request any sidecar config", metadata.Namespace, metadata.Name, requestAnnotationKey, requestedInjection)
 		return "", ErrRequestedSidecarNotFound
 	}
 
-	glog.Infof("Pod %s/%s annotation %s=%s requesting sidecar config %s", metadata.Namespace, metadata.Name, requestAnnotationKey, requestedInjection, ic.FullName())
-	return ic.FullName(), nil
+	injectionKey := strings.Join(fullNames, ",")
+	glog.Infof("Pod %s/%s annotation %s=%s requesting sidecar config %s", metadata.Namespace, metadata.Name, requestAnnotationKey, requestedInjection, injectionKey)
+	return injectionKey, nil
+}
+
+// namespaceOptedOut returns true if the namespace of the pod is labelled disabledLabelKey()=true. Namespaces that
+// cannot be looked up did not opt out.
+func (whsvr *WebhookServer) namespaceOptedOut(metadata *metav1.ObjectMeta) bool {
+	if whsvr.Namespaces == nil {
+		return false
+	}
+	namespaceLabels, err := whsvr.Namespaces.NamespaceLabels(metadata.Namespace)
+	if err != nil {
+		// dont block pods on namespace lookups; we just cant honor the opt-out
+		glog.Errorf("Unable to look up labels of namespace %s for pod %s/%s: %v", metadata.Namespace, metadata.Namespace, metadata.Name, err)
+		return false
+	}
+	if strings.ToLower(namespaceLabels[whsvr.disabledLabelKey()]) != "true" {
+		return false
+	}
+	glog.Infof("Pod %s/%s should skip injection due to namespace label %s=%s", metadata.Namespace, metadata.Name, whsvr.disabledLabelKey(), namespaceLabels[whsvr.disabledLabelKey()])
+	return true
+}
+
+// getSidecarConfigurationsSelected returns the full names of all InjectionConfigs whose namespaceSelector and
+// podSelector select the pod. Configs whose selectors cannot be evaluated are skipped.
+func (whsvr *WebhookServer) getSidecarConfigurationsSelected(metadata *metav1.ObjectMeta) []string {
+	selected := []string{}
+	var (
+		namespaceLabels map[string]string
+		namespaceErr    error
+		namespaceLoaded bool
+	)
+	for _, ic := range whsvr.Config.SelectorInjectionConfigs() {
+		ok, err := ic.SelectsPod(metadata.Labels)
+		if err != nil {
+			glog.Errorf("Unable to evaluate podSelector of %s: %v", ic.FullName(), err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if ic.NamespaceSelector != nil {
+			if whsvr.Namespaces == nil {
+				glog.Errorf("Unable to evaluate namespaceSelector of %s: no namespace lookup configured", ic.FullName())
+				continue
+			}
+			// only look up the namespace once, and only if we need to
+			if !namespaceLoaded {
+				namespaceLabels, namespaceErr = whsvr.Namespaces.NamespaceLabels(metadata.Namespace)
+				namespaceLoaded = true
+			}
+			if namespaceErr != nil {
+				glog.Errorf("Unable to evaluate namespaceSelector of %s for pod %s/%s: %v", ic.FullName(), metadata.Namespace, metadata.Name, namespaceErr)
+				continue
+			}
+			ok, err = ic.SelectsNamespace(namespaceLabels)
+			if err != nil {
+				glog.Errorf("Unable to evaluate namespaceSelector of %s: %v", ic.FullName(), err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		selected = append(selected, ic.FullName())
+	}
+	return selected
+}
+
+// getInjectionConfig resolves a key returned by getSidecarConfigurationRequested into a single InjectionConfig,
+// rendering templated configs for the pod, and combining the requested configs if more than one was requested.
+func (whsvr *WebhookServer) getInjectionConfig(injectionKey string, pod *corev1.Pod) (*config.InjectionConfig, error) {
+	ics := []*config.InjectionConfig{}
+	for _, key := range strings.Split(injectionKey, ",") {
+		ic, err := whsvr.Config.GetInjectionConfig(key)
+		if err != nil {
+			return nil, err
+		}
+		ic, err = ic.Render(pod)
+		if err != nil {
+			return nil, err
+		}
+		ics = append(ics, ic)
+	}
+	return config.CombineInjectionConfigs(ics...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
 }
 
-func setEnvironment(target []corev1.Container, addedEnv []corev1.EnvVar, basePath string) (patch []patchOperation) {
-	var value interface{}
+// setEnvironment patches the env of each target container with addedEnv, according to policy (see
+// config.PolicyAddOnly, config.PolicyOverride and config.PolicyRemove)
+func setEnvironment(target []corev1.Container, addedEnv []corev1.EnvVar, policy string, basePath string) (patch []patchOperation) {
 	for containerIndex, container := range target {
 		// for each container in the spec, determine if we want to patch with any env vars
-		first := len(container.Env) == 0
+		var edits listEdits
 		for _, add := range addedEnv {
-			path := fmt.Sprintf("%s/%d/env", basePath, containerIndex)
-			hasKey := false
-			// make sure we dont override any existing env vars; we only add, dont replace
-			for _, origEnv := range container.Env {
+			index := -1
+			for i, origEnv := range container.Env {
 				if origEnv.Name == add.Name {
-					hasKey = true
+					index = i
 					break
 				}
 			}
-			if !hasKey {
-				// make a patch
-				value = add
-				if first {
-					first = false
-					value = []corev1.EnvVar{add}
-				} else {
-					path = path + "/-"
-				}
-				patch = append(patch, patchOperation{
-					Op:    "add",
-					Path:  path,
-					Value: value,
-				})
-			}
+			edits.record(policy, index, add, index >= 0 && reflect.DeepEqual(container.Env[index], add))
 		}
+		patch = append(patch, edits.patch(fmt.Sprintf("%s/%d/env", basePath, containerIndex), len(container.Env) == 0)...)
 	}
 	return patch
 }
 
-func addContainers(target, added []corev1.Container, basePath string) (patch []patchOperation) {
-	first := len(target) == 0
-	var value interface{}
-	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
-			value = []corev1.Container{add}
-		} else {
-			path = path + "/-"
+// listEdits collects the changes to a keyed list of a container, like its env
+type listEdits struct {
+	replaced []indexedValue
+	removed  []int
+	added    []interface{}
+}
+
+type indexedValue struct {
+	index int
+	value interface{}
+}
+
+// record determines the change policy makes for value, whose entry in the list is at index, or -1 if the
+// list has no such entry. unchanged is whether that entry is already equal to value.
+func (e *listEdits) record(policy string, index int, value interface{}, unchanged bool) {
+	switch policy {
+	case config.PolicyRemove:
+		if index >= 0 && !containsInt(e.removed, index) {
+			e.removed = append(e.removed, index)
+		}
+	case config.PolicyOverride:
+		if index < 0 {
+			e.added = append(e.added, value)
+		} else if !unchanged {
+			e.replaced = append(e.replaced, indexedValue{index: index, value: value})
 		}
+	default:
+		// make sure we dont override any existing entries; we only add, dont replace
+		if index < 0 {
+			e.added = append(e.added, value)
+		}
+	}
+}
+
+// patch returns the patch applying the edits to the list at path. Removals are by index, so they happen
+// after the replacements and from the highest index down, so that no operation shifts the index of
+// another; additions are appended last. empty is whether the list has no entries yet, in which case it
+// may not exist at all.
+func (e *listEdits) patch(path string, empty bool) (patch []patchOperation) {
+	for _, r := range e.replaced {
 		patch = append(patch, patchOperation{
-			Op:    "add",
-			Path:  path,
-			Value: value,
+			Op:    "replace",
+			Path:  fmt.Sprintf("%s/%d", path, r.index),
+			Value: r.value,
+		})
+	}
+	removed := append([]int{}, e.removed...)
+	sort.Sort(sort.Reverse(sort.IntSlice(removed)))
+	for _, index := range removed {
+		patch = append(patch, patchOperation{
+			Op:   "remove",
+			Path: fmt.Sprintf("%s/%d", path, index),
 		})
 	}
+	return append(patch, addToList(path, empty, e.added)...)
+}
+
+// addToList returns the patch appending added to the list at path. empty is whether the list has no entries
+// yet, in which case it may not exist at all, so the first addition creates it.
+func addToList(path string, empty bool, added []interface{}) (patch []patchOperation) {
+	for _, add := range added {
+		if empty {
+			empty = false
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path,
+				Value: []interface{}{add},
+			})
+		} else {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  path + "/-",
+				Value: add,
+			})
+		}
+	}
 	return patch
 }
 
+func containsInt(list []int, i int) bool {
+	for _, x := range list {
+		if x == i {
+			return true
+		}
+	}
+	return false
+}
+
+func addContainers(target, added []corev1.Container, basePath string) (patch []patchOperation) {
+	values := make([]interface{}, 0, len(added))
+	for _, add := range added {
+		values = append(values, add)
+	}
+	return addToList(basePath, len(target) == 0, values)
+}
+
 func setHostNetwork(target bool, addedHostNetwork bool, basePath string) (patch []patchOperation) {
 	if addedHostNetwork == true {
 		patch = append(patch, patchOperation{
@@ -264,75 +487,46 @@ func addVolumes(existing, added []corev1.Volume, basePath string) (patch []patch
 		}
 		return false
 	}
+	values := []interface{}{}
 	for _, add := range added {
-		value := add
-
 		if hasVolume(existing, add) {
 			continue
 		}
-		patch = append(patch, patchOperation{
-			Op:    "add",
-			Path:  basePath + "/-",
-			Value: value,
-		})
+		values = append(values, add)
 	}
-	return patch
+	// pods without volumes have no list to append to, so the first volume creates it
+	return addToList(basePath, len(existing) == 0, values)
 }
 
-func addVolumeMounts(target []corev1.Container, addedVolumeMounts []corev1.VolumeMount, basePath string) (patch []patchOperation) {
-	var value interface{}
+// addVolumeMounts patches the volume mounts of each target container with addedVolumeMounts, according to
+// policy (see config.PolicyAddOnly, config.PolicyOverride and config.PolicyRemove). Overriding or removing
+// also matches existing mounts by mountPath, as a container cannot mount two volumes at the same path.
+func addVolumeMounts(target []corev1.Container, addedVolumeMounts []corev1.VolumeMount, policy string, basePath string) (patch []patchOperation) {
 	for containerIndex, container := range target {
 		// for each container in the spec, determine if we want to patch with any volume mounts
-		first := len(container.VolumeMounts) == 0
+		var edits listEdits
 		for _, add := range addedVolumeMounts {
-			path := fmt.Sprintf("%s/%d/volumeMounts", basePath, containerIndex)
-			hasKey := false
-			// make sure we dont override any existing volume mounts; we only add, dont replace
-			for _, origVolumeMount := range container.VolumeMounts {
-				if origVolumeMount.Name == add.Name {
-					hasKey = true
+			index := -1
+			for i, origVolumeMount := range container.VolumeMounts {
+				if origVolumeMount.Name == add.Name ||
+					(policy != config.PolicyAddOnly && add.MountPath != "" && origVolumeMount.MountPath == add.MountPath) {
+					index = i
 					break
 				}
 			}
-			if !hasKey {
-				// make a patch
-				value = add
-				if first {
-					first = false
-					value = []corev1.VolumeMount{add}
-				} else {
-					path = path + "/-"
-				}
-				patch = append(patch, patchOperation{
-					Op:    "add",
-					Path:  path,
-					Value: value,
-				})
-			}
+			edits.record(policy, index, add, index >= 0 && reflect.DeepEqual(container.VolumeMounts[index], add))
 		}
+		patch = append(patch, edits.patch(fmt.Sprintf("%s/%d/volumeMounts", basePath, containerIndex), len(container.VolumeMounts) == 0)...)
 	}
 	return patch
 }
 
 func addHostAliases(target, added []corev1.HostAlias, basePath string) (patch []patchOperation) {
-	first := len(target) == 0
-	var value interface{}
+	values := make([]interface{}, 0, len(added))
 	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
-			value = []corev1.HostAlias{add}
-		} else {
-			path = path + "/-"
-		}
-		patch = append(patch, patchOperation{
-			Op:    "add",
-			Path:  path,
-			Value: value,
-		})
+		values = append(values, add)
 	}
-	return patch
+	return addToList(basePath, len(target) == 0, values)
 }
 
 func setServiceAccount(initContainers []corev1.Container, containers []corev1.Container, sa string, basePath string) (patch []patchOperation) {
@@ -348,9 +542,10 @@ func setServiceAccount(initContainers []corev1.Container, containers []corev1.Co
 	//  - name: default-token-wlfz2
 	//    readOnly: true
 	//    mountPath: /var/run/secrets/kubernetes.io/serviceaccount
+	// mounts are removed from the highest index down, so removing one does not shift the next
 	for icIndex, ic := range initContainers {
-		for vmIndex, vm := range ic.VolumeMounts {
-			if vm.MountPath == serviceAccountTokenMountPath {
+		for vmIndex := len(ic.VolumeMounts) - 1; vmIndex >= 0; vmIndex-- {
+			if ic.VolumeMounts[vmIndex].MountPath == serviceAccountTokenMountPath {
 				patch = append(patch, patchOperation{
 					Op:   "remove",
 					Path: fmt.Sprintf("%s/initContainers/%d/volumeMounts/%d", basePath, icIndex, vmIndex),
@@ -359,8 +554,8 @@ func setServiceAccount(initContainers []corev1.Container, containers []corev1.Co
 		}
 	}
 	for cIndex, c := range containers {
-		for vmIndex, vm := range c.VolumeMounts {
-			if vm.MountPath == serviceAccountTokenMountPath {
+		for vmIndex := len(c.VolumeMounts) - 1; vmIndex >= 0; vmIndex-- {
+			if c.VolumeMounts[vmIndex].MountPath == serviceAccountTokenMountPath {
 				patch = append(patch, patchOperation{
 					Op:   "remove",
 					Path: fmt.Sprintf("%s/containers/%d/volumeMounts/%d", basePath, cIndex, vmIndex),
@@ -371,6 +566,22 @@ func setServiceAccount(initContainers []corev1.Container, containers []corev1.Co
 	return patch
 }
 
+// withoutServiceAccountTokenMounts returns copies of containers without the volume mounts setServiceAccount
+// removes, i.e. the containers as any later operations of the patch see them
+func withoutServiceAccountTokenMounts(containers []corev1.Container) []corev1.Container {
+	out := make([]corev1.Container, len(containers))
+	for i, c := range containers {
+		out[i] = c
+		out[i].VolumeMounts = nil
+		for _, vm := range c.VolumeMounts {
+			if vm.MountPath != serviceAccountTokenMountPath {
+				out[i].VolumeMounts = append(out[i].VolumeMounts, vm)
+			}
+		}
+	}
+	return out
+}
+
 // for containers, add any env vars that are not already defined in the Env list.
 // this does _not_ return patches; this is intended to be used only on containers defined
 // in the injection config, so the resources do not exist yet in the k8s api (thus no patch needed)
@@ -422,24 +633,78 @@ func mergeVolumeMounts(volumeMounts []corev1.VolumeMount, containers []corev1.Co
 	return mutatedContainers
 }
 
-func updateAnnotations(target map[string]string, added map[string]string) (patch []patchOperation) {
-	for key, value := range added {
-		keyEscaped := strings.Replace(key, "/", "~1", -1)
+// updateMetadata patches the labels and annotations of the pod with the ones of inj, according to its
+// metadata policy (see config.PolicyAddOnly, config.PolicyOverride and config.PolicyRemove), and sets
+// injectorAnnotations, which always overwrite what the pod or the config set
+func updateMetadata(meta *metav1.ObjectMeta, inj *config.InjectionConfig, injectorAnnotations map[string]string) (patch []patchOperation) {
+	labels, removedLabels := applyMetadataPolicy(meta.Labels, inj.Labels, inj.GetMetadataPolicy())
+	annotations, removedAnnotations := applyMetadataPolicy(meta.Annotations, inj.Annotations, inj.GetMetadataPolicy())
+	for key, value := range injectorAnnotations {
+		annotations[key] = value
+	}
+
+	patch = append(patch, removeKeys(removedLabels, "/metadata/labels")...)
+	patch = append(patch, updateMap(meta.Labels, labels, "/metadata/labels")...)
+	for _, key := range removedAnnotations {
+		if _, ok := injectorAnnotations[key]; !ok {
+			patch = append(patch, removeKeys([]string{key}, "/metadata/annotations")...)
+		}
+	}
+	patch = append(patch, updateMap(meta.Annotations, annotations, "/metadata/annotations")...)
+	return patch
+}
 
-		if target == nil || target[key] == "" {
-			target = map[string]string{}
-			patch = append(patch, patchOperation{
-				Op:    "add",
-				Path:  path.Join("/metadata/annotations", keyEscaped),
-				Value: value,
-			})
-		} else {
-			patch = append(patch, patchOperation{
-				Op:    "replace",
-				Path:  path.Join("/metadata/annotations", keyEscaped),
-				Value: value,
-			})
+// applyMetadataPolicy returns the keys of added to set on target, and the keys of target to remove
+func applyMetadataPolicy(target, added map[string]string, policy string) (set map[string]string, removed []string) {
+	set = map[string]string{}
+	for _, key := range config.SortedKeys(added) {
+		_, exists := target[key]
+		switch {
+		case policy == config.PolicyRemove:
+			if exists {
+				removed = append(removed, key)
+			}
+		case policy == config.PolicyOverride || !exists:
+			set[key] = added[key]
+		}
+	}
+	return set, removed
+}
+
+// updateMap sets the keys of added on the map at basePath, of which target is the current value
+func updateMap(target map[string]string, added map[string]string, basePath string) (patch []patchOperation) {
+	if len(added) == 0 {
+		return nil
+	}
+	if target == nil {
+		// the pod has no such map at all (i.e. it was selected without a request annotation), so
+		// there is no map to add keys to yet
+		return append(patch, patchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: added,
+		})
+	}
+	for _, key := range config.SortedKeys(added) {
+		op := "add"
+		if _, ok := target[key]; ok {
+			op = "replace"
 		}
+		patch = append(patch, patchOperation{
+			Op:    op,
+			Path:  basePath + "/" + escapeJSONPointer(key),
+			Value: added[key],
+		})
+	}
+	return patch
+}
+
+func removeKeys(keys []string, basePath string) (patch []patchOperation) {
+	for _, key := range keys {
+		patch = append(patch, patchOperation{
+			Op:   "remove",
+			Path: basePath + "/" + escapeJSONPointer(key),
+		})
 	}
 	return patch
 }
@@ -450,31 +715,44 @@ func createPatch(pod *corev1.Pod, inj *config.InjectionConfig, annotations map[s
 
 	// be sure to inject the serviceAccountName before adding any volumeMounts, because we must prune out any existing
 	// volumeMounts that were added to support the default service account. Because this removal is by index, we splice
-	// them out before appending new volumes at the end.
+	// them out before appending new volumes at the end, and patch the remaining mounts as they are after the removal.
+	initContainers, containers := pod.Spec.InitContainers, pod.Spec.Containers
 	if inj.ServiceAccountName != "" && (pod.Spec.ServiceAccountName == "" || pod.Spec.ServiceAccountName == "default") {
 		// only override the serviceaccount name if not set in the pod spec
 		patch = append(patch, setServiceAccount(pod.Spec.InitContainers, pod.Spec.Containers, inj.ServiceAccountName, "/spec")...)
+		initContainers = withoutServiceAccountTokenMounts(initContainers)
+		containers = withoutServiceAccountTokenMounts(containers)
+	}
+	envPolicy, volumeMountPolicy := inj.GetEnvPolicy(), inj.GetVolumeMountPolicy()
+	// policies only apply to the containers of the pod. injected containers get the env vars and volume mounts
+	// they do not define themselves, unless they are meant to be removed.
+	injectedEnv, injectedVolumeMounts := inj.Environment, inj.VolumeMounts
+	if envPolicy == config.PolicyRemove {
+		injectedEnv = nil
+	}
+	if volumeMountPolicy == config.PolicyRemove {
+		injectedVolumeMounts = nil
 	}
 
 	{ // initcontainer injections
 		// patch all existing InitContainers with the VolumeMounts+EnvVars, and add injected initcontainers
-		patch = append(patch, setEnvironment(pod.Spec.InitContainers, inj.Environment, "/spec/initContainers")...)
-		patch = append(patch, addVolumeMounts(pod.Spec.InitContainers, inj.VolumeMounts, "/spec/initContainers")...)
+		patch = append(patch, setEnvironment(initContainers, inj.Environment, envPolicy, "/spec/initContainers")...)
+		patch = append(patch, addVolumeMounts(initContainers, inj.VolumeMounts, volumeMountPolicy, "/spec/initContainers")...)
 		// next, make sure any injected init containers in our config get the EnvVars and VolumeMounts injected
 		// this mutates inj.InitContainers with our environment vars
-		mutatedInjectedInitContainers := mergeEnvVars(inj.Environment, inj.InitContainers)
-		mutatedInjectedInitContainers = mergeVolumeMounts(inj.VolumeMounts, mutatedInjectedInitContainers)
+		mutatedInjectedInitContainers := mergeEnvVars(injectedEnv, inj.InitContainers)
+		mutatedInjectedInitContainers = mergeVolumeMounts(injectedVolumeMounts, mutatedInjectedInitContainers)
 		patch = append(patch, addContainers(pod.Spec.InitContainers, mutatedInjectedInitContainers, "/spec/initContainers")...)
 	}
 
 	{ // container injections
 		// now, patch all existing containers with the env vars and volume mounts, and add injected containers
-		patch = append(patch, setEnvironment(pod.Spec.Containers, inj.Environment, "/spec/containers")...)
-		patch = append(patch, addVolumeMounts(pod.Spec.Containers, inj.VolumeMounts, "/spec/containers")...)
+		patch = append(patch, setEnvironment(containers, inj.Environment, envPolicy, "/spec/containers")...)
+		patch = append(patch, addVolumeMounts(containers, inj.VolumeMounts, volumeMountPolicy, "/spec/containers")...)
 		// first, make sure any injected containers in our config get the EnvVars and VolumeMounts injected
 		// this mutates inj.Containers with our environment vars
-		mutatedInjectedContainers := mergeEnvVars(inj.Environment, inj.Containers)
-		mutatedInjectedContainers = mergeVolumeMounts(inj.VolumeMounts, mutatedInjectedContainers)
+		mutatedInjectedContainers := mergeEnvVars(injectedEnv, inj.Containers)
+		mutatedInjectedContainers = mergeVolumeMounts(injectedVolumeMounts, mutatedInjectedContainers)
 		patch = append(patch, addContainers(pod.Spec.Containers, mutatedInjectedContainers, "/spec/containers")...)
 	}
 
@@ -484,74 +762,116 @@ func createPatch(pod *corev1.Pod, inj *config.InjectionConfig, annotations map[s
 		patch = append(patch, addVolumes(pod.Spec.Volumes, inj.Volumes, "/spec/volumes")...)
 	}
 
+	{ // pod level settings, like tolerations and the securityContext
+		podSettingsPatch, err := setPodSettings(pod, inj, "/spec")
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, podSettingsPatch...)
+	}
+
 	{ // now, set hostNetwork,hostPID
 		patch = append(patch, setHostNetwork(pod.Spec.HostNetwork, inj.HostNetwork, "/spec/hostNetwork")...)
 		patch = append(patch, setHostPID(pod.Spec.HostPID, inj.HostPID, "/spec/hostPID")...)
 	}
 
-	// last but not least, set annotations
-	patch = append(patch, updateAnnotations(pod.Annotations, annotations)...)
+	// last but not least, set labels and annotations
+	patch = append(patch, updateMetadata(&pod.ObjectMeta, inj, annotations)...)
 	return json.Marshal(patch)
 }
 
+// patchPod returns the JSON patch injecting the InjectionConfigs named by injectionKey (as returned by
+// getSidecarConfigurationRequested) into pod. If it fails, the reason reported in metrics is returned too.
+func (whsvr *WebhookServer) patchPod(pod *corev1.Pod, injectionKey string) ([]byte, string, error) {
+	injectionConfig, err := whsvr.getInjectionConfig(injectionKey, pod)
+	if err != nil {
+		reason := GetErrorReason(err)
+		if reason == "unknown_error" {
+			reason = "missing_config"
+		}
+		return nil, reason, err
+	}
+
+	// the rendered config tells what was injected, and the loaded one whether it changed since (see StalePods)
+	hash, err := injectionConfig.Hash()
+	if err != nil {
+		return nil, "patching_error", err
+	}
+	loadedHash, err := whsvr.injectionConfigHash(injectionKey)
+	if err != nil {
+		return nil, "patching_error", err
+	}
+	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
+	// configs that are not rendered are the loaded ones, so default a copy to keep their hash
+	injectionConfig = injectionConfig.DeepCopy()
+	applyDefaultsWorkaround(injectionConfig.Containers, injectionConfig.Volumes)
+	annotations := map[string]string{}
+	annotations[whsvr.statusAnnotationKey()] = StatusInjected
+	// record what was injected, so pods can be found once their config changes (see StalePods)
+	annotations[whsvr.injectedConfigAnnotationKey()] = injectionConfig.FullName()
+	annotations[whsvr.injectedConfigHashAnnotationKey()] = hash
+	annotations[whsvr.injectedConfigLoadedHashAnnotationKey()] = loadedHash
+	patchBytes, err := createPatch(pod, injectionConfig, annotations)
+	if err != nil {
+		return nil, "patching_error", err
+	}
+	return patchBytes, "", nil
+}
+
 // main mutation process
-func (whsvr *WebhookServer) mutate(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+func (whsvr *WebhookServer) mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		glog.Errorf("Could not unmarshal raw object: %v", err)
-		injectionCounter.With(prometheus.Labels{"status": "error", "reason": "unmarshal_error", "requested": ""}).Inc()
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
+		// we cannot tell what was requested, so only the default policy applies
+		return injectionFailed(whsvr.failurePolicy(""), "", "unmarshal_error", "error", err)
+	}
+
+	// pods created by controllers do not have their namespace set yet, so use the namespace of the request
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
 	}
 
 	glog.Infof("AdmissionReview for Kind=%s, Namespace=%s Name=%s (%s) UID=%s patchOperation=%s UserInfo=%s",
 		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
 
 	// determine whether to perform mutation
-	injectionKey, err := whsvr.getSidecarConfigurationRequested(ignoredNamespaces, &pod.ObjectMeta)
+	injectionKey, err := whsvr.getSidecarConfigurationRequested(whsvr.IgnoredNamespaces, &pod.ObjectMeta)
+	if err == ErrRequestedSidecarNotFound {
+		requested := pod.Annotations[whsvr.requestAnnotationKey()]
+		policy := whsvr.failurePolicy(requested)
+		glog.Infof("Requested sidecar config %q of %s/%s not found (failurePolicy=%s)", requested, pod.Namespace, pod.Name, policy)
+		// the annotation is not a metric label, as anything can be requested
+		return injectionFailed(policy, injectionKey, GetErrorReason(err), "skipped", fmt.Errorf("%s: %s", err.Error(), requested))
+	}
 	if err != nil {
 		glog.Infof("Skipping mutation of %s/%s: %v", pod.Namespace, pod.Name, err)
 		reason := GetErrorReason(err)
 		injectionCounter.With(prometheus.Labels{"status": "skipped", "reason": reason, "requested": injectionKey}).Inc()
-		return &v1beta1.AdmissionResponse{
+		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
+	policy := whsvr.failurePolicy(injectionKey)
 
-	injectionConfig, err := whsvr.Config.GetInjectionConfig(injectionKey)
-	if err != nil {
-		glog.Errorf("Error getting injection config %s, permitting launch of pod with no sidecar injected: %s", injectionConfig, err.Error())
-		// dont prevent pods from launching! just return allowed
-		injectionCounter.With(prometheus.Labels{"status": "skipped", "reason": "missing_config", "requested": injectionKey}).Inc()
-		return &v1beta1.AdmissionResponse{
-			Allowed: true,
-		}
-	}
-
-	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
-	applyDefaultsWorkaround(injectionConfig.Containers, injectionConfig.Volumes)
-	annotations := map[string]string{}
-	annotations[whsvr.statusAnnotationKey()] = StatusInjected
-	patchBytes, err := createPatch(&pod, injectionConfig, annotations)
+	patchBytes, reason, err := whsvr.patchPod(&pod, injectionKey)
 	if err != nil {
-		injectionCounter.With(prometheus.Labels{"status": "error", "reason": "patching_error", "requested": injectionKey}).Inc()
-		return &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+		glog.Errorf("Error patching pod %s/%s with injection config %s (failurePolicy=%s): %s", pod.Namespace, pod.Name, injectionKey, policy, err.Error())
+		// configs that cannot be loaded are skipped, patches that cannot be created are errors
+		status := "skipped"
+		if reason == "patching_error" {
+			status = "error"
 		}
+		return injectionFailed(policy, injectionKey, reason, status, err)
 	}
 
 	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
 	injectionCounter.With(prometheus.Labels{"status": "success", "reason": "all_groovy", "requested": injectionKey}).Inc()
-	return &v1beta1.AdmissionResponse{
+	return &admissionv1.AdmissionResponse{
 		Allowed: true,
 		Patch:   patchBytes,
-		PatchType: func() *v1beta1.PatchType {
-			pt := v1beta1.PatchTypeJSONPatch
+		PatchType: func() *admissionv1.PatchType {
+			pt := admissionv1.PatchTypeJSONPatch
 			return &pt
 		}(),
 	}
@@ -572,11 +892,39 @@ func (whsvr *WebhookServer) MutateHandler() http.Handler {
 	return instrumentHandler("mutate", http.HandlerFunc(whsvr.mutateHandler))
 }
 
+// ConfigMapsHandler returns the load status of each watched ConfigMap
+func (whsvr *WebhookServer) ConfigMapsHandler() http.Handler {
+	return instrumentHandler("configmaps", http.HandlerFunc(whsvr.configMapsHandler))
+}
+
+func (whsvr *WebhookServer) configMapsHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := []watcher.ConfigMapStatus{}
+	if whsvr.ConfigMaps != nil {
+		statuses = whsvr.ConfigMaps.ConfigMapStatuses()
+	}
+	resp, err := json.Marshal(statuses)
+	if err != nil {
+		glog.Errorf("Can't encode ConfigMap statuses: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+	}
+}
+
 func (whsvr *WebhookServer) healthHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "d|-_-|b 🦄")
 }
 
 func (whsvr *WebhookServer) mutateHandler(w http.ResponseWriter, r *http.Request) {
+	whsvr.serveAdmissionReview(w, r, whsvr.mutate)
+}
+
+// serveAdmissionReview decodes the AdmissionReview in the body of r, and answers it with the response of
+// review, in the AdmissionReview version it was sent
+func (whsvr *WebhookServer) serveAdmissionReview(w http.ResponseWriter, r *http.Request, review func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -597,33 +945,36 @@ func (whsvr *WebhookServer) mutateHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+	var admissionResponse *admissionv1.AdmissionResponse
+	req, gvk, err := decodeAdmissionReview(body)
+	if err != nil {
 		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
+		admissionResponse = &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
 		}
-	} else {
-		admissionResponse = whsvr.mutate(ar.Request)
-	}
-
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+	} else if req == nil {
+		glog.Errorf("AdmissionReview %s is missing a request", gvk)
+		admissionResponse = &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: "AdmissionReview is missing a request",
+			},
 		}
+	} else {
+		admissionResponse = review(req)
+		admissionResponse.UID = req.UID
 	}
 
-	resp, err := json.Marshal(admissionReview)
+	// answer in the same AdmissionReview version that we were sent
+	resp, err := encodeAdmissionReview(gvk, admissionResponse)
 	if err != nil {
 		glog.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
 	glog.Infof("Ready to write reponse ...")
+	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(resp); err != nil {
 		glog.Errorf("Can't write response: %v", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
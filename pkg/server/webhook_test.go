@@ -1,20 +1,28 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/ghodss/yaml"
 	"github.com/nsf/jsondiff" // for json diffing patches
 	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config"
+	"github.com/tumblr/k8s-sidecar-injector/internal/pkg/config/watcher"
 	_ "github.com/tumblr/k8s-sidecar-injector/internal/pkg/testing"
-	"k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 var (
@@ -35,8 +43,21 @@ var (
 	obj7v3           = "test/fixtures/k8s/object7-badrequestformat.yaml"
 	ignoredNamespace = "test/fixtures/k8s/ignored-namespace-pod.yaml"
 	badSidecar       = "test/fixtures/k8s/bad-sidecar.yaml"
+	obj8             = "test/fixtures/k8s/object8-multiple.yaml"
+	obj8Missing      = "test/fixtures/k8s/object8-multiple-missing.yaml"
+	obj9             = "test/fixtures/k8s/object9-selected.yaml"
+	obj9OtherNS      = "test/fixtures/k8s/object9-not-selected-namespace.yaml"
+	obj10Glob        = "test/fixtures/k8s/object10-ignored-glob.yaml"
+	obj10OptedOut    = "test/fixtures/k8s/object10-opted-out.yaml"
 
-	testIgnoredNamespaces = []string{"ignore-me"}
+	testIgnoredNamespaces, _ = NewNamespaceMatcher([]string{"ignore-me", "openshift-*", "/^kube-.*$/"})
+
+	// labels of the namespaces pods in our fixtures live in
+	testNamespaces = fakeNamespaceLabeler{
+		"unittest":  {},
+		"selected":  {"team": "injectable"},
+		"opted-out": {"injector.unittest.com/disabled": "true"},
+	}
 
 	// tests to check config loading of sidecars
 	configTests = []expectedSidecarConfiguration{
@@ -53,6 +74,12 @@ var (
 		{configuration: obj7v3, expectedSidecar: "", expectedError: ErrRequestedSidecarNotFound},
 		{configuration: ignoredNamespace, expectedSidecar: "", expectedError: ErrSkipIgnoredNamespace},
 		{configuration: badSidecar, expectedSidecar: "", expectedError: ErrRequestedSidecarNotFound},
+		{configuration: obj8, expectedSidecar: "sidecar-test:latest,init-containers:v2"},
+		{configuration: obj8Missing, expectedSidecar: "", expectedError: ErrRequestedSidecarNotFound},
+		{configuration: obj9, expectedSidecar: "selector-injected:latest"},
+		{configuration: obj9OtherNS, expectedSidecar: "", expectedError: ErrMissingRequestAnnotation},
+		{configuration: obj10Glob, expectedSidecar: "", expectedError: ErrSkipIgnoredNamespace},
+		{configuration: obj10OptedOut, expectedSidecar: "", expectedError: ErrSkipIgnoredNamespace},
 	}
 
 	// tests to check the mutate() function for correct operation
@@ -60,12 +87,32 @@ var (
 		{name: "missing-sidecar-config", allowed: true, patchExpected: false},
 		{name: "sidecar-test-1", allowed: true, patchExpected: true},
 		{name: "env-override", allowed: true, patchExpected: true},
+		{name: "env-policy-override", allowed: true, patchExpected: true},
+		{name: "volume-mount-policy-remove", allowed: true, patchExpected: true},
 		{name: "service-account", allowed: true, patchExpected: true},
 		{name: "service-account-already-set", allowed: true, patchExpected: true},
 		{name: "service-account-set-default", allowed: true, patchExpected: true},
 		{name: "service-account-default-token", allowed: true, patchExpected: true},
 		{name: "volumetest", allowed: true, patchExpected: true},
 		{name: "volumetest-existingvolume", allowed: true, patchExpected: true},
+		{name: "multiple-sidecars", allowed: true, patchExpected: true},
+		{name: "multiple-sidecars-conflict", allowed: true, patchExpected: false},
+		{name: "selector", allowed: true, patchExpected: true},
+		{name: "templated", allowed: true, patchExpected: true},
+		{name: "pod-settings", allowed: true, patchExpected: true},
+		{name: "pod-settings-existing", allowed: true, patchExpected: true},
+		{name: "pod-settings-priority", allowed: true, patchExpected: true},
+		{name: "metadata", allowed: true, patchExpected: true},
+		{name: "metadata-override", allowed: true, patchExpected: true},
+		{name: "metadata-remove", allowed: true, patchExpected: true},
+		{name: "audit-logger", allowed: true, patchExpected: true},
+		{name: "failure-policy-missing", allowed: false, patchExpected: false},
+	}
+
+	// tests to check the mutate handler answers AdmissionReviews in the version they were sent
+	reviewTests = []reviewTest{
+		{name: "v1", apiVersion: "admission.k8s.io/v1", patch: "sidecar-test-1"},
+		{name: "v1beta1", apiVersion: "admission.k8s.io/v1beta1", patch: "sidecar-test-1"},
 	}
 	sidecarConfigs, _           = filepath.Glob(path.Join(sidecars, "*.yaml"))
 	expectedNumInjectionConfigs = len(sidecarConfigs)
@@ -79,12 +126,44 @@ type expectedSidecarConfiguration struct {
 
 type mutationTest struct {
 	// name is a file relative to test/fixtures/k8s/admissioncontrol/request/ ending in .yaml
-	//  which is the v1beta1.AdmissionRequest object passed to mutate
+	//  which is the admissionv1.AdmissionRequest object passed to mutate
 	name          string
 	allowed       bool
 	patchExpected bool
 }
 
+// fakeNamespaceLabeler maps namespace names to their labels
+type fakeNamespaceLabeler map[string]map[string]string
+
+func (f fakeNamespaceLabeler) NamespaceLabels(namespace string) (map[string]string, error) {
+	l, ok := f[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace %s not found", namespace)
+	}
+	return l, nil
+}
+
+// countingNamespaceLabeler counts the lookups of a NamespaceLabeler
+type countingNamespaceLabeler struct {
+	NamespaceLabeler
+	lookups int
+}
+
+func (c *countingNamespaceLabeler) NamespaceLabels(namespace string) (map[string]string, error) {
+	c.lookups++
+	return c.NamespaceLabeler.NamespaceLabels(namespace)
+}
+
+type reviewTest struct {
+	// name is a file relative to test/fixtures/k8s/admissioncontrol/review/ ending in .yaml
+	//  which is the full AdmissionReview object POSTed to the mutate handler
+	name string
+	// apiVersion is the expected apiVersion of the AdmissionReview response
+	apiVersion string
+	// patch is a file relative to test/fixtures/k8s/admissioncontrol/patch/ ending in .json
+	patch string
+}
+
 func TestLoadConfig(t *testing.T) {
 	c, err := config.LoadConfigDirectory(sidecars)
 	if err != nil {
@@ -103,6 +182,7 @@ func TestLoadConfig(t *testing.T) {
 		Server: &http.Server{
 			Addr: ":6969",
 		},
+		Namespaces: testNamespaces,
 	}
 
 	for _, test := range configTests {
@@ -126,6 +206,78 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
+func TestNamespaceLookups(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+	namespaces := &countingNamespaceLabeler{NamespaceLabeler: testNamespaces}
+	s := &WebhookServer{Config: c, Namespaces: namespaces}
+
+	tests := []struct {
+		configuration string
+		lookups       int
+	}{
+		// nothing could be injected, so the namespace is not looked up
+		{configuration: obj3Missing, lookups: 0},
+		{configuration: obj4, lookups: 0},
+		{configuration: ignoredNamespace, lookups: 0},
+		{configuration: obj1, lookups: 1},
+		{configuration: obj10OptedOut, lookups: 1},
+	}
+	for _, test := range tests {
+		data, err := ioutil.ReadFile(test.configuration)
+		if err != nil {
+			t.Fatalf("unable to load object metadata yaml: %v", err)
+		}
+		var obj *metav1.ObjectMeta
+		if err := yaml.Unmarshal(data, &obj); err != nil {
+			t.Fatalf("unable to unmarshal object metadata yaml: %v", err)
+		}
+		namespaces.lookups = 0
+		s.getSidecarConfigurationRequested(testIgnoredNamespaces, obj)
+		if namespaces.lookups != test.lookups {
+			t.Errorf("%s: expected %d namespace lookups but got %d", test.configuration, test.lookups, namespaces.lookups)
+		}
+	}
+}
+
+func TestNamespaceOptOutFirstRequest(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "opted-out",
+			Labels: testNamespaces["opted-out"],
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	namespaces := watcher.NewNamespaceCache(client.CoreV1(), 0)
+	go namespaces.Watch(ctx)
+	// like main, requests are only served once namespaces are cached
+	if !namespaces.WaitForSync(ctx) {
+		t.Fatal("timed out waiting for the Namespace cache to sync")
+	}
+	s := &WebhookServer{Config: c, Namespaces: namespaces}
+
+	data, err := ioutil.ReadFile(obj10OptedOut)
+	if err != nil {
+		t.Fatalf("unable to load object metadata yaml: %v", err)
+	}
+	var obj *metav1.ObjectMeta
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		t.Fatalf("unable to unmarshal object metadata yaml: %v", err)
+	}
+	if _, err := s.getSidecarConfigurationRequested(testIgnoredNamespaces, obj); err != ErrSkipIgnoredNamespace {
+		t.Fatalf("expected the first pod of an opted out namespace to be skipped with %v but got %v", ErrSkipIgnoredNamespace, err)
+	}
+}
+
 func TestMutation(t *testing.T) {
 	c, err := config.LoadConfigDirectory(sidecars)
 	if err != nil {
@@ -139,11 +291,12 @@ func TestMutation(t *testing.T) {
 		Server: &http.Server{
 			Addr: ":6969",
 		},
+		Namespaces: testNamespaces,
 	}
 
 	for _, test := range mutationTests {
 		// now, try to perform the mutation on the k8s object
-		var req v1beta1.AdmissionRequest
+		var req admissionv1.AdmissionRequest
 		reqFile := fmt.Sprintf("test/fixtures/k8s/admissioncontrol/request/%s.yaml", test.name)
 		resPatchFile := fmt.Sprintf("test/fixtures/k8s/admissioncontrol/patch/%s.json", test.name)
 		// load the AdmissionRequest object
@@ -184,7 +337,152 @@ func TestMutation(t *testing.T) {
 				t.Errorf("Actual patch JSON: %s", string(resPatch))
 				t.Fatalf("received AdmissionResponse.patch field differed from expected with %s (%s) (actual on left, expected on right):\n%s", resPatchFile, difference.String(), diffString)
 			}
+			// the API server rejects pods whose patch does not apply, like appends to lists the pod does not have
+			if _, err := applyPatch(req.Object.Raw, resPatch); err != nil {
+				t.Fatalf("%s: patch does not apply to the pod: %v", reqFile, err)
+			}
 		}
 
 	}
 }
+
+func TestMutateHandlerAdmissionReviewVersions(t *testing.T) {
+	c, err := config.LoadConfigDirectory(sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AnnotationNamespace = "injector.unittest.com"
+
+	s := &WebhookServer{
+		Config: c,
+		Server: &http.Server{
+			Addr: ":6969",
+		},
+		Namespaces: testNamespaces,
+	}
+
+	for _, test := range reviewTests {
+		reviewFile := fmt.Sprintf("test/fixtures/k8s/admissioncontrol/review/%s.yaml", test.name)
+		resPatchFile := fmt.Sprintf("test/fixtures/k8s/admissioncontrol/patch/%s.json", test.patch)
+		reviewData, err := ioutil.ReadFile(reviewFile)
+		if err != nil {
+			t.Fatalf("%s: unable to load AdmissionReview object: %v", reviewFile, err)
+		}
+		body, err := yaml.YAMLToJSON(reviewData)
+		if err != nil {
+			t.Fatalf("%s: unable to convert AdmissionReview yaml to json: %v", reviewFile, err)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.mutateHandler(w, r)
+
+		// both AdmissionReview versions share the same wire format, so we can inspect either using v1 types
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+			t.Fatalf("%s: unable to unmarshal AdmissionReview response: %v", reviewFile, err)
+		}
+		if review.APIVersion != test.apiVersion {
+			t.Fatalf("%s: expected response apiVersion %s but got %s", reviewFile, test.apiVersion, review.APIVersion)
+		}
+		if review.Kind != "AdmissionReview" {
+			t.Fatalf("%s: expected response kind AdmissionReview but got %s", reviewFile, review.Kind)
+		}
+		if review.Response == nil {
+			t.Fatalf("%s: expected a response in the AdmissionReview", reviewFile)
+		}
+		if review.Response.UID != "0df28fbd-5f5f-11e8-bc74-36e6bb280816" {
+			t.Fatalf("%s: expected response UID to match the request, but got %s", reviewFile, review.Response.UID)
+		}
+		if !review.Response.Allowed {
+			t.Fatalf("%s: expected AdmissionResponse.Allowed=true", reviewFile)
+		}
+
+		expectedPatchData, err := ioutil.ReadFile(resPatchFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		difference, diffString := jsondiff.Compare(expectedPatchData, review.Response.Patch, &jsondiffopts)
+		if difference != jsondiff.FullMatch {
+			t.Errorf("Actual patch JSON: %s", string(review.Response.Patch))
+			t.Fatalf("received AdmissionResponse.patch field differed from expected with %s (%s) (actual on left, expected on right):\n%s", resPatchFile, difference.String(), diffString)
+		}
+	}
+}
+
+type fakeConfigMapStatusReporter []watcher.ConfigMapStatus
+
+func (f fakeConfigMapStatusReporter) ConfigMapStatuses() []watcher.ConfigMapStatus {
+	return f
+}
+
+func TestConfigMapsHandler(t *testing.T) {
+	for name, test := range map[string]struct {
+		reporter ConfigMapStatusReporter
+		expected string
+	}{
+		"no watcher": {
+			reporter: nil,
+			expected: `[]`,
+		},
+		"broken configmap": {
+			reporter: fakeConfigMapStatusReporter{
+				{
+					Namespace:                    "default",
+					Name:                         "team-a",
+					ResourceVersion:              "2",
+					Error:                        "not a valid name or name:version format",
+					InjectionConfigs:             []string{"env1:latest"},
+					LastKnownGoodResourceVersion: "1",
+				},
+			},
+			expected: `[{"namespace":"default","name":"team-a","resourceVersion":"2","loaded":false,"error":"not a valid name or name:version format","injectionConfigs":["env1:latest"],"lastKnownGoodResourceVersion":"1","lastTransitionTime":"0001-01-01T00:00:00Z"}]`,
+		},
+	} {
+		s := &WebhookServer{ConfigMaps: test.reporter}
+		w := httptest.NewRecorder()
+		s.configMapsHandler(w, httptest.NewRequest(http.MethodGet, "/configmaps", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200 but got %d", name, w.Code)
+		}
+		if w.Body.String() != test.expected {
+			t.Errorf("%s: expected %s but got %s", name, test.expected, w.Body.String())
+		}
+	}
+}
+
+func TestAddTolerations(t *testing.T) {
+	seconds, otherSeconds := int64(30), int64(60)
+	target := []corev1.Toleration{
+		{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "agents", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "node.kubernetes.io/unreachable", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute, TolerationSeconds: &seconds},
+	}
+	added := []corev1.Toleration{
+		target[0],
+		{Key: "node.kubernetes.io/unreachable", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute, TolerationSeconds: &otherSeconds},
+	}
+	// tolerations are equal like when configs are merged: tolerating a taint for longer is a different toleration
+	patch := addTolerations(target, added, "/spec/tolerations")
+	if len(patch) != 1 || patch[0].Path != "/spec/tolerations/-" || patch[0].Value.(corev1.Toleration).TolerationSeconds != &otherSeconds {
+		t.Errorf("expected only the toleration with other tolerationSeconds to be added, but got %+v", patch)
+	}
+}
+
+func TestAddVolumes(t *testing.T) {
+	logs := corev1.Volume{Name: "logs"}
+	config := corev1.Volume{Name: "config"}
+
+	// JSON patches cannot append to a list that does not exist, so the first volume of a pod creates it
+	patch := addVolumes(nil, []corev1.Volume{logs, config}, "/spec/volumes")
+	if len(patch) != 2 || patch[0].Path != "/spec/volumes" || !reflect.DeepEqual(patch[0].Value, []interface{}{logs}) ||
+		patch[1].Path != "/spec/volumes/-" || !reflect.DeepEqual(patch[1].Value, config) {
+		t.Errorf("expected the volumes list to be created with logs, and config to be appended, but got %+v", patch)
+	}
+
+	// volumes the pod already has are not added
+	patch = addVolumes([]corev1.Volume{logs}, []corev1.Volume{logs, config}, "/spec/volumes")
+	if len(patch) != 1 || patch[0].Path != "/spec/volumes/-" || !reflect.DeepEqual(patch[0].Value, config) {
+		t.Errorf("expected only config to be appended, but got %+v", patch)
+	}
+}